@@ -0,0 +1,304 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-mysql-org/go-mysql/client"
+	"github.com/go-mysql-org/go-mysql/mysql"
+)
+
+// operation is a statement of the workload, written with placeholders and
+// sent either prepared or with its arguments inlined
+type operation struct {
+	name  string
+	query string
+	args  func(rng *rand.Rand, rows int) []interface{}
+}
+
+var readOperations = []operation{
+	{
+		name:  "point_select",
+		query: "SELECT id, name, price FROM products WHERE id = ?",
+		args: func(rng *rand.Rand, rows int) []interface{} {
+			return []interface{}{rng.Intn(rows) + 1}
+		},
+	},
+	{
+		name:  "range_select",
+		query: "SELECT id, name, price FROM products WHERE id BETWEEN ? AND ?",
+		args: func(rng *rand.Rand, rows int) []interface{} {
+			id := rng.Intn(rows) + 1
+			return []interface{}{id, id + 20}
+		},
+	},
+	{
+		name:  "types_select",
+		query: "SELECT * FROM data_types_demo WHERE id = ?",
+		args: func(rng *rand.Rand, rows int) []interface{} {
+			return []interface{}{rng.Intn(typesRows(rows)) + 1}
+		},
+	},
+}
+
+var writeOperations = []operation{
+	{
+		name:  "update_price",
+		query: "UPDATE products SET price = ? WHERE id = ?",
+		args: func(rng *rand.Rand, rows int) []interface{} {
+			return []interface{}{float64(rng.Intn(100000)) / 100, rng.Intn(rows) + 1}
+		},
+	},
+	{
+		name:  "insert_types",
+		query: "INSERT INTO data_types_demo (int_col, big_int_col, double_col, date_col, varchar_col, enum_col) VALUES (?, ?, ?, ?, ?, ?)",
+		args: func(rng *rand.Rand, rows int) []interface{} {
+			return []interface{}{
+				rng.Int31(),
+				rng.Int63(),
+				rng.Float64() * 1000,
+				time.Now().Format("2006-01-02"),
+				fmt.Sprintf("bench %d", rng.Int()),
+				fmt.Sprintf("value%d", rng.Intn(3)+1),
+			}
+		},
+	},
+}
+
+func typesRows(rows int) int {
+	return max(rows/10, 1)
+}
+
+// inline replaces the placeholders of a query with its arguments for the
+// text protocol
+func inline(query string, args []interface{}) string {
+	var out strings.Builder
+	n := 0
+	for _, c := range query {
+		if c != '?' || n >= len(args) {
+			out.WriteRune(c)
+			continue
+		}
+		switch v := args[n].(type) {
+		case string:
+			out.WriteString("'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(v) + "'")
+		case float64:
+			out.WriteString(fmt.Sprintf("%g", v))
+		default:
+			out.WriteString(fmt.Sprintf("%v", v))
+		}
+		n++
+	}
+	return out.String()
+}
+
+type Bench struct {
+	config *Config
+}
+
+func NewBench(config *Config) *Bench {
+	return &Bench{config: config}
+}
+
+func (b *Bench) connect(target *TargetConfig, database string) (*client.Conn, error) {
+	return client.Connect(fmt.Sprintf("%s:%d", target.Host, target.Port), target.User, target.Password, database)
+}
+
+// readSchema reads one of the schema files cmd/create-db uses
+func readSchema(name string) (string, error) {
+	path := "data/schema/" + name
+	data, err := os.ReadFile(path)
+	if err != nil {
+		data, err = os.ReadFile("../../" + path)
+		if err != nil {
+			return "", fmt.Errorf("failed to read schema: %w", err)
+		}
+	}
+	return string(data), nil
+}
+
+// Setup recreates the benchmark database through the first target and seeds
+// it, every target must reach the same data
+func (b *Bench) Setup() error {
+	target := &b.config.Targets[0]
+	log.Printf("setting up %s through %s", b.config.Database, target.Name)
+
+	conn, err := b.connect(target, "")
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	for _, query := range []string{
+		fmt.Sprintf("DROP DATABASE IF EXISTS %s", b.config.Database),
+		fmt.Sprintf("CREATE DATABASE %s", b.config.Database),
+	} {
+		if _, err := conn.Execute(query); err != nil {
+			return err
+		}
+	}
+	if err := conn.UseDB(b.config.Database); err != nil {
+		return err
+	}
+
+	for _, file := range []string{"products.sql", "data_types_demo.sql"} {
+		schema, err := readSchema(file)
+		if err != nil {
+			return err
+		}
+		if _, err := conn.Execute(schema); err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	insert := func(prefix string, rows int, value func(i int) string) error {
+		const batch = 500
+		for i := 0; i < rows; i += batch {
+			values := make([]string, 0, batch)
+			for j := i; j < min(i+batch, rows); j++ {
+				values = append(values, value(j))
+			}
+			if _, err := conn.Execute(prefix + strings.Join(values, ", ")); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if err := insert("INSERT INTO products (name, price) VALUES ", b.config.Rows, func(i int) string {
+		return fmt.Sprintf("('product %d', %.2f)", i+1, float64(rng.Intn(100000))/100)
+	}); err != nil {
+		return err
+	}
+	if err := insert("INSERT INTO data_types_demo (tiny_int_col, int_col, big_int_col, double_col, decimal_col, date_col, datetime_col, varchar_col, text_col, enum_col, set_col, boolean_col) VALUES ",
+		typesRows(b.config.Rows), func(i int) string {
+			return fmt.Sprintf("(%d, %d, %d, %g, %.2f, '2024-01-%02d', '2024-01-01 12:%02d:00', 'row %d', '%s', 'value%d', 'option1,option%d', %d)",
+				rng.Intn(128), rng.Int31(), rng.Int63(), rng.Float64()*1000, float64(rng.Intn(100000))/100, i%28+1, i%60, i,
+				strings.Repeat("x", rng.Intn(200)), i%3+1, i%3+1, i%2)
+		}); err != nil {
+		return err
+	}
+
+	// give replicas behind the first target a moment to catch up
+	time.Sleep(time.Second)
+	return nil
+}
+
+// Run runs every scenario against every target, one after the other
+func (b *Bench) Run() *Report {
+	report := &Report{}
+	for _, scenario := range b.config.Scenarios {
+		for i := range b.config.Targets {
+			target := &b.config.Targets[i]
+			log.Printf("running %s against %s (%s:%d)", scenario.Name, target.Name, target.Host, target.Port)
+			report.Results = append(report.Results, b.runScenario(target, &scenario))
+		}
+	}
+	return report
+}
+
+func (b *Bench) runScenario(target *TargetConfig, scenario *ScenarioConfig) *Result {
+	start := time.Now()
+	measureFrom := start.Add(time.Duration(b.config.Warmup) * time.Second)
+	deadline := measureFrom.Add(time.Duration(b.config.Duration) * time.Second)
+
+	recorders := make([]*recorder, b.config.Concurrency)
+	var wg sync.WaitGroup
+	for i := range recorders {
+		recorders[i] = &recorder{}
+		wg.Add(1)
+		go func(rec *recorder, seed int64) {
+			defer wg.Done()
+			b.worker(target, scenario, rand.New(rand.NewSource(seed)), measureFrom, deadline, rec)
+		}(recorders[i], int64(i)+1)
+	}
+	wg.Wait()
+
+	return newResult(target.Name, scenario, time.Duration(b.config.Duration)*time.Second, recorders)
+}
+
+// worker sends statements until the deadline, counting those sent after
+// measureFrom. With reconnect_every set the connection time is part of the
+// latency of the first statement on each connection.
+func (b *Bench) worker(target *TargetConfig, scenario *ScenarioConfig, rng *rand.Rand, measureFrom time.Time, deadline time.Time, rec *recorder) {
+	var conn *client.Conn
+	var stmts map[string]*client.Stmt
+	used := 0
+
+	closeConn := func() {
+		for _, stmt := range stmts {
+			stmt.Close()
+		}
+		if conn != nil {
+			conn.Close()
+		}
+		conn = nil
+		stmts = nil
+	}
+	defer closeConn()
+
+	for time.Now().Before(deadline) {
+		start := time.Now()
+		measured := start.After(measureFrom)
+
+		if conn != nil && scenario.ReconnectEvery > 0 && used >= scenario.ReconnectEvery {
+			closeConn()
+		}
+		if conn == nil {
+			var err error
+			conn, err = b.connect(target, b.config.Database)
+			if err != nil {
+				if measured {
+					rec.connectErrors++
+				}
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			stmts = make(map[string]*client.Stmt)
+			used = 0
+			if measured {
+				rec.connects++
+			}
+		}
+
+		op := &readOperations[rng.Intn(len(readOperations))]
+		write := rng.Float64() >= scenario.ReadRatio
+		if write {
+			op = &writeOperations[rng.Intn(len(writeOperations))]
+		}
+		args := op.args(rng, b.config.Rows)
+
+		var err error
+		if scenario.Protocol == "prepared" {
+			stmt, ok := stmts[op.name]
+			if !ok {
+				stmt, err = conn.Prepare(op.query)
+				if err == nil {
+					stmts[op.name] = stmt
+				}
+			}
+			if err == nil {
+				_, err = stmt.Execute(args...)
+			}
+		} else {
+			_, err = conn.Execute(inline(op.query, args))
+		}
+		used++
+
+		if measured {
+			rec.add(time.Since(start), write, err)
+		}
+		var myErr *mysql.MyError
+		if err != nil && !errors.As(err, &myErr) {
+			// connection trouble rather than a statement error
+			closeConn()
+		}
+	}
+}
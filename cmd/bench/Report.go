@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// recorder collects the measurements of one worker
+type recorder struct {
+	latencies     []time.Duration
+	reads         int
+	writes        int
+	errors        int
+	connects      int
+	connectErrors int
+}
+
+func (r *recorder) add(latency time.Duration, write bool, err error) {
+	r.latencies = append(r.latencies, latency)
+	if write {
+		r.writes++
+	} else {
+		r.reads++
+	}
+	if err != nil {
+		r.errors++
+	}
+}
+
+type Result struct {
+	Target        string  `json:"target"`
+	Scenario      string  `json:"scenario"`
+	Protocol      string  `json:"protocol"`
+	ReadRatio     float64 `json:"read_ratio"`
+	Statements    int     `json:"statements"`
+	Reads         int     `json:"reads"`
+	Writes        int     `json:"writes"`
+	Errors        int     `json:"errors"`
+	Connects      int     `json:"connects"`
+	ConnectErrors int     `json:"connect_errors"`
+	Throughput    float64 `json:"throughput"` // statements per second
+	P50           float64 `json:"p50_ms"`
+	P95           float64 `json:"p95_ms"`
+	P99           float64 `json:"p99_ms"`
+	Max           float64 `json:"max_ms"`
+}
+
+func percentile(sorted []time.Duration, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(float64(len(sorted)-1) * p)
+	return float64(sorted[i].Microseconds()) / 1000
+}
+
+func newResult(target string, scenario *ScenarioConfig, duration time.Duration, recorders []*recorder) *Result {
+	result := &Result{
+		Target:    target,
+		Scenario:  scenario.Name,
+		Protocol:  scenario.Protocol,
+		ReadRatio: scenario.ReadRatio,
+	}
+
+	var latencies []time.Duration
+	for _, rec := range recorders {
+		latencies = append(latencies, rec.latencies...)
+		result.Reads += rec.reads
+		result.Writes += rec.writes
+		result.Errors += rec.errors
+		result.Connects += rec.connects
+		result.ConnectErrors += rec.connectErrors
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	result.Statements = len(latencies)
+	if duration > 0 {
+		result.Throughput = float64(result.Statements) / duration.Seconds()
+	}
+	result.P50 = percentile(latencies, 0.50)
+	result.P95 = percentile(latencies, 0.95)
+	result.P99 = percentile(latencies, 0.99)
+	result.Max = percentile(latencies, 1)
+	return result
+}
+
+type Report struct {
+	Results []*Result `json:"results"`
+}
+
+func (r *Report) Print(out io.Writer) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SCENARIO\tTARGET\tPROTOCOL\tREADS\tSTMTS/S\tP50 MS\tP95 MS\tP99 MS\tMAX MS\tERRORS\tCONNECTS\tOVERHEAD P50")
+
+	// the first target of each scenario is the baseline
+	baselines := make(map[string]*Result)
+	for _, result := range r.Results {
+		overhead := "baseline"
+		if baseline, ok := baselines[result.Scenario]; ok {
+			overhead = fmt.Sprintf("%+.2f ms", result.P50-baseline.P50)
+		} else {
+			baselines[result.Scenario] = result
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%.0f%%\t%.0f\t%.2f\t%.2f\t%.2f\t%.2f\t%d\t%d\t%s\n",
+			result.Scenario, result.Target, result.Protocol, result.ReadRatio*100, result.Throughput,
+			result.P50, result.P95, result.P99, result.Max, result.Errors+result.ConnectErrors, result.Connects, overhead)
+	}
+	w.Flush()
+}
+
+func (r *Report) Save(path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, data, 0640); err != nil {
+		return fmt.Errorf("failed to write report: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+type TargetConfig struct {
+	Name     string `yaml:"name"`
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"`
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+}
+
+type ScenarioConfig struct {
+	Name           string  `yaml:"name"`
+	ReadRatio      float64 `yaml:"read_ratio"`      // share of reads, the rest are writes
+	Protocol       string  `yaml:"protocol"`        // text or prepared
+	ReconnectEvery int     `yaml:"reconnect_every"` // statements per connection before reconnecting, 0 keeps connections open
+}
+
+type Config struct {
+	Targets     []TargetConfig   `yaml:"targets"` // the first target is the baseline others are compared to
+	Database    string           `yaml:"database"`
+	Setup       bool             `yaml:"setup"` // recreate and seed the schemas through the first target before running
+	Rows        int              `yaml:"rows"`  // products rows seeded, data_types_demo gets a tenth of that
+	Concurrency int              `yaml:"concurrency"`
+	Duration    int              `yaml:"duration"` // seconds per scenario and target
+	Warmup      int              `yaml:"warmup"`   // seconds run before measuring
+	Scenarios   []ScenarioConfig `yaml:"scenarios"`
+	Report      string           `yaml:"report"` // JSON report file, the summary is always printed
+}
+
+func loadConfig(path string) (*Config, error) {
+	config := Config{
+		Database:    "dbinsight_bench",
+		Setup:       true,
+		Rows:        10000,
+		Concurrency: 16,
+		Duration:    30,
+		Warmup:      5,
+	}
+
+	configFile, err := os.Open(path)
+	if err != nil {
+		// for debugging
+		configFile, err = os.Open("../../" + path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open config file: %w", err)
+		}
+	}
+	defer configFile.Close()
+
+	decoder := yaml.NewDecoder(configFile)
+	err = decoder.Decode(&config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode config file: %w", err)
+	}
+
+	if len(config.Targets) == 0 {
+		return nil, fmt.Errorf("no targets configured")
+	}
+	if len(config.Scenarios) == 0 {
+		config.Scenarios = []ScenarioConfig{{Name: "default", ReadRatio: 0.8, Protocol: "text"}}
+	}
+	for _, scenario := range config.Scenarios {
+		if scenario.Protocol != "text" && scenario.Protocol != "prepared" {
+			return nil, fmt.Errorf("scenario %s: unknown protocol: %s", scenario.Name, scenario.Protocol)
+		}
+		if scenario.ReadRatio < 0 || scenario.ReadRatio > 1 {
+			return nil, fmt.Errorf("scenario %s: read_ratio must be between 0 and 1", scenario.Name)
+		}
+	}
+	if config.Rows < 1 {
+		config.Rows = 1
+	}
+
+	return &config, nil
+}
+
+func main() {
+	configPath := flag.String("config", "data/config/bench.yaml", "path to the configuration file")
+	skipSetup := flag.Bool("skip-setup", false, "use the existing schemas instead of recreating them")
+	flag.Parse()
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *skipSetup {
+		cfg.Setup = false
+	}
+
+	bench := NewBench(cfg)
+
+	if cfg.Setup {
+		if err := bench.Setup(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	report := bench.Run()
+	report.Print(os.Stdout)
+	if cfg.Report != "" {
+		if err := report.Save(cfg.Report); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
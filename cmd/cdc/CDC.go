@@ -0,0 +1,320 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-mysql-org/go-mysql/canal"
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/replication"
+	canallog "github.com/siddontang/go-log/log"
+)
+
+// CDC tails the primary's row based binlog and writes every change to a sink
+type CDC struct {
+	config *Config
+	sink   Sink
+	canal  *canal.Canal
+
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+
+	mu             sync.Mutex
+	gtid           string   // GTID of the transaction being read
+	changedTables  []string // tables reported by OnTableChanged for the next DDL
+	lastCheckpoint time.Time
+
+	stopOnce sync.Once
+}
+
+func NewCDC(config *Config, sink Sink) (*CDC, error) {
+	cfg := canal.NewDefaultConfig()
+	cfg.Addr = fmt.Sprintf("%s:%d", config.Host, config.Port)
+	cfg.User = config.User
+	cfg.Password = config.Password
+	cfg.ServerID = config.ServerID
+	cfg.Flavor = config.Flavor
+	cfg.IncludeTableRegex = config.IncludeTables
+	cfg.ExcludeTableRegex = config.ExcludeTables
+	// binlog only, no initial mysqldump
+	cfg.Dump.ExecutionPath = ""
+
+	// stdout may be the sink, keep canal's own logging out of it
+	streamHandler, err := canallog.NewStreamHandler(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Logger = canallog.NewDefault(streamHandler)
+
+	cdc := &CDC{
+		config: config,
+		sink:   sink,
+	}
+
+	for _, pattern := range config.IncludeTables {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid include_tables pattern %q: %w", pattern, err)
+		}
+		cdc.include = append(cdc.include, re)
+	}
+	for _, pattern := range config.ExcludeTables {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exclude_tables pattern %q: %w", pattern, err)
+		}
+		cdc.exclude = append(cdc.exclude, re)
+	}
+
+	c, err := canal.NewCanal(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create canal: %w", err)
+	}
+	c.SetEventHandler(&eventHandler{cdc: cdc})
+	cdc.canal = c
+
+	return cdc, nil
+}
+
+// Run streams from the checkpoint, or from the primary's current position
+// when there is none, until Stop is called or the stream fails
+func (cdc *CDC) Run() error {
+	checkpoint, err := LoadCheckpoint(cdc.config.CheckpointFile)
+	if err != nil {
+		return err
+	}
+
+	if checkpoint != nil && checkpoint.GTIDSet != "" {
+		gset, err := mysql.ParseGTIDSet(cdc.config.Flavor, checkpoint.GTIDSet)
+		if err != nil {
+			return fmt.Errorf("invalid checkpoint gtid set: %w", err)
+		}
+		log.Printf("Resuming from GTID set %s", gset)
+		return cdc.canal.StartFromGTID(gset)
+	}
+
+	if checkpoint != nil && checkpoint.File != "" {
+		pos := mysql.Position{Name: checkpoint.File, Pos: checkpoint.Pos}
+		log.Printf("Resuming from %s", pos)
+		return cdc.canal.RunFrom(pos)
+	}
+
+	// first run, prefer GTIDs so the checkpoint survives a primary failover
+	gset, err := cdc.canal.GetMasterGTIDSet()
+	if err == nil && gset != nil && gset.String() != "" {
+		log.Printf("Starting from GTID set %s", gset)
+		return cdc.canal.StartFromGTID(gset)
+	}
+
+	pos, err := cdc.canal.GetMasterPos()
+	if err != nil {
+		return fmt.Errorf("failed to read binlog position: %w", err)
+	}
+	log.Printf("Starting from %s", pos)
+	return cdc.canal.RunFrom(pos)
+}
+
+func (cdc *CDC) Stop() {
+	cdc.stopOnce.Do(cdc.canal.Close)
+}
+
+// Close stops streaming, writes a final checkpoint and closes the sink
+func (cdc *CDC) Close() error {
+	cdc.Stop()
+
+	pos := cdc.canal.SyncedPosition()
+	if pos.Name != "" {
+		if err := cdc.saveCheckpoint(pos, cdc.canal.SyncedGTIDSet()); err != nil {
+			log.Println(err)
+		}
+	}
+
+	return cdc.sink.Close()
+}
+
+func (cdc *CDC) tableMatches(database string, table string) bool {
+	key := database + "." + table
+
+	matched := len(cdc.include) == 0
+	for _, re := range cdc.include {
+		if re.MatchString(key) {
+			matched = true
+			break
+		}
+	}
+	if !matched {
+		return false
+	}
+
+	for _, re := range cdc.exclude {
+		if re.MatchString(key) {
+			return false
+		}
+	}
+	return true
+}
+
+func (cdc *CDC) saveCheckpoint(pos mysql.Position, gset mysql.GTIDSet) error {
+	checkpoint := &Checkpoint{
+		File: pos.Name,
+		Pos:  pos.Pos,
+	}
+	if gset != nil {
+		checkpoint.GTIDSet = gset.String()
+	}
+	return checkpoint.Save(cdc.config.CheckpointFile)
+}
+
+type eventHandler struct {
+	canal.DummyEventHandler
+	cdc *CDC
+}
+
+func (h *eventHandler) position(header *replication.EventHeader) string {
+	return fmt.Sprintf("%s:%d", h.cdc.canal.SyncedPosition().Name, header.LogPos)
+}
+
+func (h *eventHandler) OnGTID(header *replication.EventHeader, e mysql.BinlogGTIDEvent) error {
+	gset, err := e.GTIDNext()
+	if err != nil {
+		return err
+	}
+
+	h.cdc.mu.Lock()
+	h.cdc.gtid = gset.String()
+	h.cdc.mu.Unlock()
+
+	return nil
+}
+
+func (h *eventHandler) OnRow(e *canal.RowsEvent) error {
+	h.cdc.mu.Lock()
+	gtid := h.cdc.gtid
+	h.cdc.mu.Unlock()
+
+	newEvent := func() *ChangeEvent {
+		return &ChangeEvent{
+			Type:      e.Action,
+			Database:  e.Table.Schema,
+			Table:     e.Table.Name,
+			Timestamp: e.Header.Timestamp,
+			Position:  h.position(e.Header),
+			GTID:      gtid,
+		}
+	}
+
+	switch e.Action {
+	case canal.UpdateAction:
+		// rows come in before/after pairs
+		for i := 0; i+1 < len(e.Rows); i += 2 {
+			event := newEvent()
+			event.Before = rowToMap(e, e.Rows[i])
+			event.After = rowToMap(e, e.Rows[i+1])
+			if err := h.cdc.sink.Write(event); err != nil {
+				return err
+			}
+		}
+	case canal.InsertAction:
+		for _, row := range e.Rows {
+			event := newEvent()
+			event.After = rowToMap(e, row)
+			if err := h.cdc.sink.Write(event); err != nil {
+				return err
+			}
+		}
+	case canal.DeleteAction:
+		for _, row := range e.Rows {
+			event := newEvent()
+			event.Before = rowToMap(e, row)
+			if err := h.cdc.sink.Write(event); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// OnTableChanged is called for each table a DDL statement touches, right
+// before OnDDL
+func (h *eventHandler) OnTableChanged(header *replication.EventHeader, schema string, table string) error {
+	h.cdc.mu.Lock()
+	defer h.cdc.mu.Unlock()
+	h.cdc.changedTables = append(h.cdc.changedTables, schema+"."+table)
+	return nil
+}
+
+func (h *eventHandler) OnDDL(header *replication.EventHeader, nextPos mysql.Position, e *replication.QueryEvent) error {
+	h.cdc.mu.Lock()
+	tables := h.cdc.changedTables
+	h.cdc.changedTables = nil
+	gtid := h.cdc.gtid
+	h.cdc.mu.Unlock()
+
+	event := &ChangeEvent{
+		Type:      "ddl",
+		Database:  string(e.Schema),
+		Timestamp: header.Timestamp,
+		Position:  fmt.Sprintf("%s:%d", nextPos.Name, header.LogPos),
+		GTID:      gtid,
+		Query:     string(e.Query),
+	}
+
+	matched := false
+	for _, name := range tables {
+		database, table, _ := strings.Cut(name, ".")
+		if h.cdc.tableMatches(database, table) {
+			matched = true
+			event.Database = database
+			event.Table = table
+			break
+		}
+	}
+	if !matched {
+		return nil
+	}
+
+	return h.cdc.sink.Write(event)
+}
+
+// OnPosSynced is called at transaction boundaries, the checkpoint is
+// written at most every checkpoint_interval seconds unless canal forces it
+// (after DDL)
+func (h *eventHandler) OnPosSynced(header *replication.EventHeader, pos mysql.Position, set mysql.GTIDSet, force bool) error {
+	h.cdc.mu.Lock()
+	due := force || time.Since(h.cdc.lastCheckpoint) >= time.Duration(h.cdc.config.CheckpointInterval)*time.Second
+	if due {
+		h.cdc.lastCheckpoint = time.Now()
+	}
+	h.cdc.mu.Unlock()
+
+	if !due {
+		return nil
+	}
+	return h.cdc.saveCheckpoint(pos, set)
+}
+
+func (h *eventHandler) String() string {
+	return "dbinsight-cdc"
+}
+
+func rowToMap(e *canal.RowsEvent, row []interface{}) map[string]interface{} {
+	values := make(map[string]interface{}, len(e.Table.Columns))
+	for i, column := range e.Table.Columns {
+		if i >= len(row) {
+			break
+		}
+		value := row[i]
+		// text and blob columns arrive as []byte which json would base64
+		if b, ok := value.([]byte); ok {
+			value = string(b)
+		}
+		values[column.Name] = value
+	}
+	return values
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// Checkpoint is the last binlog position whose events were delivered to
+// the sink, a restarted CDC resumes from here
+type Checkpoint struct {
+	GTIDSet string `json:"gtid_set,omitempty"`
+	File    string `json:"file,omitempty"`
+	Pos     uint32 `json:"pos,omitempty"`
+}
+
+func LoadCheckpoint(path string) (*Checkpoint, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read checkpoint %s: %w", path, err)
+	}
+
+	checkpoint := &Checkpoint{}
+	if err := json.Unmarshal(data, checkpoint); err != nil {
+		return nil, fmt.Errorf("failed to decode checkpoint %s: %w", path, err)
+	}
+
+	return checkpoint, nil
+}
+
+// Save writes the checkpoint through a temporary file so a crash never
+// leaves a truncated checkpoint behind
+func (cp *Checkpoint) Save(path string) error {
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write checkpoint %s: %w", tmp, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to rename checkpoint %s: %w", tmp, err)
+	}
+
+	return nil
+}
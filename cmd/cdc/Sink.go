@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// ChangeEvent is one line of CDC output
+type ChangeEvent struct {
+	Type      string                 `json:"type"` // insert, update, delete or ddl
+	Database  string                 `json:"database"`
+	Table     string                 `json:"table,omitempty"`
+	Timestamp uint32                 `json:"timestamp"`
+	Position  string                 `json:"position"` // binlog file:offset of the event
+	GTID      string                 `json:"gtid,omitempty"`
+	Before    map[string]interface{} `json:"before,omitempty"`
+	After     map[string]interface{} `json:"after,omitempty"`
+	Query     string                 `json:"query,omitempty"` // ddl only
+}
+
+// Sink delivers change events, Write must not return until the event is
+// durably handed off since the checkpoint advances right after
+type Sink interface {
+	Write(event *ChangeEvent) error
+	Close() error
+}
+
+func NewSink(config *SinkConfig) (Sink, error) {
+	switch config.Type {
+	case "", "stdout":
+		return &StreamSink{out: os.Stdout}, nil
+	case "file":
+		return NewFileSink(config.Path, config.MaxSize)
+	case "webhook":
+		return NewWebhookSink(config.URL, time.Duration(config.Timeout)*time.Second)
+	default:
+		return nil, fmt.Errorf("unknown sink type: %s", config.Type)
+	}
+}
+
+// StreamSink writes JSON lines to an already open stream such as stdout
+type StreamSink struct {
+	out *os.File
+	mu  sync.Mutex
+}
+
+func (s *StreamSink) Write(event *ChangeEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.out.Write(append(line, '\n'))
+	return err
+}
+
+func (s *StreamSink) Close() error {
+	return s.out.Sync()
+}
+
+// FileSink writes JSON lines to a file, renaming it with a timestamp suffix
+// once it grows past maxSize
+type FileSink struct {
+	path    string
+	maxSize int64
+	file    *os.File
+	size    int64
+	mu      sync.Mutex
+}
+
+func NewFileSink(path string, maxSize int64) (*FileSink, error) {
+	if path == "" {
+		return nil, fmt.Errorf("file sink requires a path")
+	}
+	s := &FileSink{
+		path:    path,
+		maxSize: maxSize,
+	}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileSink) open() error {
+	file, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", s.path, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	s.file = file
+	s.size = info.Size()
+	return nil
+}
+
+func (s *FileSink) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	rotated := fmt.Sprintf("%s.%s", s.path, time.Now().Format("20060102-150405.000"))
+	if err := os.Rename(s.path, rotated); err != nil {
+		return fmt.Errorf("failed to rotate %s: %w", s.path, err)
+	}
+	return s.open()
+}
+
+func (s *FileSink) Write(event *ChangeEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.maxSize > 0 && s.size > 0 && s.size+int64(len(line)) > s.maxSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := s.file.Write(line)
+	s.size += int64(n)
+	return err
+}
+
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+	return s.file.Close()
+}
+
+// WebhookSink POSTs every event as a JSON document, retrying until the
+// endpoint accepts it with a 2xx response
+type WebhookSink struct {
+	url      string
+	client   *http.Client
+	shutdown chan struct{}
+	once     sync.Once
+}
+
+func NewWebhookSink(url string, timeout time.Duration) (*WebhookSink, error) {
+	if url == "" {
+		return nil, fmt.Errorf("webhook sink requires a url")
+	}
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	return &WebhookSink{
+		url:      url,
+		client:   &http.Client{Timeout: timeout},
+		shutdown: make(chan struct{}),
+	}, nil
+}
+
+func (s *WebhookSink) Write(event *ChangeEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	delay := 100 * time.Millisecond
+	for {
+		err = s.post(body)
+		if err == nil {
+			return nil
+		}
+		log.Printf("webhook delivery failed, retrying in %s: %v", delay, err)
+
+		select {
+		case <-time.After(delay):
+		case <-s.shutdown:
+			return fmt.Errorf("webhook delivery aborted: %w", err)
+		}
+		delay = min(delay*2, 30*time.Second)
+	}
+}
+
+func (s *WebhookSink) post(body []byte) error {
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return nil
+}
+
+func (s *WebhookSink) Close() error {
+	s.once.Do(func() { close(s.shutdown) })
+	return nil
+}
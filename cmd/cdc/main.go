@@ -0,0 +1,105 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"gopkg.in/yaml.v3"
+)
+
+type SinkConfig struct {
+	Type    string `yaml:"type"`     // stdout, file or webhook
+	Path    string `yaml:"path"`     // file sink: output file
+	MaxSize int64  `yaml:"max_size"` // file sink: bytes before the file is rotated, 0 never rotates
+	URL     string `yaml:"url"`      // webhook sink: endpoint events are POSTed to
+	Timeout int    `yaml:"timeout"`  // webhook sink: seconds per request
+}
+
+type Config struct {
+	Host               string     `yaml:"host"`
+	Port               int        `yaml:"port"`
+	User               string     `yaml:"user"` // needs REPLICATION SLAVE, REPLICATION CLIENT and SELECT
+	Password           string     `yaml:"password"`
+	ServerID           uint32     `yaml:"server_id"`      // must be unique among the primary's replicas
+	Flavor             string     `yaml:"flavor"`         // mysql or mariadb
+	IncludeTables      []string   `yaml:"include_tables"` // regular expressions matched against database.table
+	ExcludeTables      []string   `yaml:"exclude_tables"`
+	CheckpointFile     string     `yaml:"checkpoint_file"`
+	CheckpointInterval int        `yaml:"checkpoint_interval"` // seconds between checkpoint writes
+	Sink               SinkConfig `yaml:"sink"`
+}
+
+func loadConfig(path string) (*Config, error) {
+	config := Config{
+		Host:               "127.0.0.1",
+		Port:               3306,
+		User:               "root",
+		ServerID:           1002,
+		Flavor:             "mysql",
+		CheckpointFile:     "data/cdc.checkpoint",
+		CheckpointInterval: 5,
+		Sink: SinkConfig{
+			Type:    "stdout",
+			Timeout: 10,
+		},
+	}
+
+	configFile, err := os.Open(path)
+	if err != nil {
+		// for debugging
+		configFile, err = os.Open("../../" + path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open config file: %w", err)
+		}
+	}
+	defer configFile.Close()
+
+	decoder := yaml.NewDecoder(configFile)
+	err = decoder.Decode(&config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode config file: %w", err)
+	}
+
+	return &config, nil
+}
+
+func main() {
+	configPath := flag.String("config", "data/config/cdc.yaml", "path to the configuration file")
+	flag.Parse()
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	sink, err := NewSink(&cfg.Sink)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	cdc, err := NewCDC(cfg, sink)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	sigchan := make(chan os.Signal, 1)
+	signal.Notify(sigchan, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigchan
+		log.Println("Received Unix signal, initiating shutdown...")
+		cdc.Stop()
+	}()
+
+	if err := cdc.Run(); err != nil {
+		log.Println(err)
+	}
+
+	if err := cdc.Close(); err != nil {
+		log.Fatal(err)
+	}
+	log.Println("CDC stopped")
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	AllowlistModeOff     = "off"
+	AllowlistModeLearn   = "learn"
+	AllowlistModeEnforce = "enforce"
+
+	AllowlistActionBlock = "block"
+	AllowlistActionAlert = "alert"
+)
+
+type AllowlistConfig struct {
+	Mode                 string   `yaml:"mode"`                   // off, learn or enforce
+	File                 string   `yaml:"file"`                   // where learned fingerprints are stored
+	Users                []string `yaml:"users"`                  // users subject to the allowlist, empty means everyone
+	LearnDuration        int      `yaml:"learn_duration"`         // seconds to learn for, 0 learns until restarted
+	EnforceAfterLearning bool     `yaml:"enforce_after_learning"` // switch to enforce once learn_duration passes
+	Action               string   `yaml:"action"`                 // block or alert on unknown queries
+	FlushInterval        int      `yaml:"flush_interval"`         // seconds between writes of the allowlist file
+	ErrorCode            uint16   `yaml:"error_code"`
+	ErrorMessage         string   `yaml:"error_message"`
+}
+
+// a learned query fingerprint as stored in the allowlist file
+type AllowlistEntry struct {
+	Digest    string    `yaml:"digest"`
+	Query     string    `yaml:"query"`
+	FirstSeen time.Time `yaml:"first_seen"`
+}
+
+// Allowlist records the distinct query fingerprints issued by each user
+// while learning and rejects (or reports) anything else while enforcing.
+type Allowlist struct {
+	config     *AllowlistConfig
+	users      map[string]bool
+	mu         sync.RWMutex
+	mode       string
+	learnUntil time.Time
+	entries    map[string]map[string]*AllowlistEntry // user -> digest -> entry
+	dirty      bool
+	shutdown   chan struct{}
+	wg         sync.WaitGroup
+}
+
+func NewAllowlist(config *AllowlistConfig) (*Allowlist, error) {
+	if config.Mode == "" {
+		config.Mode = AllowlistModeOff
+	}
+	if config.Mode != AllowlistModeOff && config.Mode != AllowlistModeLearn && config.Mode != AllowlistModeEnforce {
+		return nil, fmt.Errorf("allowlist: invalid mode: %s", config.Mode)
+	}
+	if config.Action == "" {
+		config.Action = AllowlistActionBlock
+	}
+	if config.Action != AllowlistActionBlock && config.Action != AllowlistActionAlert {
+		return nil, fmt.Errorf("allowlist: invalid action: %s", config.Action)
+	}
+	if config.File == "" {
+		config.File = "data/allowlist.yaml"
+	}
+	if config.FlushInterval <= 0 {
+		config.FlushInterval = 10
+	}
+	if config.ErrorCode == 0 {
+		config.ErrorCode = mysql.ER_SPECIFIC_ACCESS_DENIED_ERROR
+	}
+	if config.ErrorMessage == "" {
+		config.ErrorMessage = "Statement not in dbinsight allowlist"
+	}
+
+	al := &Allowlist{
+		config:   config,
+		mode:     config.Mode,
+		entries:  make(map[string]map[string]*AllowlistEntry),
+		shutdown: make(chan struct{}),
+	}
+
+	if len(config.Users) > 0 {
+		al.users = make(map[string]bool, len(config.Users))
+		for _, user := range config.Users {
+			al.users[user] = true
+		}
+	}
+
+	if config.Mode == AllowlistModeOff {
+		return al, nil
+	}
+
+	if err := al.load(); err != nil {
+		return nil, err
+	}
+
+	if config.Mode == AllowlistModeEnforce && len(al.entries) == 0 {
+		logFor("allowlist").Warn("enforce mode enabled but no queries were learned", "file", config.File)
+	}
+
+	return al, nil
+}
+
+func (al *Allowlist) load() error {
+	data, err := os.ReadFile(al.config.File)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("allowlist: failed to read %s: %w", al.config.File, err)
+	}
+
+	stored := make(map[string][]*AllowlistEntry)
+	if err := yaml.Unmarshal(data, &stored); err != nil {
+		return fmt.Errorf("allowlist: failed to decode %s: %w", al.config.File, err)
+	}
+
+	for user, entries := range stored {
+		digests := make(map[string]*AllowlistEntry, len(entries))
+		for _, entry := range entries {
+			digests[entry.Digest] = entry
+		}
+		al.entries[user] = digests
+	}
+
+	return nil
+}
+
+// Start begins periodic flushing of learned fingerprints
+func (al *Allowlist) Start() {
+	if al.config.Mode == AllowlistModeOff {
+		return
+	}
+
+	al.mu.Lock()
+	if al.mode == AllowlistModeLearn && al.config.LearnDuration > 0 {
+		al.learnUntil = time.Now().Add(time.Duration(al.config.LearnDuration) * time.Second)
+	}
+	al.mu.Unlock()
+
+	al.wg.Add(1)
+	go func() {
+		defer al.wg.Done()
+		ticker := time.NewTicker(time.Duration(al.config.FlushInterval) * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				al.checkLearnPeriod()
+				if err := al.Flush(); err != nil {
+					logFor("allowlist").Error("failed to flush learned queries", "err", err)
+				}
+			case <-al.shutdown:
+				return
+			}
+		}
+	}()
+}
+
+// Stop writes any unsaved fingerprints and stops the flush thread
+func (al *Allowlist) Stop() error {
+	if al.config.Mode == AllowlistModeOff {
+		return nil
+	}
+	close(al.shutdown)
+	al.wg.Wait()
+	return al.Flush()
+}
+
+func (al *Allowlist) checkLearnPeriod() {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	if al.mode != AllowlistModeLearn || al.learnUntil.IsZero() || time.Now().Before(al.learnUntil) {
+		return
+	}
+
+	if al.config.EnforceAfterLearning {
+		logFor("allowlist").Info("learning period finished, switching to enforce mode")
+		al.mode = AllowlistModeEnforce
+	} else {
+		logFor("allowlist").Info("learning period finished")
+		al.mode = AllowlistModeOff
+	}
+}
+
+// Flush writes the learned fingerprints to the allowlist file
+func (al *Allowlist) Flush() error {
+	al.mu.Lock()
+	if !al.dirty {
+		al.mu.Unlock()
+		return nil
+	}
+	stored := make(map[string][]*AllowlistEntry, len(al.entries))
+	for user, digests := range al.entries {
+		for _, entry := range digests {
+			stored[user] = append(stored[user], entry)
+		}
+	}
+	al.dirty = false
+	al.mu.Unlock()
+
+	data, err := yaml.Marshal(stored)
+	if err != nil {
+		return fmt.Errorf("allowlist: failed to encode: %w", err)
+	}
+
+	// write to a temporary file first so a crash never leaves a truncated allowlist
+	tmp := al.config.File + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("allowlist: failed to write %s: %w", tmp, err)
+	}
+	if err := os.Rename(tmp, al.config.File); err != nil {
+		return fmt.Errorf("allowlist: failed to rename %s: %w", tmp, err)
+	}
+
+	return nil
+}
+
+// Check learns or verifies the fingerprint of every statement in the query
+func (al *Allowlist) Check(user string, query string) error {
+	if al == nil {
+		return nil
+	}
+
+	al.mu.RLock()
+	mode := al.mode
+	al.mu.RUnlock()
+
+	if mode == AllowlistModeOff {
+		return nil
+	}
+	if al.users != nil && !al.users[user] {
+		return nil
+	}
+
+	for _, stmt := range splitAndProcessStatements(query, "8.0.33") {
+		normalized := NormalizeQuery(stmt)
+		if normalized == "" {
+			continue
+		}
+		digest := DigestNormalized(normalized)
+
+		switch mode {
+		case AllowlistModeLearn:
+			al.learn(user, digest, normalized)
+		case AllowlistModeEnforce:
+			if al.allowed(user, digest) {
+				continue
+			}
+			logFor("allowlist").Warn("unknown query", "digest", digest, "user", user, "query", normalized)
+			if al.config.Action == AllowlistActionBlock {
+				return mysql.NewError(al.config.ErrorCode, al.config.ErrorMessage)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (al *Allowlist) learn(user string, digest string, normalized string) {
+	al.mu.RLock()
+	_, ok := al.entries[user][digest]
+	al.mu.RUnlock()
+	if ok {
+		return
+	}
+
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	digests, ok := al.entries[user]
+	if !ok {
+		digests = make(map[string]*AllowlistEntry)
+		al.entries[user] = digests
+	}
+	if _, ok := digests[digest]; ok {
+		return
+	}
+	digests[digest] = &AllowlistEntry{
+		Digest:    digest,
+		Query:     normalized,
+		FirstSeen: time.Now(),
+	}
+	al.dirty = true
+}
+
+func (al *Allowlist) allowed(user string, digest string) bool {
+	al.mu.RLock()
+	defer al.mu.RUnlock()
+
+	_, ok := al.entries[user][digest]
+	return ok
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/syslog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+)
+
+type AuditConfig struct {
+	Enabled       bool   `yaml:"enabled"`
+	Policy        string `yaml:"policy"`         // statements audited: all, writes (writes, DDL and DCL) or ddl (DDL and DCL)
+	Output        string `yaml:"output"`         // file, syslog or socket
+	Path          string `yaml:"path"`           // file: audit log, socket: unix socket JSON lines are streamed to
+	MaxSize       int64  `yaml:"max_size"`       // file: bytes before the file is rotated, 0 never rotates
+	MaxFiles      int    `yaml:"max_files"`      // file: rotated files kept, 0 keeps everything
+	FlushInterval int    `yaml:"flush_interval"` // seconds between flushes of buffered events
+}
+
+// AuditEvent is one line of the audit log
+type AuditEvent struct {
+	Time       time.Time `json:"time"`
+	Event      string    `json:"event"` // connect, disconnect, auth_failed or statement
+	Connection uint32    `json:"connection,omitempty"`
+	User       string    `json:"user,omitempty"`
+	Client     string    `json:"client"`
+	Backend    string    `json:"backend,omitempty"`
+	Database   string    `json:"database,omitempty"`
+	Kind       string    `json:"kind,omitempty"`      // read, write, ddl, dcl or other
+	Statement  string    `json:"statement,omitempty"` // normalized, literals are never logged
+	Digest     string    `json:"digest,omitempty"`
+	Rows       int       `json:"rows,omitempty"`
+	Affected   uint64    `json:"rows_affected,omitempty"`
+	ErrorCode  uint16    `json:"error_code,omitempty"`
+	DurationMs float64   `json:"duration_ms,omitempty"`
+}
+
+// Audit writes session and statement events for compliance. Events are
+// written synchronously so none are lost under load, a buffered file is
+// flushed every flush_interval and on Stop.
+type Audit struct {
+	config *AuditConfig
+
+	mu      sync.Mutex
+	file    *rotatingFile
+	syslog  *syslog.Writer
+	socket  net.Conn
+	done    chan struct{}
+	wg      sync.WaitGroup
+	stopped bool
+}
+
+func NewAudit(config *AuditConfig) (*Audit, error) {
+	if config.Policy == "" {
+		config.Policy = "all"
+	}
+	if config.Output == "" {
+		config.Output = "file"
+	}
+	if config.Path == "" && config.Output == "file" {
+		config.Path = "data/audit.log"
+	}
+	if config.FlushInterval <= 0 {
+		config.FlushInterval = 1
+	}
+
+	switch config.Policy {
+	case "all", "writes", "ddl":
+	default:
+		return nil, fmt.Errorf("audit: unknown policy: %s", config.Policy)
+	}
+	switch config.Output {
+	case "file", "syslog":
+	case "socket":
+		if config.Path == "" {
+			return nil, fmt.Errorf("audit: socket output requires a path")
+		}
+	default:
+		return nil, fmt.Errorf("audit: unknown output: %s", config.Output)
+	}
+
+	return &Audit{
+		config: config,
+		done:   make(chan struct{}),
+	}, nil
+}
+
+func (a *Audit) Start() error {
+	if !a.config.Enabled {
+		return nil
+	}
+
+	var err error
+	switch a.config.Output {
+	case "file":
+		a.file, err = openRotatingFile(a.config.Path, 0600, a.config.MaxSize, a.config.MaxFiles, true)
+	case "syslog":
+		a.syslog, err = syslog.New(syslog.LOG_INFO|syslog.LOG_AUTHPRIV, "dbinsight-audit")
+	case "socket":
+		a.socket, err = net.Dial("unix", a.config.Path)
+	}
+	if err != nil {
+		return fmt.Errorf("audit: %w", err)
+	}
+
+	if a.file != nil {
+		a.wg.Add(1)
+		go a.flusher()
+	}
+
+	logFor("audit").Info("logging statements", "policy", a.config.Policy, "output", a.config.Output)
+	return nil
+}
+
+func (a *Audit) flusher() {
+	defer a.wg.Done()
+
+	ticker := time.NewTicker(time.Duration(a.config.FlushInterval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-a.done:
+			return
+		case <-ticker.C:
+			if err := a.file.Flush(); err != nil {
+				logFor("audit").Error("failed to write", "err", err)
+			}
+		}
+	}
+}
+
+// Stop flushes and closes the audit log, it runs after every session ended
+func (a *Audit) Stop() {
+	if !a.config.Enabled {
+		return
+	}
+	close(a.done)
+	a.wg.Wait()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.stopped = true
+
+	if a.file != nil {
+		if err := a.file.Close(); err != nil {
+			logFor("audit").Error("failed to write", "err", err)
+		}
+	}
+	if a.syslog != nil {
+		a.syslog.Close()
+	}
+	if a.socket != nil {
+		a.socket.Close()
+	}
+}
+
+// Enabled reports whether events are being written
+func (a *Audit) Enabled() bool {
+	return a.config.Enabled
+}
+
+func (a *Audit) Write(event *AuditEvent) {
+	if !a.config.Enabled {
+		return
+	}
+
+	line, err := json.Marshal(event)
+	if err != nil {
+		logFor("audit").Error("failed to write", "err", err)
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.stopped {
+		return
+	}
+
+	switch {
+	case a.file != nil:
+		_, err = a.file.Write(append(line, '\n'))
+	case a.syslog != nil:
+		err = a.syslog.Info(string(line))
+	case a.socket != nil:
+		_, err = a.socket.Write(append(line, '\n'))
+	}
+	if err != nil {
+		logFor("audit").Error("failed to write", "err", err)
+	}
+}
+
+// auditKinds orders the kinds of statements from the least to the most
+// sensitive
+var auditKinds = map[string]int{"other": 0, "read": 1, "write": 2, "ddl": 3, "dcl": 4}
+
+// auditKind classifies a query for the audit policy, a multi-statement
+// query takes the kind of its most sensitive statement
+func auditKind(query string) string {
+	stmts, err := parseSQL(query)
+	if err != nil || len(stmts) == 0 {
+		return "other"
+	}
+
+	kind := "other"
+	for _, stmt := range stmts {
+		k := "other"
+		switch stmt {
+		case Select, Show, Desc, Describe:
+			k = "read"
+		case Insert, Update, Delete:
+			k = "write"
+		case Create, Alter, Drop, Truncate, Rename:
+			k = "ddl"
+		case Grant, Revoke:
+			k = "dcl"
+		}
+		if auditKinds[k] > auditKinds[kind] {
+			kind = k
+		}
+	}
+	return kind
+}
+
+func (a *Audit) wants(kind string) bool {
+	switch a.config.Policy {
+	case "writes":
+		return kind == "write" || kind == "ddl" || kind == "dcl"
+	case "ddl":
+		return kind == "ddl" || kind == "dcl"
+	}
+	return true
+}
+
+func (ph *ProxyHandler) auditSession(event string) {
+	if !ph.p.audit.Enabled() {
+		return
+	}
+
+	backend := ""
+	if ph.readServer != nil && ph.writeServer != nil {
+		backend = ph.readServer.address
+		if ph.writeServer.address != backend {
+			backend += "," + ph.writeServer.address
+		}
+	}
+
+	ph.p.audit.Write(&AuditEvent{
+		Time:       time.Now(),
+		Event:      event,
+		Connection: ph.connectionID,
+		User:       ph.user,
+		Client:     ph.remoteAddr,
+		Backend:    backend,
+		Database:   ph.databaseName,
+	})
+}
+
+// auditStatement writes a statement event if the policy covers the
+// statement, res and err are what the client got back
+func (ph *ProxyHandler) auditStatement(start time.Time, query string, res *mysql.Result, err error) {
+	if !ph.p.audit.Enabled() {
+		return
+	}
+
+	kind := auditKind(query)
+	if !ph.p.audit.wants(kind) {
+		return
+	}
+
+	normalized := NormalizeQuery(query)
+	event := &AuditEvent{
+		Time:       start,
+		Event:      "statement",
+		Connection: ph.connectionID,
+		User:       ph.user,
+		Client:     ph.remoteAddr,
+		Backend:    ph.lastBackend,
+		Database:   ph.databaseName,
+		Kind:       kind,
+		Statement:  normalized,
+		Digest:     DigestNormalized(normalized),
+		DurationMs: float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if res != nil {
+		event.Affected = res.AffectedRows
+		if res.Resultset != nil {
+			event.Rows = len(res.RowDatas)
+		}
+	}
+	if err != nil {
+		var myErr *mysql.MyError
+		if errors.As(err, &myErr) {
+			event.ErrorCode = myErr.Code
+		} else {
+			event.ErrorCode = mysql.ER_UNKNOWN_ERROR
+		}
+	}
+
+	ph.p.audit.Write(event)
+}
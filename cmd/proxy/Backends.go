@@ -3,11 +3,11 @@ package main
 import (
 	"context"
 	"fmt"
-	"log"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/go-mysql-org/go-mysql/client"
-	// "time"
 )
 
 type UserKey struct {
@@ -22,9 +22,12 @@ type Backends struct {
 	primary  *BackendServer
 	usermap  *UserMap
 	config   *Config
-	rr_index int // server to use for round robin load balancing
+	rr_index int            // server to use for round robin load balancing
+	group_rr map[string]int // round robin index for each replica group
 	mu       sync.RWMutex
-	//healthCheckShutdown chan struct{}
+
+	healthCheckShutdown chan struct{}
+	healthCheckWg       sync.WaitGroup
 }
 
 // generic struct that represents either a reader or writer
@@ -32,6 +35,8 @@ type BackendServer struct {
 	pools      map[UserKey]*client.Pool
 	address    string
 	serverType ServerType
+	group      string
+	lag        atomic.Int64 // replication lag in seconds, -1 when unknown
 	mu         sync.RWMutex // Add a read/write mutex
 }
 
@@ -45,16 +50,18 @@ func NewUserKey(host string, user string, pass string) UserKey {
 
 func NewBackends(config *Config) *Backends {
 	return &Backends{
-		config: config,
-		//healthCheckShutdown: make(chan struct{}),
+		config:              config,
+		healthCheckShutdown: make(chan struct{}),
 	}
 }
 
 func NewBackendServer(address string) *BackendServer {
-	return &BackendServer{
+	svr := &BackendServer{
 		address: address,
 		pools:   make(map[UserKey]*client.Pool),
 	}
+	svr.lag.Store(-1)
+	return svr
 }
 
 func (be *Backends) Initialize() error {
@@ -68,6 +75,7 @@ func (be *Backends) Initialize() error {
 	for _, replica := range be.config.BackendReplicas {
 		svr := NewBackendServer(fmt.Sprintf("%s:%d", replica.Host, replica.Port))
 		svr.serverType = ServerTypeReader
+		svr.group = replica.Group
 		be.replicas = append(be.replicas, svr)
 
 		for _, item := range be.usermap.users {
@@ -76,7 +84,7 @@ func (be *Backends) Initialize() error {
 				item.backend_user,
 				item.backend_pass,
 				"",
-				client.WithLogFunc(log.Printf), // Or your logging function
+				client.WithLogFunc(printfFor("backends")),
 				client.WithPoolLimits(10, 100, 5),
 				client.WithConnOptions(), // No connection options
 			)
@@ -99,7 +107,7 @@ func (be *Backends) Initialize() error {
 			item.backend_user,
 			item.backend_pass,
 			"",
-			client.WithLogFunc(log.Printf), // Or your logging function
+			client.WithLogFunc(printfFor("backends")),
 			client.WithPoolLimits(10, 100, 5),
 			client.WithConnOptions(), // No connection options
 		)
@@ -110,21 +118,28 @@ func (be *Backends) Initialize() error {
 		wsvr.AddPool(key, pool)
 	}
 
+	wsvr.lag.Store(0)
+
 	// start health check thread
-	/*go func() {
-		ticker := time.NewTicker(time.Duration(pools.config.HealthCheckDelay) * time.Second)
+	be.healthCheckWg.Add(1)
+	go func() {
+		defer be.healthCheckWg.Done()
+		delay := be.config.HealthCheckDelay
+		if delay <= 0 {
+			delay = 5
+		}
+		ticker := time.NewTicker(time.Duration(delay) * time.Second)
 		defer ticker.Stop()
+		be.CheckReplicationLag()
 		for {
 			select {
 			case <-ticker.C:
-				if err := pools.CheckHealth(); err != nil {
-					log.Println("Health check failed:", err)
-				}
-			case <-pools.healthCheckShutdown: // Receive shutdown signal
+				be.CheckReplicationLag()
+			case <-be.healthCheckShutdown: // Receive shutdown signal
 				return // Exit the goroutine
 			}
 		}
-	}()*/
+	}()
 
 	return nil
 }
@@ -144,6 +159,31 @@ func (be *Backends) GetNextReplica() (*BackendServer, error) {
 	return svr, nil
 }
 
+// GetNextReplicaInGroup round robins over the replicas of a replica group
+func (be *Backends) GetNextReplicaInGroup(group string) (*BackendServer, error) {
+	be.mu.Lock()
+	defer be.mu.Unlock()
+
+	members := make([]*BackendServer, 0)
+	for _, svr := range be.replicas {
+		if svr.group == group {
+			members = append(members, svr)
+		}
+	}
+
+	if len(members) == 0 {
+		return nil, fmt.Errorf("no replicas available in group: %s", group)
+	}
+
+	if be.group_rr == nil {
+		be.group_rr = make(map[string]int)
+	}
+	idx := be.group_rr[group] % len(members)
+	be.group_rr[group] = (idx + 1) % len(members)
+
+	return members[idx], nil
+}
+
 func (be *Backends) GetWriter() (*BackendServer, error) {
 	be.mu.RLock()         // Acquire a read lock
 	defer be.mu.RUnlock() // Release the read lock
@@ -157,6 +197,99 @@ func (be *Backends) GetWriter() (*BackendServer, error) {
 	return svr, nil
 }
 
+// GetReader returns the next replica, or the primary when the cluster has
+// no replicas
+func (be *Backends) GetReader() (*BackendServer, error) {
+	be.mu.RLock()
+	noReplicas := len(be.replicas) == 0
+	be.mu.RUnlock()
+
+	if noReplicas {
+		return be.GetWriter()
+	}
+	return be.GetNextReplica()
+}
+
+// CheckReplicationLag refreshes the replication lag of every replica
+func (be *Backends) CheckReplicationLag() {
+	be.mu.RLock()
+	replicas := be.replicas
+	be.mu.RUnlock()
+
+	if len(be.usermap.users) == 0 {
+		return
+	}
+	item := be.usermap.users[0]
+
+	for _, svr := range replicas {
+		key := NewUserKey(svr.address, item.backend_user, item.backend_pass)
+		lag, err := svr.measureReplicationLag(key)
+		if err != nil {
+			logFor("backends").Warn("failed to check replication lag", "backend", svr.address, "err", err)
+			lag = -1
+		}
+		svr.lag.Store(lag)
+	}
+}
+
+func (bs *BackendServer) measureReplicationLag(key UserKey) (int64, error) {
+	conn, err := bs.GetNextConn(key)
+	if err != nil {
+		return -1, err
+	}
+	defer bs.PutConn(key, conn)
+
+	column := "Seconds_Behind_Source"
+	res, err := conn.Execute("SHOW REPLICA STATUS")
+	if err != nil {
+		// servers before 8.0.22
+		column = "Seconds_Behind_Master"
+		res, err = conn.Execute("SHOW SLAVE STATUS")
+		if err != nil {
+			return -1, err
+		}
+	}
+	defer res.Close()
+
+	if res.Resultset == nil || res.RowNumber() == 0 {
+		// not configured as a replica
+		return 0, nil
+	}
+
+	isNull, err := res.IsNullByName(0, column)
+	if err != nil {
+		return -1, err
+	}
+	if isNull {
+		// replication is not running
+		return -1, nil
+	}
+
+	lag, err := res.GetIntByName(0, column)
+	if err != nil {
+		return -1, err
+	}
+
+	return lag, nil
+}
+
+// ReplicationLag returns the last measured lag in seconds, ok is false when
+// the lag is unknown or replication is stopped
+func (bs *BackendServer) ReplicationLag() (int64, bool) {
+	lag := bs.lag.Load()
+	return lag, lag >= 0
+}
+
+// WithinLag reports whether the server may serve reads with the given maximum
+// lag in seconds, a negative maximum means no limit
+func (bs *BackendServer) WithinLag(maxLag int) bool {
+	if maxLag < 0 {
+		return true
+	}
+	lag, ok := bs.ReplicationLag()
+	return ok && lag <= int64(maxLag)
+}
+
 func (bs *BackendServer) GetNextConn(key UserKey) (*client.Conn, error) {
 	bs.mu.RLock()         // Acquire a read lock
 	defer bs.mu.RUnlock() // Release the read lock
@@ -186,6 +319,18 @@ func (bs *BackendServer) PutConn(key UserKey, conn *client.Conn) error {
 	return nil
 }
 
+// DropConn closes a connection taken from the pool instead of returning it
+func (bs *BackendServer) DropConn(key UserKey, conn *client.Conn) {
+	bs.mu.RLock()
+	defer bs.mu.RUnlock()
+
+	if pool, ok := bs.pools[key]; ok {
+		pool.DropConn(conn)
+		return
+	}
+	conn.Close()
+}
+
 func (bs *BackendServer) AddPool(key UserKey, pool *client.Pool) {
 	bs.mu.Lock()
 	defer bs.mu.Unlock()
@@ -199,7 +344,9 @@ func (bs *BackendServer) DeletePool(key UserKey) {
 }
 
 func (be *Backends) Shutdown() error {
-	//close(pools.healthCheckShutdown)
+	close(be.healthCheckShutdown)
+	be.healthCheckWg.Wait()
+
 	be.mu.Lock()
 	defer be.mu.Unlock()
 
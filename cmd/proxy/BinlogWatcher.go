@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-mysql-org/go-mysql/client"
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/replication"
+)
+
+type BinlogConfig struct {
+	Enabled    bool   `yaml:"enabled"`
+	ServerID   uint32 `yaml:"server_id"` // must be unique among the primary's replicas
+	Flavor     string `yaml:"flavor"`    // mysql or mariadb
+	Host       string `yaml:"host"`      // defaults to the primary
+	Port       int    `yaml:"port"`
+	User       string `yaml:"user"` // needs REPLICATION SLAVE and REPLICATION CLIENT
+	Password   string `yaml:"password"`
+	RetryDelay int    `yaml:"retry_delay"` // seconds to wait before reconnecting
+}
+
+// TableChangeListener is notified about every change the binlog watcher
+// sees on the primary, regardless of which client made it
+type TableChangeListener interface {
+	// tables are database.table names changed by row events
+	InvalidateTables(tables []string)
+	// query is a statement (DDL or statement based replication) run in database
+	InvalidateForWrite(database string, query string)
+	// called when events may have been missed, e.g. after a reconnect
+	InvalidateAll()
+}
+
+// BinlogWatcher tails the primary's binary log and tells its listeners which
+// tables changed
+type BinlogWatcher struct {
+	config    *BinlogConfig
+	listeners []TableChangeListener
+
+	mu  sync.Mutex
+	pos mysql.Position
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func NewBinlogWatcher(config *BinlogConfig, primary *Config) *BinlogWatcher {
+	if config.ServerID == 0 {
+		config.ServerID = 1001
+	}
+	if config.Flavor == "" {
+		config.Flavor = mysql.MySQLFlavor
+	}
+	if config.Host == "" {
+		config.Host = primary.BackendPrimaryHost
+	}
+	if config.Port == 0 {
+		config.Port = primary.BackendPrimaryPort
+	}
+	if config.User == "" {
+		config.User = primary.BackendPrimaryUser
+		config.Password = primary.BackendPrimaryPassword
+	}
+	if config.RetryDelay <= 0 {
+		config.RetryDelay = 5
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &BinlogWatcher{
+		config: config,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+func (bw *BinlogWatcher) AddListener(listener TableChangeListener) {
+	bw.listeners = append(bw.listeners, listener)
+}
+
+// Start begins tailing the binlog from the primary's current position
+func (bw *BinlogWatcher) Start() error {
+	if !bw.config.Enabled {
+		return nil
+	}
+
+	pos, err := bw.currentPosition()
+	if err != nil {
+		return fmt.Errorf("binlog: failed to read binlog position: %w", err)
+	}
+	bw.setPosition(pos)
+
+	logFor("binlog").Info("tailing binlog", "host", bw.config.Host, "port", bw.config.Port, "position", pos.String())
+
+	bw.wg.Add(1)
+	go bw.run()
+
+	return nil
+}
+
+// Stop disconnects from the primary and waits for the watcher to exit
+func (bw *BinlogWatcher) Stop() {
+	bw.cancel()
+	bw.wg.Wait()
+}
+
+func (bw *BinlogWatcher) address() string {
+	return fmt.Sprintf("%s:%d", bw.config.Host, bw.config.Port)
+}
+
+func (bw *BinlogWatcher) currentPosition() (mysql.Position, error) {
+	conn, err := client.Connect(bw.address(), bw.config.User, bw.config.Password, "")
+	if err != nil {
+		return mysql.Position{}, err
+	}
+	defer conn.Close()
+
+	res, err := conn.Execute("SHOW BINARY LOG STATUS")
+	if err != nil {
+		// servers before 8.2
+		res, err = conn.Execute("SHOW MASTER STATUS")
+		if err != nil {
+			return mysql.Position{}, err
+		}
+	}
+	defer res.Close()
+
+	if res.Resultset == nil || res.RowNumber() == 0 {
+		return mysql.Position{}, fmt.Errorf("binary logging is not enabled on %s", bw.address())
+	}
+
+	file, err := res.GetStringByName(0, "File")
+	if err != nil {
+		return mysql.Position{}, err
+	}
+	offset, err := res.GetUintByName(0, "Position")
+	if err != nil {
+		return mysql.Position{}, err
+	}
+
+	return mysql.Position{Name: file, Pos: uint32(offset)}, nil
+}
+
+func (bw *BinlogWatcher) position() mysql.Position {
+	bw.mu.Lock()
+	defer bw.mu.Unlock()
+	return bw.pos
+}
+
+func (bw *BinlogWatcher) setPosition(pos mysql.Position) {
+	bw.mu.Lock()
+	defer bw.mu.Unlock()
+	bw.pos = pos
+}
+
+func (bw *BinlogWatcher) run() {
+	defer bw.wg.Done()
+
+	for {
+		err := bw.stream(bw.position())
+		if bw.ctx.Err() != nil {
+			return
+		}
+
+		// anything could have changed while we were not watching
+		logFor("binlog").Warn("stream interrupted", "backend", bw.address(), "err", err)
+		for _, listener := range bw.listeners {
+			listener.InvalidateAll()
+		}
+
+		select {
+		case <-time.After(time.Duration(bw.config.RetryDelay) * time.Second):
+		case <-bw.ctx.Done():
+			return
+		}
+	}
+}
+
+func (bw *BinlogWatcher) stream(pos mysql.Position) error {
+	syncer := replication.NewBinlogSyncer(replication.BinlogSyncerConfig{
+		ServerID: bw.config.ServerID,
+		Flavor:   bw.config.Flavor,
+		Host:     bw.config.Host,
+		Port:     uint16(bw.config.Port),
+		User:     bw.config.User,
+		Password: bw.config.Password,
+	})
+	defer syncer.Close()
+
+	streamer, err := syncer.StartSync(pos)
+	if err != nil {
+		return err
+	}
+
+	for {
+		ev, err := streamer.GetEvent(bw.ctx)
+		if err != nil {
+			return err
+		}
+		bw.handleEvent(ev)
+	}
+}
+
+func (bw *BinlogWatcher) handleEvent(ev *replication.BinlogEvent) {
+	switch e := ev.Event.(type) {
+	case *replication.RotateEvent:
+		bw.setPosition(mysql.Position{Name: string(e.NextLogName), Pos: uint32(e.Position)})
+		return
+
+	case *replication.RowsEvent:
+		table := strings.ToLower(string(e.Table.Schema) + "." + string(e.Table.Table))
+		for _, listener := range bw.listeners {
+			listener.InvalidateTables([]string{table})
+		}
+
+	case *replication.QueryEvent:
+		query := string(e.Query)
+		switch strings.ToUpper(strings.TrimSpace(query)) {
+		case "BEGIN", "COMMIT", "ROLLBACK":
+		default:
+			for _, listener := range bw.listeners {
+				listener.InvalidateForWrite(string(e.Schema), query)
+			}
+		}
+	}
+
+	if ev.Header.LogPos > 0 {
+		pos := bw.position()
+		pos.Pos = ev.Header.LogPos
+		bw.setPosition(pos)
+	}
+}
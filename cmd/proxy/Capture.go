@@ -0,0 +1,233 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/jbhall78/dbinsight/internal/capture"
+)
+
+type CaptureConfig struct {
+	Enabled       bool    `yaml:"enabled"`
+	Directory     string  `yaml:"directory"`
+	Percent       float64 `yaml:"percent"`        // share of sessions recorded, whole sessions so they can be replayed
+	MaxSize       int64   `yaml:"max_size"`       // compressed bytes per file before starting a new one
+	MaxAge        int     `yaml:"max_age"`        // seconds per file before starting a new one, 0 rotates on size only
+	MaxFiles      int     `yaml:"max_files"`      // files kept in the directory, 0 keeps everything
+	QueueSize     int     `yaml:"queue_size"`     // records waiting to be written, more are dropped
+	FlushInterval int     `yaml:"flush_interval"` // seconds between flushes to disk
+}
+
+// Capture records sampled sessions to disk in the format cmd/replay reads.
+// Sessions hand records to a single writer goroutine so a slow disk never
+// holds up a client, records are dropped when the queue is full.
+type Capture struct {
+	config  *CaptureConfig
+	writer  *capture.Writer
+	queue   chan *capture.Record
+	done    chan struct{}
+	wg      sync.WaitGroup
+	session atomic.Uint64
+	dropped atomic.Int64
+}
+
+func NewCapture(config *CaptureConfig) (*Capture, error) {
+	if config.Directory == "" {
+		config.Directory = "data/capture"
+	}
+	if config.Percent == 0 {
+		config.Percent = 100
+	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = 10000
+	}
+	if config.FlushInterval <= 0 {
+		config.FlushInterval = 1
+	}
+
+	return &Capture{
+		config: config,
+		queue:  make(chan *capture.Record, config.QueueSize),
+		done:   make(chan struct{}),
+	}, nil
+}
+
+func (c *Capture) Start() error {
+	if !c.config.Enabled {
+		return nil
+	}
+
+	writer, err := capture.NewWriter(c.config.Directory, c.config.MaxSize, time.Duration(c.config.MaxAge)*time.Second, c.config.MaxFiles)
+	if err != nil {
+		return err
+	}
+	c.writer = writer
+
+	c.wg.Add(1)
+	go c.run()
+
+	logFor("capture").Info("recording sessions", "percent", c.config.Percent, "directory", c.config.Directory)
+	return nil
+}
+
+// Stop writes what is still queued and closes the current file
+func (c *Capture) Stop() {
+	if c.writer == nil {
+		return
+	}
+	close(c.done)
+	c.wg.Wait()
+
+	if n := c.dropped.Load(); n > 0 {
+		logFor("capture").Warn("dropped records", "count", n)
+	}
+}
+
+func (c *Capture) run() {
+	defer c.wg.Done()
+
+	ticker := time.NewTicker(time.Duration(c.config.FlushInterval) * time.Second)
+	defer ticker.Stop()
+
+	write := func(r *capture.Record) {
+		if err := c.writer.Write(r); err != nil {
+			logFor("capture").Error("failed to write", "err", err)
+		}
+	}
+
+	for {
+		select {
+		case r := <-c.queue:
+			write(r)
+		case <-ticker.C:
+			if err := c.writer.Flush(); err != nil {
+				logFor("capture").Error("failed to write", "err", err)
+			}
+		case <-c.done:
+			for {
+				select {
+				case r := <-c.queue:
+					write(r)
+				default:
+					if err := c.writer.Close(); err != nil {
+						logFor("capture").Error("failed to write", "err", err)
+					}
+					return
+				}
+			}
+		}
+	}
+}
+
+// Begin decides whether a new session is recorded and returns its capture
+// session id, 0 when it is not
+func (c *Capture) Begin() uint64 {
+	if c.writer == nil || c.config.Percent <= 0 {
+		return 0
+	}
+	if c.config.Percent < 100 && rand.Float64()*100 >= c.config.Percent {
+		return 0
+	}
+	return c.session.Add(1)
+}
+
+func (c *Capture) Record(r *capture.Record) {
+	select {
+	case <-c.done:
+	case c.queue <- r:
+	default:
+		c.dropped.Add(1)
+	}
+}
+
+// captureConnect starts recording the session if it is sampled, database is
+// the one the client asked for before any tenant mapping
+func (ph *ProxyHandler) captureConnect(database string) {
+	ph.captureID = ph.p.capture.Begin()
+	if ph.captureID == 0 {
+		return
+	}
+	ph.p.capture.Record(&capture.Record{
+		Type:     capture.TypeConnect,
+		Time:     time.Now().UnixNano(),
+		Session:  ph.captureID,
+		User:     ph.user,
+		Database: database,
+		Client:   ph.remoteAddr,
+	})
+}
+
+// captureCommand records a command of a sampled session, res and err are
+// what the client got back
+func (ph *ProxyHandler) captureCommand(recordType string, start time.Time, query string, stmt uint32, args []interface{}, res *mysql.Result, err error) {
+	if ph.captureID == 0 {
+		return
+	}
+
+	r := &capture.Record{
+		Type:      recordType,
+		Time:      start.UnixNano(),
+		Session:   ph.captureID,
+		Query:     query,
+		Statement: stmt,
+		Duration:  time.Since(start).Microseconds(),
+	}
+	if query != "" {
+		r.Digest = QueryDigest(query)
+	}
+	if args != nil {
+		r.Args = capture.EncodeArgs(args)
+	}
+	if res != nil {
+		r.Affected = res.AffectedRows
+		if res.Resultset != nil {
+			r.Rows = len(res.RowDatas)
+		}
+	}
+	r.Error = captureError(err)
+
+	ph.p.capture.Record(r)
+}
+
+// captureUseDB records a COM_INIT_DB of a sampled session, database is the
+// one the client asked for before any tenant mapping
+func (ph *ProxyHandler) captureUseDB(start time.Time, database string, err error) {
+	if ph.captureID == 0 {
+		return
+	}
+	ph.p.capture.Record(&capture.Record{
+		Type:     capture.TypeUseDB,
+		Time:     start.UnixNano(),
+		Session:  ph.captureID,
+		Database: database,
+		Duration: time.Since(start).Microseconds(),
+		Error:    captureError(err),
+	})
+}
+
+// captureError returns the MySQL error code the client got for err
+func captureError(err error) uint16 {
+	if err == nil {
+		return 0
+	}
+	var myErr *mysql.MyError
+	if errors.As(err, &myErr) {
+		return myErr.Code
+	}
+	return mysql.ER_UNKNOWN_ERROR
+}
+
+func (ph *ProxyHandler) captureDisconnect() {
+	if ph.captureID == 0 {
+		return
+	}
+	ph.p.capture.Record(&capture.Record{
+		Type:    capture.TypeDisconnect,
+		Time:    time.Now().UnixNano(),
+		Session: ph.captureID,
+	})
+}
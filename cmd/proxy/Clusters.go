@@ -0,0 +1,348 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+)
+
+// DefaultCluster is the cluster made of backend_primary_* and backend_replicas
+const DefaultCluster = "default"
+
+type ClusterConfig struct {
+	Name        string          `yaml:"name"`
+	PrimaryHost string          `yaml:"primary_host"`
+	PrimaryPort int             `yaml:"primary_port"`
+	Replicas    []ReplicaConfig `yaml:"replicas"`
+	Databases   []string        `yaml:"databases"` // sessions using these databases, and statements on their tables, go to this cluster
+	Tables      []string        `yaml:"tables"`    // statements referencing these tables go to this cluster, database.table or table in any database
+}
+
+// Clusters holds the backends of every cluster along with the rules that map
+// databases and tables to them
+type Clusters struct {
+	config    *Config
+	backends  map[string]*Backends
+	databases map[string]string // database -> cluster
+	tables    map[string]string // database.table or table -> cluster
+}
+
+func NewClusters(config *Config) (*Clusters, error) {
+	c := &Clusters{
+		config:    config,
+		backends:  make(map[string]*Backends),
+		databases: make(map[string]string),
+		tables:    make(map[string]string),
+	}
+
+	seen := map[string]bool{DefaultCluster: true}
+	for _, cluster := range config.Clusters {
+		if cluster.Name == "" {
+			return nil, fmt.Errorf("clusters: cluster without a name")
+		}
+		if seen[cluster.Name] {
+			return nil, fmt.Errorf("clusters: duplicate cluster name: %s", cluster.Name)
+		}
+		seen[cluster.Name] = true
+
+		if cluster.PrimaryHost == "" {
+			return nil, fmt.Errorf("clusters: cluster %s has no primary_host", cluster.Name)
+		}
+
+		for _, database := range cluster.Databases {
+			database = strings.ToLower(database)
+			if other, ok := c.databases[database]; ok {
+				return nil, fmt.Errorf("clusters: database %s is mapped to both %s and %s", database, other, cluster.Name)
+			}
+			c.databases[database] = cluster.Name
+		}
+		for _, table := range cluster.Tables {
+			table = strings.ToLower(unquoteIdentifier(table))
+			if other, ok := c.tables[table]; ok {
+				return nil, fmt.Errorf("clusters: table %s is mapped to both %s and %s", table, other, cluster.Name)
+			}
+			c.tables[table] = cluster.Name
+		}
+	}
+
+	return c, nil
+}
+
+// Initialize connects to the backends of every cluster, the default cluster
+// is the one the proxy already created
+func (c *Clusters) Initialize(defaultBackends *Backends) {
+	c.backends[DefaultCluster] = defaultBackends
+
+	for _, cluster := range c.config.Clusters {
+		// every cluster is a copy of the main config with its own servers
+		cfg := *c.config
+		cfg.BackendPrimaryHost = cluster.PrimaryHost
+		cfg.BackendPrimaryPort = cluster.PrimaryPort
+		if cfg.BackendPrimaryPort == 0 {
+			cfg.BackendPrimaryPort = 3306
+		}
+		cfg.BackendReplicas = cluster.Replicas
+
+		backends := NewBackends(&cfg)
+		if err := backends.Initialize(); err != nil {
+			logFor("clusters").Error("failed to initialize cluster", "cluster", cluster.Name, "err", err)
+			continue
+		}
+		c.backends[cluster.Name] = backends
+
+		logFor("clusters").Info("cluster", "cluster", cluster.Name, "host", cfg.BackendPrimaryHost, "port", cfg.BackendPrimaryPort, "replicas", len(cluster.Replicas))
+	}
+}
+
+// Get returns the backends of a cluster
+func (c *Clusters) Get(name string) (*Backends, error) {
+	backends, ok := c.backends[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown cluster: %s", name)
+	}
+	return backends, nil
+}
+
+// Shutdown closes the backends of every cluster except the default one,
+// which the proxy shuts down itself
+func (c *Clusters) Shutdown() {
+	for name, backends := range c.backends {
+		if name == DefaultCluster {
+			continue
+		}
+		backends.Shutdown()
+	}
+}
+
+// ForDatabase returns the cluster sessions using the database belong to
+func (c *Clusters) ForDatabase(database string) string {
+	if cluster, ok := c.databases[strings.ToLower(database)]; ok {
+		return cluster
+	}
+	return DefaultCluster
+}
+
+// system schemas exist on every cluster, so tables in them follow the session
+var systemSchemas = map[string]bool{
+	"information_schema": true,
+	"performance_schema": true,
+	"mysql":              true,
+	"sys":                true,
+}
+
+// forTable returns the cluster a qualified database.table lives in, or ""
+// for system tables which every cluster has
+func (c *Clusters) forTable(table string) string {
+	if cluster, ok := c.tables[table]; ok {
+		return cluster
+	}
+	database, name, _ := strings.Cut(table, ".")
+	if cluster, ok := c.tables[name]; ok {
+		return cluster
+	}
+	if database == "" || systemSchemas[database] {
+		return ""
+	}
+	return c.ForDatabase(database)
+}
+
+// ClusterRoute is where a statement must run because of the tables it uses
+type ClusterRoute struct {
+	Cluster  string
+	Database string // database of the first routed table, used as the default database on that cluster
+	Tables   []string
+}
+
+// ForQuery returns the cluster the tables referenced by the query live in,
+// or nil when it references no tables and can run wherever the session is.
+// A query whose tables live in more than one cluster is an error.
+func (c *Clusters) ForQuery(database string, query string) (*ClusterRoute, error) {
+	if len(c.config.Clusters) == 0 {
+		return nil, nil
+	}
+
+	var route *ClusterRoute
+	clusters := make(map[string]bool)
+	for _, stmt := range splitAndProcessStatements(query, "8.0.33") {
+		tokens := Tokenize(stmt)
+		for _, table := range qualifyTables(database, extractTables(tokens)) {
+			cluster := c.forTable(table)
+			if cluster == "" {
+				continue
+			}
+			clusters[cluster] = true
+			if route == nil {
+				db, _, _ := strings.Cut(table, ".")
+				route = &ClusterRoute{Cluster: cluster, Database: db}
+			}
+			route.Tables = append(route.Tables, table)
+		}
+	}
+
+	if len(clusters) > 1 {
+		names := make([]string, 0, len(clusters))
+		for name := range clusters {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, mysql.NewError(mysql.ER_NOT_SUPPORTED_YET, fmt.Sprintf("statement references tables in more than one cluster: %s", strings.Join(names, ", ")))
+	}
+
+	return route, nil
+}
+
+// switchCluster moves the session to the read and write servers of another
+// cluster. Transactions, locked sessions and prepared statements are tied to
+// their backend connections, so those sessions cannot move.
+func (ph *ProxyHandler) switchCluster(name string) error {
+	if name == ph.cluster {
+		return nil
+	}
+
+	ph.stmtMutex.Lock()
+	preparedStatements := len(ph.preparedStmts)
+	ph.stmtMutex.Unlock()
+
+	if ph.inTransaction || ph.connectionLocked || preparedStatements > 0 {
+		return mysql.NewError(mysql.ER_NOT_SUPPORTED_YET, fmt.Sprintf("cannot move a session with open transactions, session state or prepared statements from cluster %s to %s", ph.cluster, name))
+	}
+
+	backends, err := ph.p.clusters.Get(name)
+	if err != nil {
+		return err
+	}
+	readServer, err := backends.GetReader()
+	if err != nil {
+		return err
+	}
+	writeServer, err := backends.GetWriter()
+	if err != nil {
+		return err
+	}
+
+	readConn, err := readServer.GetNextConn(NewUserKey(readServer.address, ph.backendUser, ph.backendPassword))
+	if err != nil {
+		return err
+	}
+	writeConn, err := writeServer.GetNextConn(NewUserKey(writeServer.address, ph.backendUser, ph.backendPassword))
+	if err != nil {
+		readServer.PutConn(NewUserKey(readServer.address, ph.backendUser, ph.backendPassword), readConn)
+		return err
+	}
+
+	if ph.p.config.LogQueries {
+		ph.logger().Info("moving session to another cluster", "from", ph.cluster, "to", name)
+	}
+
+	ph.releaseConns()
+
+	ph.cluster = name
+	ph.readServer = readServer
+	ph.writeServer = writeServer
+	ph.read_conn = readConn
+	ph.write_conn = writeConn
+	ph.current_conn = readConn
+	ph.trackThreads()
+
+	return nil
+}
+
+// releaseConns returns the session's read and write connections to their
+// pools, or closes them when their backend threads were killed
+func (ph *ProxyHandler) releaseConns() {
+	ph.threads.Store(nil)
+	if ph.killed.Load() {
+		if ph.read_conn != nil {
+			ph.readServer.DropConn(NewUserKey(ph.readServer.address, ph.backendUser, ph.backendPassword), ph.read_conn)
+		}
+		if ph.write_conn != nil {
+			ph.writeServer.DropConn(NewUserKey(ph.writeServer.address, ph.backendUser, ph.backendPassword), ph.write_conn)
+		}
+		ph.read_conn = nil
+		ph.write_conn = nil
+		ph.current_conn = nil
+		return
+	}
+	if ph.read_conn != nil {
+		if err := ph.readServer.PutConn(NewUserKey(ph.readServer.address, ph.backendUser, ph.backendPassword), ph.read_conn); err != nil {
+			ph.logger().Error("failed to return connection to pool", "backend", ph.readServer.address, "err", err)
+		}
+	}
+	if ph.write_conn != nil {
+		if err := ph.writeServer.PutConn(NewUserKey(ph.writeServer.address, ph.backendUser, ph.backendPassword), ph.write_conn); err != nil {
+			ph.logger().Error("failed to return connection to pool", "backend", ph.writeServer.address, "err", err)
+		}
+	}
+	ph.read_conn = nil
+	ph.write_conn = nil
+	ph.current_conn = nil
+}
+
+// executeOnCluster runs a single statement on another cluster than the one
+// the session is using, on a connection borrowed for that statement
+func (ph *ProxyHandler) executeOnCluster(route *ClusterRoute, cmd int, query string) (*mysql.Result, error) {
+	if ph.inTransaction || ph.connectionLocked {
+		return nil, mysql.NewError(mysql.ER_NOT_SUPPORTED_YET, fmt.Sprintf("cannot run a statement on cluster %s inside a session bound to cluster %s", route.Cluster, ph.cluster))
+	}
+
+	backends, err := ph.p.clusters.Get(route.Cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	read := false
+	switch cmd {
+	case Select, Show, Desc, Describe:
+		read = true
+	}
+
+	var svr *BackendServer
+	if read && !ph.hints.wantsPrimary() {
+		svr, err = backends.GetReader()
+	} else {
+		svr, err = backends.GetWriter()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key := NewUserKey(svr.address, ph.backendUser, ph.backendPassword)
+	conn, err := svr.GetNextConn(key)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := svr.PutConn(key, conn); err != nil {
+			ph.logger().Error("failed to return connection to pool", "backend", svr.address, "err", err)
+		}
+	}()
+
+	if route.Database != "" {
+		if err := conn.UseDB(route.Database); err != nil {
+			return nil, err
+		}
+	}
+
+	// the cache is invalidated with the query as the client sent it
+	tagged := ph.session.tag(query)
+	ph.lastBackend = conn.RemoteAddr().String()
+
+	if ph.p.config.LogQueries {
+		ph.logger().Info("executing query on cluster", "cluster", route.Cluster, "tables", route.Tables, "query", ph.p.redactor.Query(tagged))
+	}
+
+	res, err := ph.executeWithTimeout(svr, conn, ph.statementTimeout(query), func() (*mysql.Result, error) {
+		return conn.Execute(tagged)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if !read {
+		ph.p.cache.InvalidateForWrite(route.Database, query)
+		res.Resultset = nil // force an OK packet to be sent by go-mysql
+	}
+	return res, nil
+}
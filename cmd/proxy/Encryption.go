@@ -0,0 +1,705 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+)
+
+const (
+	EncryptionModeRandomized    = "randomized"
+	EncryptionModeDeterministic = "deterministic"
+
+	// stored values look like enc:v1:<key>:<base64 nonce and ciphertext>
+	encryptionPrefix = "enc:v1:"
+)
+
+type EncryptedColumnConfig struct {
+	Column  string   `yaml:"column"`  // table.column
+	Mode    string   `yaml:"mode"`    // randomized (default) or deterministic, which allows equality lookups
+	Key     string   `yaml:"key"`     // key name in the key file, defaults to the first key
+	Readers []string `yaml:"readers"` // proxy users that get plaintext back, empty means everyone
+}
+
+type EncryptionConfig struct {
+	Enabled bool                    `yaml:"enabled"`
+	KeyFile string                  `yaml:"key_file"` // lines of <name> <base64 key>, keys are 16, 24 or 32 bytes
+	Columns []EncryptedColumnConfig `yaml:"columns"`
+}
+
+type encryptionKey struct {
+	name  string
+	aead  cipher.AEAD
+	nonce []byte // HMAC key deriving deterministic nonces
+}
+
+type encryptedColumn struct {
+	table         string // lower case
+	column        string // lower case
+	deterministic bool
+	key           *encryptionKey
+	readers       map[string]bool
+}
+
+// Encryption encrypts the values of configured columns with AES-GCM before
+// statements reach the backend and decrypts them in results for users
+// allowed to read them. Randomized values use a fresh nonce each time,
+// deterministic values derive the nonce from the value so equal values
+// encrypt equally and can be looked up with = and IN. Only literals and
+// parameters compared with or assigned to the column directly are
+// encrypted, values inside expressions are sent as they are. INSERT and
+// REPLACE into a table with encrypted columns must list their columns.
+type Encryption struct {
+	config  *EncryptionConfig
+	keys    map[string]*encryptionKey
+	columns map[string][]*encryptedColumn // lower case column -> tables it is encrypted in
+	tables  map[string]bool
+}
+
+func NewEncryption(config *EncryptionConfig) (*Encryption, error) {
+	e := &Encryption{
+		config:  config,
+		keys:    make(map[string]*encryptionKey),
+		columns: make(map[string][]*encryptedColumn),
+		tables:  make(map[string]bool),
+	}
+	if !config.Enabled {
+		return e, nil
+	}
+
+	if config.KeyFile == "" {
+		config.KeyFile = "data/keys"
+	}
+	first, err := e.loadKeys(config.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, columnConfig := range config.Columns {
+		table, column, ok := strings.Cut(strings.ToLower(unquoteIdentifier(columnConfig.Column)), ".")
+		if !ok || table == "" || column == "" {
+			return nil, fmt.Errorf("encryption: column must be table.column: %s", columnConfig.Column)
+		}
+
+		c := &encryptedColumn{
+			table:  table,
+			column: column,
+		}
+		switch columnConfig.Mode {
+		case "", EncryptionModeRandomized:
+		case EncryptionModeDeterministic:
+			c.deterministic = true
+		default:
+			return nil, fmt.Errorf("encryption: %s: unknown mode: %s", columnConfig.Column, columnConfig.Mode)
+		}
+
+		keyName := columnConfig.Key
+		if keyName == "" {
+			keyName = first
+		}
+		if c.key = e.keys[keyName]; c.key == nil {
+			return nil, fmt.Errorf("encryption: %s: unknown key: %s", columnConfig.Column, keyName)
+		}
+
+		if len(columnConfig.Readers) > 0 {
+			c.readers = make(map[string]bool, len(columnConfig.Readers))
+			for _, user := range columnConfig.Readers {
+				c.readers[user] = true
+			}
+		}
+
+		e.columns[column] = append(e.columns[column], c)
+		e.tables[table] = true
+	}
+
+	return e, nil
+}
+
+// loadKeys reads the key file, returning the name of its first key. Keys
+// that are no longer used for new values must stay in the file for as long
+// as values encrypted with them are stored.
+func (e *Encryption) loadKeys(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("encryption: failed to open key file: %w", err)
+	}
+	defer file.Close()
+
+	first := ""
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) != 2 || strings.Contains(fields[0], ":") {
+			return "", fmt.Errorf("encryption: %s:%d: expected <name> <base64 key>", path, line)
+		}
+		raw, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil {
+			return "", fmt.Errorf("encryption: %s:%d: %w", path, line, err)
+		}
+		block, err := aes.NewCipher(raw)
+		if err != nil {
+			return "", fmt.Errorf("encryption: %s:%d: %w", path, line, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return "", fmt.Errorf("encryption: %s:%d: %w", path, line, err)
+		}
+		if _, ok := e.keys[fields[0]]; ok {
+			return "", fmt.Errorf("encryption: %s:%d: duplicate key: %s", path, line, fields[0])
+		}
+
+		mac := hmac.New(sha256.New, raw)
+		mac.Write([]byte("dbinsight deterministic nonce"))
+		e.keys[fields[0]] = &encryptionKey{
+			name:  fields[0],
+			aead:  aead,
+			nonce: mac.Sum(nil),
+		}
+		if first == "" {
+			first = fields[0]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("encryption: %w", err)
+	}
+	if first == "" {
+		return "", fmt.Errorf("encryption: no keys in %s", path)
+	}
+	return first, nil
+}
+
+func (e *Encryption) enabled() bool {
+	return e != nil && e.config.Enabled && len(e.columns) > 0
+}
+
+// lookup returns the encrypted column a value compared with or assigned to
+// column (name, alias.name or table.name) belongs to, given the tables of
+// the statement
+func (e *Encryption) lookup(column string, tables []string) *encryptedColumn {
+	qualifier, name := "", column
+	if i := strings.LastIndexByte(column, '.'); i >= 0 {
+		qualifier, name = column[:i], column[i+1:]
+	}
+	candidates := e.columns[name]
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	for _, c := range candidates {
+		if qualifier == c.table || strings.HasSuffix(qualifier, "."+c.table) {
+			return c
+		}
+	}
+	// an alias or no qualifier, go by the tables of the statement
+	for _, c := range candidates {
+		for _, table := range tables {
+			if table == c.table || strings.HasSuffix(table, "."+c.table) {
+				return c
+			}
+		}
+	}
+	return nil
+}
+
+// hasTable reports whether the table, qualified or not, has encrypted columns
+func (e *Encryption) hasTable(table string) bool {
+	name := strings.ToLower(table)
+	if i := strings.LastIndexByte(name, '.'); i >= 0 {
+		name = name[i+1:]
+	}
+	return e.tables[name]
+}
+
+// statementTables returns the lower case tables of the query, nil when none
+// of them has encrypted columns
+func (e *Encryption) statementTables(query string) []string {
+	tables := extractTables(Tokenize(query))
+	found := false
+	for i, table := range tables {
+		tables[i] = strings.ToLower(table)
+		name := tables[i]
+		if j := strings.LastIndexByte(name, '.'); j >= 0 {
+			name = name[j+1:]
+		}
+		found = found || e.tables[name]
+	}
+	if !found {
+		return nil
+	}
+	return tables
+}
+
+func (e *Encryption) encrypt(c *encryptedColumn, plaintext []byte) (string, error) {
+	nonce := make([]byte, c.key.aead.NonceSize())
+	if c.deterministic {
+		mac := hmac.New(sha256.New, c.key.nonce)
+		mac.Write([]byte(c.table + "." + c.column + "\x00"))
+		mac.Write(plaintext)
+		copy(nonce, mac.Sum(nil))
+	} else if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("encryption: %w", err)
+	}
+
+	sealed := c.key.aead.Seal(nonce, nonce, plaintext, nil)
+	return encryptionPrefix + c.key.name + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (e *Encryption) decrypt(value []byte) ([]byte, error) {
+	keyName, data, ok := strings.Cut(strings.TrimPrefix(string(value), encryptionPrefix), ":")
+	if !ok {
+		return nil, fmt.Errorf("malformed value")
+	}
+	key := e.keys[keyName]
+	if key == nil {
+		return nil, fmt.Errorf("unknown key: %s", keyName)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < key.aead.NonceSize() {
+		return nil, fmt.Errorf("malformed value")
+	}
+	size := key.aead.NonceSize()
+	return key.aead.Open(nil, sealed[:size], sealed[size:], nil)
+}
+
+// literalValue returns the value a string or number literal stands for,
+// ok is false for literals it can't tell the value of
+func literalValue(text string) (value []byte, ok bool) {
+	if text != "" && (text[0] == '-' || text[0] == '+') {
+		// signed numbers are stored as their text, -'1' is arithmetic
+		number := strings.TrimSpace(text[1:])
+		if _, err := strconv.ParseFloat(number, 64); err != nil {
+			return nil, false
+		}
+		if text[0] == '-' {
+			number = "-" + number
+		}
+		return []byte(number), true
+	}
+
+	prefix, text := splitLiteralPrefix(text)
+	switch strings.ToLower(prefix) {
+	case "", "n":
+	case "x":
+		b, err := hex.DecodeString(strings.Trim(text, "'"))
+		return b, err == nil
+	case "b":
+		return bitValue(strings.Trim(text, "'"))
+	default:
+		// a charset introducer, the value is sent as the bytes it has here
+		if !strings.HasPrefix(prefix, "_") {
+			return nil, false
+		}
+	}
+
+	switch {
+	case strings.HasPrefix(text, "0x") || strings.HasPrefix(text, "0X"):
+		b, err := hex.DecodeString(text[2:])
+		return b, err == nil
+	case strings.HasPrefix(text, "0b"):
+		return bitValue(text[2:])
+	}
+	if len(text) < 2 || (text[0] != '\'' && text[0] != '"') {
+		return []byte(text), true
+	}
+
+	quote := text[0]
+	text = text[1 : len(text)-1]
+	value = make([]byte, 0, len(text))
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case c == '\\' && i+1 < len(text):
+			i++
+			switch text[i] {
+			case '0':
+				value = append(value, 0)
+			case 'n':
+				value = append(value, '\n')
+			case 'r':
+				value = append(value, '\r')
+			case 't':
+				value = append(value, '\t')
+			case 'b':
+				value = append(value, '\b')
+			case 'Z':
+				value = append(value, 26)
+			case '%', '_':
+				// kept escaped for LIKE
+				value = append(value, '\\', text[i])
+			default:
+				value = append(value, text[i])
+			}
+		case c == quote && i+1 < len(text) && text[i+1] == quote:
+			value = append(value, c)
+			i++
+		default:
+			value = append(value, c)
+		}
+	}
+	return value, true
+}
+
+// bitValue returns the bytes of a b'0101' or 0b0101 literal
+func bitValue(bits string) ([]byte, bool) {
+	if bits == "" {
+		return nil, false
+	}
+	value := make([]byte, (len(bits)+7)/8)
+	for i := 0; i < len(bits); i++ {
+		bit := len(bits) - 1 - i
+		switch bits[i] {
+		case '1':
+			value[len(value)-1-bit/8] |= 1 << (bit % 8)
+		case '0':
+		default:
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// unmappedInsert returns the table of an INSERT or REPLACE whose values
+// can't be told apart by column, because they come without a column list
+// or from a SELECT. columns is the column list, nil when there is none.
+func unmappedInsert(query string) (table string, columns []string, ok bool) {
+	tokens := lexSQL(query)
+	if len(tokens) == 0 || !(tokens[0].isKeyword("INSERT") || tokens[0].isKeyword("REPLACE")) {
+		return "", nil, false
+	}
+	i := 1
+	for i < len(tokens) && (tokens[i].isKeyword("LOW_PRIORITY") || tokens[i].isKeyword("DELAYED") ||
+		tokens[i].isKeyword("HIGH_PRIORITY") || tokens[i].isKeyword("IGNORE") || tokens[i].isKeyword("INTO")) {
+		i++
+	}
+	if i >= len(tokens) {
+		return "", nil, false
+	}
+	table = tokens[i].text
+	i++
+
+	// INSERT INTO t PARTITION (p0) ...
+	if i < len(tokens) && tokens[i].isKeyword("PARTITION") {
+		depth := 0
+		for i++; i < len(tokens); i++ {
+			if tokens[i].text == "(" {
+				depth++
+			} else if tokens[i].text == ")" {
+				depth--
+				if depth == 0 {
+					i++
+					break
+				}
+			}
+		}
+	}
+
+	selects := func(i int) bool {
+		return i < len(tokens) && (tokens[i].isKeyword("SELECT") || tokens[i].isKeyword("TABLE") ||
+			tokens[i].isKeyword("WITH") || (tokens[i].text == "(" && !tokens[i].quoted))
+	}
+
+	// INSERT INTO t (a, b) ..., unless the parenthesis opens a SELECT
+	if i < len(tokens) && tokens[i].text == "(" && !selects(i+1) {
+		columns = []string{}
+		for i++; i < len(tokens) && tokens[i].text != ")"; i++ {
+			if tokens[i].text != "," {
+				columns = append(columns, strings.ToLower(tokens[i].text))
+			}
+		}
+		return table, columns, selects(i + 1)
+	}
+
+	if i < len(tokens) && (tokens[i].isKeyword("VALUES") || tokens[i].isKeyword("VALUE") || selects(i)) {
+		return table, nil, true
+	}
+	return "", nil, false
+}
+
+// comparisons an encrypted column supports with a value, deterministic
+// columns only
+var encryptedEqualities = map[string]bool{
+	"=": true, "<=>": true, "!=": true, "<>": true, "IN": true, "NOT IN": true,
+}
+
+// comparisonAt returns the comparison operator starting at tokens[i] and
+// how many tokens it spans, n is 0 when there is none
+func comparisonAt(tokens []sqlToken, i int) (op string, n int) {
+	for n < 3 && i+n < len(tokens) && !tokens[i+n].quoted && len(tokens[i+n].text) == 1 && strings.Contains("<>=!", tokens[i+n].text) {
+		op += tokens[i+n].text
+		n++
+	}
+	if n > 0 {
+		return op, n
+	}
+
+	if i < len(tokens) && tokens[i].isKeyword("NOT") {
+		op, n = "NOT ", 1
+	} else if i < len(tokens) && tokens[i].isKeyword("SOUNDS") {
+		op, n = "SOUNDS ", 1
+	}
+	if i+n < len(tokens) {
+		for _, keyword := range []string{"IN", "LIKE", "BETWEEN", "REGEXP", "RLIKE"} {
+			if tokens[i+n].isKeyword(keyword) {
+				return op + keyword, n + 1
+			}
+		}
+	}
+	return "", 0
+}
+
+// valueAt reports whether tokens[i] starts a literal or a ? placeholder
+func valueAt(tokens []sqlToken, i int) bool {
+	if i >= len(tokens) {
+		return false
+	}
+	t := tokens[i]
+	switch {
+	case t.quoted:
+		return true
+	case t.identifier:
+		return false
+	case t.text == "?":
+		return true
+	case t.text == "-" || t.text == "+":
+		return valueAt(tokens, i+1)
+	case isLiteralPrefix(t.text):
+		return i+1 < len(tokens) && tokens[i+1].quoted
+	}
+	_, n := literalAt(tokens, i)
+	return n > 0 || strings.HasPrefix(strings.ToLower(t.text), "0x") || strings.HasPrefix(strings.ToLower(t.text), "0b")
+}
+
+// checkComparisons refuses comparisons of encrypted columns with values
+// that could never match: ranges and patterns, since ciphertexts don't
+// keep the order of their values, and any comparison of a randomized
+// column, which encrypts equal values differently every time. Values
+// written before the column aren't encrypted and are refused as well.
+func (e *Encryption) checkComparisons(tokens []sqlToken, tables []string) error {
+	depth := 0
+	assigning := false // in the SET list of an UPDATE, INSERT or ON DUPLICATE KEY UPDATE
+	for i, t := range tokens {
+		switch {
+		case t.quoted:
+			continue
+		case t.text == "(":
+			depth++
+			continue
+		case t.text == ")":
+			depth--
+			continue
+		case depth == 0 && (t.isKeyword("SET") || (t.isKeyword("UPDATE") && i > 0 && tokens[i-1].isKeyword("KEY"))):
+			assigning = true
+			continue
+		case depth == 0 && (t.isKeyword("WHERE") || t.isKeyword("ORDER") || t.isKeyword("LIMIT")):
+			assigning = false
+			continue
+		}
+
+		c := e.lookup(strings.ToLower(t.text), tables)
+		if c == nil {
+			continue
+		}
+
+		// the column followed by the comparison
+		op, n := comparisonAt(tokens, i+1)
+		value := i + 1 + n
+		if op == "IN" || op == "NOT IN" {
+			value++ // the list's (
+		}
+		if n > 0 && valueAt(tokens, value) {
+			assignment := op == "=" && assigning && depth == 0 && i > 0 &&
+				(tokens[i-1].isKeyword("SET") || tokens[i-1].isKeyword("UPDATE") || tokens[i-1].text == ",")
+			switch {
+			case assignment:
+			case !encryptedEqualities[op]:
+				return mysql.NewError(mysql.ER_NOT_SUPPORTED_YET, fmt.Sprintf("%s.%s is encrypted, it can't be compared with %s", c.table, c.column, op))
+			case !c.deterministic:
+				return mysql.NewError(mysql.ER_NOT_SUPPORTED_YET, fmt.Sprintf("%s.%s is encrypted with randomized mode, it can't be compared with values", c.table, c.column))
+			}
+		}
+
+		// a value followed by the comparison and the column
+		j := i - 1
+		for j >= 0 && i-j <= 3 && !tokens[j].quoted && len(tokens[j].text) == 1 && strings.Contains("<>=!", tokens[j].text) {
+			j--
+		}
+		if j < i-1 && j >= 0 && valueAt(tokens, j) {
+			return mysql.NewError(mysql.ER_NOT_SUPPORTED_YET, fmt.Sprintf("%s.%s is encrypted, compare it with a value by naming the column first", c.table, c.column))
+		}
+	}
+	return nil
+}
+
+// EncryptQuery returns the query with the literals of encrypted columns
+// replaced by their encrypted values
+func (e *Encryption) EncryptQuery(query string) (string, error) {
+	if !e.enabled() {
+		return query, nil
+	}
+
+	// values that can't be matched to their columns are refused rather
+	// than stored in plaintext
+	if table, columns, ok := unmappedInsert(query); ok && e.hasTable(table) {
+		if columns == nil {
+			return query, mysql.NewError(mysql.ER_NOT_SUPPORTED_YET, fmt.Sprintf("%s has encrypted columns, INSERT and REPLACE must list their columns", table))
+		}
+		for _, column := range columns {
+			if c := e.lookup(column, []string{strings.ToLower(table)}); c != nil {
+				return query, mysql.NewError(mysql.ER_NOT_SUPPORTED_YET, fmt.Sprintf("%s.%s is encrypted, its values can't be inserted from a SELECT", c.table, c.column))
+			}
+		}
+	}
+
+	tables := e.statementTables(query)
+	if tables == nil {
+		return query, nil
+	}
+	if err := e.checkComparisons(lexSQL(query), tables); err != nil {
+		return query, err
+	}
+
+	var err error
+	encrypted := scanLiterals(query, true, func(column string, text string) string {
+		c := e.lookup(column, tables)
+		if c == nil || text == "?" || err != nil {
+			return text
+		}
+		plaintext, ok := literalValue(text)
+		if !ok {
+			err = mysql.NewError(mysql.ER_NOT_SUPPORTED_YET, fmt.Sprintf("can't encrypt the value of %s.%s: %s", c.table, c.column, text))
+			return text
+		}
+		var value string
+		value, err = e.encrypt(c, plaintext)
+		return "'" + value + "'"
+	})
+	if err != nil {
+		return query, err
+	}
+	return encrypted, nil
+}
+
+// EncryptArgs returns the prepared statement arguments with the parameters
+// of encrypted columns encrypted, args itself is left untouched
+func (e *Encryption) EncryptArgs(query string, args []interface{}) ([]interface{}, error) {
+	if !e.enabled() || len(args) == 0 {
+		return args, nil
+	}
+	tables := e.statementTables(query)
+	if tables == nil {
+		return args, nil
+	}
+
+	// the encrypted column of each placeholder, in order
+	columns := make([]*encryptedColumn, 0, len(args))
+	scanLiterals(query, true, func(column string, text string) string {
+		if text == "?" {
+			columns = append(columns, e.lookup(column, tables))
+		}
+		return text
+	})
+
+	var encrypted []interface{}
+	for i, arg := range args {
+		if i >= len(columns) || columns[i] == nil || arg == nil {
+			continue
+		}
+
+		var plaintext []byte
+		switch v := arg.(type) {
+		case []byte:
+			plaintext = v
+		case string:
+			plaintext = []byte(v)
+		default:
+			plaintext = []byte(fmt.Sprintf("%v", v))
+		}
+
+		value, err := e.encrypt(columns[i], plaintext)
+		if err != nil {
+			return nil, err
+		}
+		if encrypted == nil {
+			encrypted = append([]interface{}(nil), args...)
+		}
+		encrypted[i] = value
+	}
+	if encrypted == nil {
+		return args, nil
+	}
+	return encrypted, nil
+}
+
+// resultColumn returns the encrypted column a result field comes from
+func (e *Encryption) resultColumn(field *mysql.Field) *encryptedColumn {
+	name := strings.ToLower(string(field.OrgName))
+	if name == "" {
+		name = strings.ToLower(string(field.Name))
+	}
+	table := strings.ToLower(string(field.OrgTable))
+	if table == "" {
+		table = strings.ToLower(string(field.Table))
+	}
+	for _, c := range e.columns[name] {
+		if c.table == table {
+			return c
+		}
+	}
+	return nil
+}
+
+// Decrypt returns the result with the values of encrypted columns the user
+// may read decrypted, other users get the stored values. Results may be
+// shared with other sessions through the cache, so a copy is returned when
+// anything is decrypted.
+func (e *Encryption) Decrypt(user string, res *mysql.Result, text bool) (*mysql.Result, error) {
+	if !e.enabled() || res == nil || res.Resultset == nil {
+		return res, nil
+	}
+
+	columns := make([]bool, len(res.Fields))
+	found := false
+	for i, field := range res.Fields {
+		c := e.resultColumn(field)
+		if c != nil && isStringType(field.Type) && (c.readers == nil || c.readers[user]) {
+			columns[i] = true
+			found = true
+		}
+	}
+	if !found {
+		return res, nil
+	}
+
+	return rewriteResult(res, res.Fields, columns, text, func(column int, value *mysql.FieldValue) []byte {
+		stored := fieldValueText(value)
+		if !strings.HasPrefix(string(stored), encryptionPrefix) {
+			// written before the column was encrypted
+			return stored
+		}
+		plaintext, err := e.decrypt(stored)
+		if err != nil {
+			logFor("encryption").Error("failed to decrypt", "column", string(res.Fields[column].Name), "err", err)
+			return stored
+		}
+		return plaintext
+	})
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestLiteralValue(t *testing.T) {
+	tests := []struct {
+		text  string
+		value string
+		ok    bool
+	}{
+		{"'abc'", "abc", true},
+		{`"abc"`, "abc", true},
+		{"'it''s'", "it's", true},
+		{`'a\'b\n'`, "a'b\n", true},
+		{"123", "123", true},
+		{"0x414243", "ABC", true},
+		{"0b01000001", "A", true},
+		{"X'414243'", "ABC", true},
+		{"x'4'", "", false},
+		{"B'0100000101000010'", "AB", true},
+		{"b'2'", "", false},
+		{"N'abc'", "abc", true},
+		{"_utf8mb4'abc'", "abc", true},
+		{"_binary'abc'", "abc", true},
+		{"-123", "-123", true},
+		{"- 1.5", "-1.5", true},
+		{"+7", "7", true},
+		{"-'123'", "", false},
+	}
+
+	for _, test := range tests {
+		value, ok := literalValue(test.text)
+		if ok != test.ok || (ok && string(value) != test.value) {
+			t.Errorf("literalValue(%q) = %q, %v, want %q, %v", test.text, value, ok, test.value, test.ok)
+		}
+	}
+}
+
+// testEncryption encrypts users.ssn deterministically and users.card
+// randomized
+func testEncryption(t *testing.T) *Encryption {
+	keyFile := filepath.Join(t.TempDir(), "keys")
+	if err := os.WriteFile(keyFile, []byte("k1 MDEyMzQ1Njc4OTAxMjM0NTY3ODkwMTIzNDU2Nzg5MDE=\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	e, err := NewEncryption(&EncryptionConfig{
+		Enabled: true,
+		KeyFile: keyFile,
+		Columns: []EncryptedColumnConfig{
+			{Column: "users.ssn", Mode: EncryptionModeDeterministic},
+			{Column: "users.card", Mode: EncryptionModeRandomized},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestEncryptQuery(t *testing.T) {
+	e := testEncryption(t)
+
+	// E(v) in a wanted query stands for the quoted ciphertext of v
+	c := e.columns["ssn"][0]
+	encrypted := regexp.MustCompile(`E\(([^)]*)\)`)
+	expand := func(query string) string {
+		return encrypted.ReplaceAllStringFunc(query, func(m string) string {
+			value, err := e.encrypt(c, []byte(encrypted.FindStringSubmatch(m)[1]))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return "'" + value + "'"
+		})
+	}
+
+	tests := []struct {
+		query string
+		want  string // empty when the query is refused
+	}{
+		{"SELECT * FROM users WHERE ssn = '123'", "SELECT * FROM users WHERE ssn = E(123)"},
+		{"SELECT * FROM users WHERE ssn = 123", "SELECT * FROM users WHERE ssn = E(123)"},
+		{"SELECT * FROM users WHERE ssn = _utf8mb4'123'", "SELECT * FROM users WHERE ssn = E(123)"},
+		{"SELECT * FROM users WHERE ssn = X'313233'", "SELECT * FROM users WHERE ssn = E(123)"},
+		{"SELECT * FROM users WHERE ssn IN ('1', '2')", "SELECT * FROM users WHERE ssn IN (E(1), E(2))"},
+		{"SELECT * FROM users u WHERE u.ssn = '1'", "SELECT * FROM users u WHERE u.ssn = E(1)"},
+		{"SELECT * FROM users WHERE ssn = ?", "SELECT * FROM users WHERE ssn = ?"},
+		{"SELECT * FROM users WHERE name = 'ssn'", "SELECT * FROM users WHERE name = 'ssn'"},
+		{"SELECT * FROM users WHERE ssn = '1' /* ssn = '2' */", "SELECT * FROM users WHERE ssn = E(1) /* ssn = '2' */"},
+		{"SELECT * FROM orders WHERE ssn = '1'", "SELECT * FROM orders WHERE ssn = '1'"},
+		{"UPDATE users SET ssn = '1' WHERE id = 2", "UPDATE users SET ssn = E(1) WHERE id = 2"},
+		{"UPDATE users SET ssn = -123", "UPDATE users SET ssn = E(-123)"},
+		{"UPDATE users SET ssn = - 123, age = 1-2", "UPDATE users SET ssn = E(-123), age = 1-2"},
+		{"UPDATE users SET ssn = -'123'", ""},
+
+		// executed comments are part of the statement
+		{"UPDATE users SET ssn = /*!50000 '123' */", "UPDATE users SET ssn = /*!50000 E(123) */"},
+		{"INSERT INTO users (ssn) VALUES /*!50000 ('123') */", "INSERT INTO users (ssn) VALUES /*!50000 (E(123)) */"},
+		{"INSERT INTO users (ssn) VALUES /*! ('123') */", "INSERT INTO users (ssn) VALUES /*! (E(123)) */"},
+
+		// INSERT values are only encrypted when they map to the column
+		{"INSERT INTO users (ssn, name) VALUES ('1', 'bob'), ('2', 'amy')", "INSERT INTO users (ssn, name) VALUES (E(1), 'bob'), (E(2), 'amy')"},
+		{"INSERT INTO users (name, ssn) VALUES (CONCAT('a', 'b'), '1')", "INSERT INTO users (name, ssn) VALUES (CONCAT('a', 'b'), E(1))"},
+		{"INSERT INTO users SET ssn = '1'", "INSERT INTO users SET ssn = E(1)"},
+		{"INSERT INTO users VALUES ('123', 'bob')", ""},
+		{"INSERT INTO app.users VALUES ('123', 'bob')", ""},
+		{"INSERT IGNORE users VALUE ('123', 'bob')", ""},
+		{"REPLACE INTO users SELECT * FROM staging", ""},
+		{"INSERT INTO users PARTITION (p0) VALUES ('123', 'bob')", ""},
+		{"INSERT INTO users (id, ssn) SELECT 1, '123'", ""},
+		{"INSERT INTO users (id, ssn) (SELECT 1, '123')", ""},
+		{"INSERT INTO users (id, ssn) TABLE staging", ""},
+		{"INSERT INTO users (id, name) SELECT 1, 'bob'", "INSERT INTO users (id, name) SELECT 1, 'bob'"},
+		{"INSERT INTO orders VALUES (1, 'x')", "INSERT INTO orders VALUES (1, 'x')"},
+
+		// values that can't be told are refused
+		{"SELECT * FROM users WHERE ssn = x'4'", ""},
+	}
+
+	for _, test := range tests {
+		got, err := e.EncryptQuery(test.query)
+		switch {
+		case test.want == "" && err == nil:
+			t.Errorf("EncryptQuery(%q) = %q, want an error", test.query, got)
+		case test.want != "" && err != nil:
+			t.Errorf("EncryptQuery(%q) failed: %v", test.query, err)
+		case test.want != "" && got != expand(test.want):
+			t.Errorf("EncryptQuery(%q) = %q, want %q", test.query, got, expand(test.want))
+		}
+	}
+}
+
+func TestEncryptQueryComparisons(t *testing.T) {
+	e := testEncryption(t)
+
+	tests := []struct {
+		query string
+		ok    bool
+	}{
+		// deterministic columns are looked up with equality only
+		{"SELECT * FROM users WHERE ssn = '1'", true},
+		{"SELECT * FROM users WHERE ssn <=> '1'", true},
+		{"SELECT * FROM users WHERE ssn != '1'", true},
+		{"SELECT * FROM users WHERE ssn NOT IN ('1', '2')", true},
+		{"SELECT * FROM users WHERE ssn = ?", true},
+		{"SELECT * FROM users WHERE ssn LIKE '12%'", false},
+		{"SELECT * FROM users WHERE ssn NOT LIKE '12%'", false},
+		{"SELECT * FROM users WHERE ssn > '100'", false},
+		{"SELECT * FROM users WHERE ssn <= ?", false},
+		{"SELECT * FROM users WHERE ssn BETWEEN '1' AND '2'", false},
+		{"SELECT * FROM users WHERE ssn REGEXP '^1'", false},
+		{"SELECT * FROM users WHERE '1' = ssn", false},
+		{"SELECT * FROM users WHERE ssn IS NULL", true},
+		{"SELECT * FROM users u JOIN staff s ON u.ssn = s.ssn", true},
+		{"SELECT * FROM users WHERE name LIKE '12%'", true},
+		{"SELECT * FROM users WHERE note = 'ssn > 1'", true},
+
+		// randomized columns can be written but never compared
+		{"UPDATE users SET card = '4111' WHERE id = 1", true},
+		{"UPDATE users SET name = 'x', card = ? WHERE id = 1", true},
+		{"INSERT INTO users SET card = '4111'", true},
+		{"INSERT INTO users (id, card) VALUES (1, '4111') ON DUPLICATE KEY UPDATE card = '4111'", true},
+		{"SELECT * FROM users WHERE card = '4111'", false},
+		{"SELECT * FROM users WHERE card IN ('4111')", false},
+		{"SELECT * FROM users WHERE card = ?", false},
+		{"UPDATE users SET name = 'x' WHERE card = '4111'", false},
+		{"DELETE FROM users WHERE card <> '4111'", false},
+		{"SELECT * FROM users WHERE card IS NOT NULL", true},
+	}
+
+	for _, test := range tests {
+		_, err := e.EncryptQuery(test.query)
+		if (err == nil) != test.ok {
+			t.Errorf("EncryptQuery(%q) error = %v, want ok %v", test.query, err, test.ok)
+		}
+	}
+}
+
+func TestEncryptQueryRandomized(t *testing.T) {
+	e := testEncryption(t)
+
+	query := "UPDATE users SET card = '4111' WHERE id = 1"
+	first, err := e.EncryptQuery(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := e.EncryptQuery(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(first, "4111") || !strings.Contains(first, "'"+encryptionPrefix) {
+		t.Errorf("EncryptQuery(%q) = %q, want card encrypted", query, first)
+	}
+	if first == second {
+		t.Errorf("EncryptQuery(%q) encrypted equal values equally in randomized mode", query)
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+)
+
+const (
+	FirewallActionAllow = "allow"
+	FirewallActionDeny  = "deny"
+)
+
+type FirewallRuleConfig struct {
+	Name         string   `yaml:"name"`
+	Action       string   `yaml:"action"`        // allow or deny
+	Users        []string `yaml:"users"`         // proxy users, empty matches everyone
+	Databases    []string `yaml:"databases"`     // current database
+	Statements   []string `yaml:"statements"`    // SELECT, DROP, TRUNCATE, GRANT ...
+	Tables       []string `yaml:"tables"`        // table or database.table
+	Digests      []string `yaml:"digests"`       // digests produced by QueryDigest
+	Pattern      string   `yaml:"pattern"`       // regular expression matched against the query
+	WithoutWhere bool     `yaml:"without_where"` // only match statements lacking a WHERE clause
+	ErrorCode    uint16   `yaml:"error_code"`
+	ErrorMessage string   `yaml:"error_message"`
+}
+
+type FirewallConfig struct {
+	Enabled       bool                 `yaml:"enabled"`
+	DefaultAction string               `yaml:"default_action"`
+	ErrorCode     uint16               `yaml:"error_code"`
+	ErrorMessage  string               `yaml:"error_message"`
+	Rules         []FirewallRuleConfig `yaml:"rules"`
+}
+
+// Firewall evaluates queries against an ordered list of allow/deny rules,
+// the first rule that matches decides the outcome.
+type Firewall struct {
+	config   *FirewallConfig
+	rules    []*FirewallRule
+	redactor *Redactor
+}
+
+type FirewallRule struct {
+	config     *FirewallRuleConfig
+	users      map[string]bool
+	databases  map[string]bool
+	statements map[string]bool
+	tables     map[string]bool
+	digests    map[string]bool
+	pattern    *regexp.Regexp
+}
+
+// the parts of a query that firewall rules are matched against
+type FirewallRequest struct {
+	User     string
+	Database string
+	Query    string
+}
+
+func toSet(items []string, upper bool) map[string]bool {
+	if len(items) == 0 {
+		return nil
+	}
+	set := make(map[string]bool, len(items))
+	for _, item := range items {
+		item = strings.TrimSpace(item)
+		if upper {
+			item = strings.ToUpper(item)
+		} else {
+			item = strings.ToLower(item)
+		}
+		set[item] = true
+	}
+	return set
+}
+
+func NewFirewall(config *FirewallConfig, redactor *Redactor) (*Firewall, error) {
+	fw := &Firewall{
+		config:   config,
+		rules:    make([]*FirewallRule, 0, len(config.Rules)),
+		redactor: redactor,
+	}
+
+	switch config.DefaultAction {
+	case "":
+		config.DefaultAction = FirewallActionAllow
+	case FirewallActionAllow, FirewallActionDeny:
+	default:
+		return nil, fmt.Errorf("firewall: invalid default action: %s", config.DefaultAction)
+	}
+	if config.ErrorCode == 0 {
+		config.ErrorCode = mysql.ER_SPECIFIC_ACCESS_DENIED_ERROR
+	}
+	if config.ErrorMessage == "" {
+		config.ErrorMessage = "Statement blocked by dbinsight firewall"
+	}
+
+	for i := range config.Rules {
+		ruleConfig := &config.Rules[i]
+		if ruleConfig.Action != FirewallActionAllow && ruleConfig.Action != FirewallActionDeny {
+			return nil, fmt.Errorf("firewall: rule %d (%s): invalid action: %s", i, ruleConfig.Name, ruleConfig.Action)
+		}
+
+		rule := &FirewallRule{
+			config:     ruleConfig,
+			databases:  toSet(ruleConfig.Databases, false),
+			statements: toSet(ruleConfig.Statements, true),
+			tables:     toSet(ruleConfig.Tables, false),
+			digests:    toSet(ruleConfig.Digests, false),
+		}
+		// user names are case sensitive in MySQL
+		if len(ruleConfig.Users) > 0 {
+			rule.users = make(map[string]bool, len(ruleConfig.Users))
+			for _, user := range ruleConfig.Users {
+				rule.users[user] = true
+			}
+		}
+		if ruleConfig.Pattern != "" {
+			re, err := regexp.Compile(ruleConfig.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("firewall: rule %d (%s): invalid pattern: %w", i, ruleConfig.Name, err)
+			}
+			rule.pattern = re
+		}
+		fw.rules = append(fw.rules, rule)
+	}
+
+	return fw, nil
+}
+
+// Check evaluates every statement in the query and returns a MySQL error
+// for the first statement that is denied, or nil if the query may run.
+func (fw *Firewall) Check(req *FirewallRequest) error {
+	if fw == nil || !fw.config.Enabled {
+		return nil
+	}
+
+	for _, stmt := range splitAndProcessStatements(req.Query, "8.0.33") {
+		tokens := Tokenize(stmt)
+		if len(tokens) == 0 {
+			continue
+		}
+		cmd, err := parseStatement(tokens)
+		if err != nil {
+			continue // the caller reports parse errors
+		}
+
+		rule := fw.match(req, stmt, cmd, tokens)
+
+		action := fw.config.DefaultAction
+		name := "default"
+		if rule != nil {
+			action = rule.config.Action
+			name = rule.config.Name
+		}
+		if action == FirewallActionAllow {
+			continue
+		}
+
+		logFor("firewall").Warn("rule denied statement", "rule", name, "command", commandName(cmd), "user", req.User, "database", req.Database, "query", fw.redactor.Query(stmt))
+
+		code := fw.config.ErrorCode
+		message := fw.config.ErrorMessage
+		if rule != nil && rule.config.ErrorCode != 0 {
+			code = rule.config.ErrorCode
+		}
+		if rule != nil && rule.config.ErrorMessage != "" {
+			message = rule.config.ErrorMessage
+		}
+		return mysql.NewError(code, message)
+	}
+
+	return nil
+}
+
+func (fw *Firewall) match(req *FirewallRequest, stmt string, cmd int, tokens []string) *FirewallRule {
+	var tables []string
+	var digest string
+
+	for _, rule := range fw.rules {
+		if rule.users != nil && !rule.users[req.User] {
+			continue
+		}
+		if rule.databases != nil && !rule.databases[strings.ToLower(req.Database)] {
+			continue
+		}
+		if rule.statements != nil && !rule.statements[commandName(cmd)] {
+			continue
+		}
+		if rule.config.WithoutWhere && hasWhereClause(stmt) {
+			continue
+		}
+		if rule.tables != nil {
+			if tables == nil {
+				tables = extractTables(tokens)
+			}
+			if !rule.matchTables(req.Database, tables) {
+				continue
+			}
+		}
+		if rule.digests != nil {
+			if digest == "" {
+				digest = QueryDigest(stmt)
+			}
+			if !rule.digests[digest] {
+				continue
+			}
+		}
+		if rule.pattern != nil && !rule.pattern.MatchString(stmt) {
+			continue
+		}
+		return rule
+	}
+
+	return nil
+}
+
+func (rule *FirewallRule) matchTables(database string, tables []string) bool {
+	for _, table := range tables {
+		table = strings.ToLower(table)
+		if rule.tables[table] {
+			return true
+		}
+		// unqualified tables belong to the current database
+		if !strings.Contains(table, ".") && database != "" && rule.tables[strings.ToLower(database)+"."+table] {
+			return true
+		}
+		// a qualified reference also matches a rule on the bare table name
+		if idx := strings.LastIndex(table, "."); idx >= 0 && rule.tables[table[idx+1:]] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,117 @@
+package main
+
+import "testing"
+
+func TestHasWhereClause(t *testing.T) {
+	tests := []struct {
+		stmt string
+		want bool
+	}{
+		{"DELETE FROM t WHERE id = 1", true},
+		{"delete from t where id = 1", true},
+		{"DELETE FROM t", false},
+		{"UPDATE t SET a = 1 WHERE (id = 1)", true},
+		{"UPDATE t SET a = (SELECT b FROM u WHERE u.id = 1)", false},
+		{"DELETE FROM t WHERE id IN (SELECT id FROM u WHERE u.x = 1)", true},
+		{"DELETE FROM t WHERE (id) = 1", true},
+
+		// comments
+		{"DELETE FROM t /* where */", false},
+		{"DELETE FROM t # where\n", false},
+		{"DELETE FROM t -- where", false},
+		{"DELETE FROM t /*!99999 WHERE 1 */", false},
+		{"DELETE FROM t /*!50000 WHERE id = 1 */", true},
+		{"DELETE FROM t /*! WHERE id = 1 */", true},
+		{"DELETE FROM t /* where */ WHERE id = 1", true},
+
+		// string literals and identifiers
+		{"UPDATE t SET note = 'where'", false},
+		{`UPDATE t SET note = "where"`, false},
+		{"UPDATE t SET note = 'it''s where'", false},
+		{`UPDATE t SET note = 'it\'s where'`, false},
+		{"UPDATE t SET `where` = 1", false},
+		{"UPDATE t SET note = 'x' WHERE id = 1", true},
+		{"UPDATE t SET somewhere = 1", false},
+	}
+
+	for _, test := range tests {
+		if got := hasWhereClause(test.stmt); got != test.want {
+			t.Errorf("hasWhereClause(%q) = %v, want %v", test.stmt, got, test.want)
+		}
+	}
+}
+
+func TestFirewallWithoutWhere(t *testing.T) {
+	fw, err := NewFirewall(&FirewallConfig{
+		Enabled: true,
+		Rules: []FirewallRuleConfig{{
+			Name:         "no-unbounded-delete",
+			Action:       FirewallActionDeny,
+			Statements:   []string{"DELETE", "UPDATE"},
+			WithoutWhere: true,
+		}},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query   string
+		blocked bool
+	}{
+		{"DELETE FROM t WHERE id = 1", false},
+		{"DELETE FROM t", true},
+		{"DELETE FROM t /* where */", true},
+		{"DELETE FROM t -- where", true},
+		{"DELETE FROM t /*!99999 WHERE 1 */", true},
+		{"UPDATE t SET note = 'where'", true},
+		{"UPDATE t SET a = (SELECT b FROM u WHERE u.id = 1)", true},
+		{"SELECT * FROM t", false},
+		{"SELECT 1; DELETE FROM t", true},
+	}
+
+	for _, test := range tests {
+		err := fw.Check(&FirewallRequest{User: "app", Query: test.query})
+		if blocked := err != nil; blocked != test.blocked {
+			t.Errorf("Check(%q) = %v, want blocked %v", test.query, err, test.blocked)
+		}
+	}
+}
+
+func TestFirewallTenantDatabases(t *testing.T) {
+	fw, err := NewFirewall(&FirewallConfig{
+		Enabled: true,
+		Rules: []FirewallRuleConfig{
+			{Name: "no-user-deletes", Action: FirewallActionDeny, Statements: []string{"DELETE"}, Tables: []string{"app.users"}},
+			{Name: "no-drops-in-app", Action: FirewallActionDeny, Statements: []string{"DROP"}, Databases: []string{"app"}},
+		},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tenants, err := NewTenants(&TenantConfig{
+		Enabled:   true,
+		Databases: []string{"app"},
+		Template:  "{database}_{tenant}",
+		Users:     []TenantUserConfig{{User: "bob", Tenant: "t1"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// rules name the databases the client uses, not the tenant's backend ones
+	ph := &ProxyHandler{
+		p:            &Proxy{config: &Config{}, firewall: fw, tenants: tenants},
+		user:         "bob",
+		databaseName: tenants.MapDatabase("bob", "app"),
+	}
+	for _, query := range []string{
+		"DELETE FROM app.users WHERE id = 1",
+		"DELETE FROM users WHERE id = 1",
+		"DROP TABLE logs",
+	} {
+		if _, err := ph.ExecuteQuery(query); err == nil {
+			t.Errorf("ExecuteQuery(%q) was not blocked", query)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+)
+
+var (
+	showStatusRe    = regexp.MustCompile(`(?is)^\s*show\s+dbinsight\s+status\s*;?\s*$`)
+	showCacheRe     = regexp.MustCompile(`(?is)^\s*show\s+dbinsight\s+cache\s*;?\s*$`)
+	showMirrorRe    = regexp.MustCompile(`(?is)^\s*show\s+dbinsight\s+mirror\s*;?\s*$`)
+	showConnsRe     = regexp.MustCompile(`(?is)^\s*show\s+dbinsight\s+connections\s*;?\s*$`)
+	showRouteRe     = regexp.MustCompile(`(?is)^\s*show\s+dbinsight\s+route\s+for\s+(.+)$`)
+	selectBackendRe = regexp.MustCompile(`(?is)^\s*select\s+dbinsight_backend\s*\(\s*\)\s*;?\s*$`)
+	showDBInsightRe = regexp.MustCompile(`(?is)^\s*show\s+dbinsight\b`)
+)
+
+// handleIntrospectionQuery answers SHOW DBINSIGHT STATUS, SHOW DBINSIGHT
+// CACHE, SHOW DBINSIGHT MIRROR, SHOW DBINSIGHT CONNECTIONS, SHOW DBINSIGHT
+// ROUTE FOR <query> and SELECT dbinsight_backend() locally. The boolean
+// result is false when the query is not an introspection statement.
+func (ph *ProxyHandler) handleIntrospectionQuery(query string) (*mysql.Result, bool, error) {
+	switch {
+	case showStatusRe.MatchString(query):
+		res, err := ph.showStatus()
+		return res, true, err
+	case showCacheRe.MatchString(query):
+		res, err := ph.showCache()
+		return res, true, err
+	case showMirrorRe.MatchString(query):
+		res, err := ph.showMirror()
+		return res, true, err
+	case showConnsRe.MatchString(query):
+		res, err := ph.showConnections()
+		return res, true, err
+	case showRouteRe.MatchString(query):
+		match := showRouteRe.FindStringSubmatch(query)
+		res, err := ph.showRoute(match[1])
+		return res, true, err
+	case selectBackendRe.MatchString(query):
+		res, err := buildResult([]string{"dbinsight_backend()"}, [][]interface{}{{ph.backendAddress()}})
+		return res, true, err
+	case showDBInsightRe.MatchString(query):
+		return nil, true, mysql.NewError(mysql.ER_PARSE_ERROR, "Unknown SHOW DBINSIGHT statement, expected STATUS, CACHE, MIRROR, CONNECTIONS or ROUTE FOR <query>")
+	}
+
+	return nil, false, nil
+}
+
+func buildResult(names []string, values [][]interface{}) (*mysql.Result, error) {
+	rs, err := mysql.BuildSimpleTextResultset(names, values)
+	if err != nil {
+		return nil, err
+	}
+	return mysql.NewResult(rs), nil
+}
+
+// backendAddress returns the backend that served the last statement of the
+// session, or the backend the next statement would use if nothing ran yet
+func (ph *ProxyHandler) backendAddress() string {
+	if ph.lastBackend != "" {
+		return ph.lastBackend
+	}
+	if ph.current_conn != nil {
+		return ph.current_conn.RemoteAddr().String()
+	}
+	return "none"
+}
+
+func (ph *ProxyHandler) showStatus() (*mysql.Result, error) {
+	readLag := "unknown"
+	if lag, ok := ph.readServer.ReplicationLag(); ok {
+		readLag = fmt.Sprintf("%d", lag)
+	}
+
+	ph.stmtMutex.Lock()
+	preparedStatements := len(ph.preparedStmts)
+	ph.stmtMutex.Unlock()
+
+	rows := [][]interface{}{
+		{"client_address", ph.remoteAddr},
+		{"proxy_user", ph.user},
+		{"backend_user", ph.backendUser},
+		{"database", ph.databaseName},
+		{"cluster", ph.cluster},
+		{"read_backend", ph.readServer.address},
+		{"write_backend", ph.writeServer.address},
+		{"last_backend", ph.backendAddress()},
+		{"read_backend_lag", readLag},
+		{"connection_locked", fmt.Sprintf("%t", ph.connectionLocked)},
+		{"in_transaction", fmt.Sprintf("%t", ph.inTransaction)},
+		{"prepared_statements", fmt.Sprintf("%d", preparedStatements)},
+		{"read_from", ph.session.ReadFrom},
+		{"query_tag", ph.session.QueryTag},
+		{"max_lag", fmt.Sprintf("%d", ph.session.MaxLag)},
+	}
+
+	return buildResult([]string{"Variable_name", "Value"}, rows)
+}
+
+func (ph *ProxyHandler) showCache() (*mysql.Result, error) {
+	stats, entries, memory := ph.p.cache.Stats()
+
+	rows := [][]interface{}{
+		{"enabled", fmt.Sprintf("%t", ph.p.config.Cache.Enabled)},
+		{"entries", fmt.Sprintf("%d", entries)},
+		{"memory_used", fmt.Sprintf("%d", memory)},
+		{"memory_limit", fmt.Sprintf("%d", ph.p.config.Cache.MaxMemory)},
+		{"hits", fmt.Sprintf("%d", stats.Hits)},
+		{"misses", fmt.Sprintf("%d", stats.Misses)},
+		{"stores", fmt.Sprintf("%d", stats.Stores)},
+		{"evictions", fmt.Sprintf("%d", stats.Evictions)},
+		{"expirations", fmt.Sprintf("%d", stats.Expirations)},
+		{"invalidations", fmt.Sprintf("%d", stats.Invalidations)},
+	}
+
+	return buildResult([]string{"Variable_name", "Value"}, rows)
+}
+
+func (ph *ProxyHandler) showMirror() (*mysql.Result, error) {
+	stats := ph.p.mirror.Stats()
+
+	rows := [][]interface{}{
+		{"enabled", fmt.Sprintf("%t", ph.p.config.Mirror.Enabled)},
+		{"shadow", fmt.Sprintf("%s:%d", ph.p.config.Mirror.Host, ph.p.config.Mirror.Port)},
+		{"percent", fmt.Sprintf("%g", ph.p.config.Mirror.Percent)},
+		{"writes", fmt.Sprintf("%t", ph.p.config.Mirror.Writes)},
+		{"mirrored", fmt.Sprintf("%d", stats.Mirrored.Load())},
+		{"dropped", fmt.Sprintf("%d", stats.Dropped.Load())},
+		{"matched", fmt.Sprintf("%d", stats.Matched.Load())},
+		{"result_mismatches", fmt.Sprintf("%d", stats.Mismatched.Load())},
+		{"error_mismatches", fmt.Sprintf("%d", stats.Errors.Load())},
+		{"slow", fmt.Sprintf("%d", stats.Slow.Load())},
+		{"failed", fmt.Sprintf("%d", stats.Failed.Load())},
+	}
+
+	return buildResult([]string{"Variable_name", "Value"}, rows)
+}
+
+// showRoute explains where each statement of the query would be routed
+// without executing it
+func (ph *ProxyHandler) showRoute(query string) (*mysql.Result, error) {
+	query, hints, err := extractQueryHints(query)
+	if err != nil {
+		return nil, mysql.NewError(mysql.ER_UNKNOWN_ERROR, err.Error())
+	}
+	query = ph.rewriteQuery(query)
+	query = ph.p.tenants.RewriteQuery(ph.user, query)
+
+	// ExecuteQuery has usually stripped the hints already and recorded them
+	// for this statement
+	if hints == nil {
+		hints = ph.hints
+	}
+
+	savedHints := ph.hints
+	ph.hints = hints
+	defer func() { ph.hints = savedHints }()
+
+	rows := make([][]interface{}, 0)
+	for _, stmt := range splitAndProcessStatements(query, "8.0.33") {
+		tokens := Tokenize(stmt)
+		if len(tokens) == 0 {
+			continue
+		}
+		cmd, err := parseStatement(tokens)
+		if err != nil {
+			return nil, mysql.NewError(mysql.ER_PARSE_ERROR, err.Error())
+		}
+
+		decision := ph.routeStatement(cmd)
+		if isProxyStatement(stmt) {
+			decision = &RouteDecision{Target: "proxy", Reason: "answered by dbinsight"}
+		}
+
+		cluster := ph.cluster
+		switch {
+		case decision.Target == "proxy":
+			cluster = ""
+		case cmd == Use:
+			database, err := extractDatabaseName(stmt)
+			if err == nil {
+				cluster = ph.p.clusters.ForDatabase(database)
+			}
+		default:
+			shardRoute, err := ph.p.shards.Route(ph.databaseName, stmt)
+			if err != nil {
+				return nil, err
+			}
+			if shardRoute != nil {
+				cluster = strings.Join(shardRoute.Clusters, ", ")
+				if shardRoute.Keyed {
+					decision.Reason += fmt.Sprintf(", shard key %s of %s", shardRoute.Table.key, shardRoute.Table.name)
+				} else {
+					decision.Reason += fmt.Sprintf(", no shard key for %s (unkeyed policy: %s)", shardRoute.Table.name, ph.p.config.Sharding.Unkeyed)
+				}
+				break
+			}
+
+			route, err := ph.p.clusters.ForQuery(ph.databaseName, stmt)
+			if err != nil {
+				return nil, err
+			}
+			if route != nil && route.Cluster != ph.cluster {
+				cluster = route.Cluster
+				decision.Reason += fmt.Sprintf(", tables %s are in cluster %s", strings.Join(route.Tables, ", "), route.Cluster)
+			}
+		}
+
+		backend := ph.writeServer.address
+		switch decision.Target {
+		case "proxy":
+			backend = "dbinsight"
+		case "both":
+			backend = ph.readServer.address + ", " + ph.writeServer.address
+		case RouteReplica:
+			backend = ph.readServer.address
+		case RouteReplicaGroup:
+			backend = "group " + decision.Group
+		}
+
+		if cluster != "" && cluster != ph.cluster {
+			backend = "cluster " + cluster
+		}
+
+		rows = append(rows, []interface{}{stmt, commandName(cmd), cluster, decision.Target, backend, decision.Reason})
+	}
+
+	if len(rows) == 0 {
+		return nil, mysql.NewError(mysql.ER_EMPTY_QUERY, "Query was empty")
+	}
+
+	return buildResult([]string{"Statement", "Type", "Cluster", "Target", "Backend", "Reason"}, rows)
+}
+
+// isProxyStatement reports whether the statement is answered by the proxy itself
+func isProxyStatement(stmt string) bool {
+	return setSessionVariableRe.MatchString(stmt) ||
+		selectSessionVariableRe.MatchString(stmt) ||
+		showDBInsightRe.MatchString(stmt) ||
+		selectBackendRe.MatchString(stmt) ||
+		killStatementRe.MatchString(stmt) ||
+		selectConnectionIDRe.MatchString(stmt)
+}
+
+// routeStatement mirrors the routing done by ExecuteQuery for a statement type
+func (ph *ProxyHandler) routeStatement(cmd int) *RouteDecision {
+	switch cmd {
+	case Use:
+		return &RouteDecision{Target: "both", Reason: "USE is sent to the read and write connections"}
+	case Select, Show, Desc, Describe:
+		return ph.routeRead()
+	case Truncate, Rename, Grant, Revoke, Set:
+		reason := "statement changes session state"
+		if !ph.connectionLocked {
+			reason += ", locks the session to the primary"
+		}
+		return &RouteDecision{Target: RoutePrimary, Reason: reason}
+	case Begin, Commit, Rollback:
+		return &RouteDecision{Target: RoutePrimary, Reason: "transaction control"}
+	default:
+		return &RouteDecision{Target: RoutePrimary, Reason: strings.ToLower(commandName(cmd)) + " is a write statement"}
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+)
+
+type KillConfig struct {
+	AdminUsers []string `yaml:"admin_users"` // proxy users that may kill any session, everybody else only kills their own
+}
+
+// Killer decides who may kill which session. Clients only know the
+// connection ids the proxy hands out in the handshake, KILL translates them
+// into KILLs of the backend threads the session's connections run on.
+type Killer struct {
+	config *KillConfig
+	admins map[string]bool
+}
+
+func NewKiller(config *KillConfig) *Killer {
+	k := &Killer{
+		config: config,
+		admins: make(map[string]bool),
+	}
+	for _, user := range config.AdminUsers {
+		k.admins[user] = true
+	}
+	return k
+}
+
+// Allowed reports whether user may kill a session of owner
+func (k *Killer) Allowed(user string, owner string) bool {
+	return user == owner || k.admins[user]
+}
+
+// BackendThread is a backend connection's thread id on its server
+type BackendThread struct {
+	Server *BackendServer
+	ID     uint32
+}
+
+// SessionThreads are the backend threads of a session's read and write
+// connections. Statements on connections borrowed for a single statement
+// (replica groups, other clusters, shards) are not tracked.
+type SessionThreads struct {
+	Read  BackendThread
+	Write BackendThread
+}
+
+var (
+	killRe               = regexp.MustCompile(`(?is)^\s*kill\s+(?:(query|connection)\s+)?(\d+)\s*;?\s*$`)
+	killStatementRe      = regexp.MustCompile(`(?is)^\s*kill\b`)
+	selectConnectionIDRe = regexp.MustCompile(`(?is)^\s*select\s+connection_id\s*\(\s*\)\s*;?\s*$`)
+)
+
+// trackThreads records the backend threads of the session's read and write
+// connections, it is called whenever they change
+func (ph *ProxyHandler) trackThreads() {
+	if ph.read_conn == nil || ph.write_conn == nil {
+		ph.threads.Store(nil)
+		return
+	}
+	ph.threads.Store(&SessionThreads{
+		Read:  BackendThread{Server: ph.readServer, ID: ph.read_conn.GetConnectionID()},
+		Write: BackendThread{Server: ph.writeServer, ID: ph.write_conn.GetConnectionID()},
+	})
+}
+
+// handleKillQuery answers KILL [QUERY | CONNECTION] <id> and SELECT
+// CONNECTION_ID(), the ids are the proxy's connection ids and not the
+// backend thread ids. The boolean result is false for other statements.
+func (ph *ProxyHandler) handleKillQuery(query string) (*mysql.Result, bool, error) {
+	switch {
+	case killRe.MatchString(query):
+		match := killRe.FindStringSubmatch(query)
+		id, err := strconv.ParseUint(match[2], 10, 32)
+		if err != nil {
+			return nil, true, mysql.NewDefaultError(mysql.ER_NO_SUCH_THREAD, match[2])
+		}
+		if err := ph.kill(uint32(id), strings.EqualFold(match[1], "query")); err != nil {
+			return nil, true, err
+		}
+		return mysql.NewResult(nil), true, nil
+	case killStatementRe.MatchString(query):
+		return nil, true, mysql.NewError(mysql.ER_PARSE_ERROR, "KILL expects KILL [QUERY | CONNECTION] <connection id>")
+	case selectConnectionIDRe.MatchString(query):
+		res, err := buildResult([]string{"CONNECTION_ID()"}, [][]interface{}{{ph.connectionID}})
+		return res, true, err
+	}
+
+	return nil, false, nil
+}
+
+// handleProcessKill handles the deprecated COM_PROCESS_KILL command
+func (ph *ProxyHandler) handleProcessKill(data []byte) error {
+	if len(data) < 4 {
+		return mysql.NewError(mysql.ER_MALFORMED_PACKET, "malformed COM_PROCESS_KILL packet")
+	}
+	return ph.kill(binary.LittleEndian.Uint32(data), false)
+}
+
+// kill interrupts the statement the session with the given connection id
+// is running, or ends the session when query is false
+func (ph *ProxyHandler) kill(id uint32, query bool) error {
+	target := ph.p.session(id)
+	if target == nil {
+		return mysql.NewDefaultError(mysql.ER_NO_SUCH_THREAD, id)
+	}
+	if !ph.p.killer.Allowed(ph.user, target.user) {
+		return mysql.NewDefaultError(mysql.ER_KILL_DENIED_ERROR, id)
+	}
+	threads := target.threads.Load()
+	if threads == nil {
+		// still connecting or already gone
+		return mysql.NewDefaultError(mysql.ER_NO_SUCH_THREAD, id)
+	}
+
+	statement := "KILL CONNECTION %d"
+	if query {
+		statement = "KILL QUERY %d"
+	} else {
+		// the connections are dead once killed, keep them out of the pools
+		target.killed.Store(true)
+	}
+
+	var killErr error
+	for _, thread := range []BackendThread{threads.Read, threads.Write} {
+		if err := target.killThread(thread, fmt.Sprintf(statement, thread.ID)); err != nil {
+			killErr = err
+		}
+	}
+
+	ph.logger().Info("killed session", "target", id, "target_user", target.user, "query", query, "err", killErr)
+
+	if !query {
+		target.client.Close()
+	}
+	return killErr
+}
+
+// killThread runs a KILL for one of the session's backend threads on a
+// connection of the same backend user, which is allowed to kill its own
+// threads
+func (ph *ProxyHandler) killThread(thread BackendThread, statement string) error {
+	key := NewUserKey(thread.Server.address, ph.backendUser, ph.backendPassword)
+	conn, err := thread.Server.GetNextConn(key)
+	if err != nil {
+		return err
+	}
+	defer thread.Server.PutConn(key, conn)
+
+	_, err = conn.Execute(statement)
+	if myErr, ok := err.(*mysql.MyError); ok && myErr.Code == mysql.ER_NO_SUCH_THREAD {
+		// the thread ended in the meantime
+		return nil
+	}
+	return err
+}
+
+// session returns the connected client with the given connection id
+func (p *Proxy) session(id uint32) *ProxyHandler {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, ph := range p.clients {
+		if ph.connectionID == id {
+			return ph
+		}
+	}
+	return nil
+}
+
+// showConnections lists the sessions with the backend threads they run on,
+// only the user's own sessions unless the user may kill any session
+func (ph *ProxyHandler) showConnections() (*mysql.Result, error) {
+	ph.p.mu.RLock()
+	clients := make([]*ProxyHandler, len(ph.p.clients))
+	copy(clients, ph.p.clients)
+	ph.p.mu.RUnlock()
+
+	rows := make([][]interface{}, 0, len(clients))
+	for _, s := range clients {
+		if !ph.p.killer.Allowed(ph.user, s.user) {
+			continue
+		}
+		threads := s.threads.Load()
+		if threads == nil {
+			continue
+		}
+		rows = append(rows, []interface{}{
+			s.connectionID,
+			s.user,
+			s.remoteAddr,
+			threads.Read.Server.address,
+			threads.Read.ID,
+			threads.Write.Server.address,
+			threads.Write.ID,
+		})
+	}
+
+	return buildResult([]string{"Id", "User", "Client", "Read_backend", "Read_thread_id", "Write_backend", "Write_thread_id"}, rows)
+}
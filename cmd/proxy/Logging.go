@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+type LoggingConfig struct {
+	Format   string            `yaml:"format"`    // logfmt (default) or json
+	Level    string            `yaml:"level"`     // debug, info (default), warn or error
+	Levels   map[string]string `yaml:"levels"`    // subsystem -> level, overrides level
+	Output   string            `yaml:"output"`    // stderr (default), stdout or file
+	Path     string            `yaml:"path"`      // file: log file
+	MaxSize  int64             `yaml:"max_size"`  // file: bytes before the file is rotated, 0 never rotates
+	MaxFiles int               `yaml:"max_files"` // file: rotated files kept, 0 keeps everything
+}
+
+// Logging hands out structured loggers per subsystem (proxy, session,
+// firewall, cache, ...). Levels are kept per subsystem and can be changed
+// while the proxy runs through /debug/logging on the debug server.
+type Logging struct {
+	config  *LoggingConfig
+	handler slog.Handler
+	file    *rotatingFile
+
+	mu      sync.RWMutex
+	level   slog.Level            // subsystems without a level of their own
+	levels  map[string]slog.Level // per subsystem levels
+	loggers sync.Map              // subsystem -> *slog.Logger
+}
+
+// logs is what logFor hands out loggers from, logfmt on stderr until
+// SetupLogging replaces it with the configured one
+var logs = &Logging{
+	config:  &LoggingConfig{},
+	handler: slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug}),
+	level:   slog.LevelInfo,
+	levels:  make(map[string]slog.Level),
+}
+
+func NewLogging(config *LoggingConfig) (*Logging, error) {
+	if config.Format == "" {
+		config.Format = "logfmt"
+	}
+	if config.Level == "" {
+		config.Level = "info"
+	}
+	if config.Output == "" {
+		config.Output = "stderr"
+	}
+	if config.Path == "" {
+		config.Path = "data/proxy.log"
+	}
+
+	l := &Logging{
+		config: config,
+		levels: make(map[string]slog.Level),
+	}
+	if err := l.level.UnmarshalText([]byte(config.Level)); err != nil {
+		return nil, fmt.Errorf("logging: %w", err)
+	}
+	for subsystem, text := range config.Levels {
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(text)); err != nil {
+			return nil, fmt.Errorf("logging: %s: %w", subsystem, err)
+		}
+		l.levels[subsystem] = level
+	}
+
+	var out io.Writer
+	switch config.Output {
+	case "stderr":
+		out = os.Stderr
+	case "stdout":
+		out = os.Stdout
+	case "file":
+		file, err := openRotatingFile(config.Path, 0640, config.MaxSize, config.MaxFiles, false)
+		if err != nil {
+			return nil, fmt.Errorf("logging: %w", err)
+		}
+		l.file = file
+		out = file
+	default:
+		return nil, fmt.Errorf("logging: unknown output: %s", config.Output)
+	}
+
+	// the subsystem handlers decide what is logged
+	options := &slog.HandlerOptions{Level: slog.LevelDebug}
+	switch config.Format {
+	case "logfmt":
+		l.handler = slog.NewTextHandler(out, options)
+	case "json":
+		l.handler = slog.NewJSONHandler(out, options)
+	default:
+		return nil, fmt.Errorf("logging: unknown format: %s", config.Format)
+	}
+
+	return l, nil
+}
+
+// SetupLogging makes the configured logging the one logFor and the standard
+// log package write to
+func SetupLogging(config *LoggingConfig) error {
+	l, err := NewLogging(config)
+	if err != nil {
+		return err
+	}
+	logs = l
+	slog.SetDefault(l.For("proxy"))
+	return nil
+}
+
+// logFor returns the logger of a subsystem
+func logFor(subsystem string) *slog.Logger {
+	return logs.For(subsystem)
+}
+
+func (l *Logging) For(subsystem string) *slog.Logger {
+	if logger, ok := l.loggers.Load(subsystem); ok {
+		return logger.(*slog.Logger)
+	}
+	handler := &subsystemHandler{
+		Handler:   l.handler.WithAttrs([]slog.Attr{slog.String("subsystem", subsystem)}),
+		logging:   l,
+		subsystem: subsystem,
+	}
+	logger, _ := l.loggers.LoadOrStore(subsystem, slog.New(handler))
+	return logger.(*slog.Logger)
+}
+
+// Level returns the level a subsystem logs at
+func (l *Logging) Level(subsystem string) slog.Level {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if level, ok := l.levels[subsystem]; ok {
+		return level
+	}
+	return l.level
+}
+
+// SetLevel changes the level of a subsystem, or of every subsystem without
+// a level of its own when subsystem is empty. "default" drops the
+// subsystem's own level.
+func (l *Logging) SetLevel(subsystem string, text string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if subsystem != "" && text == "default" {
+		delete(l.levels, subsystem)
+		return nil
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(text)); err != nil {
+		return err
+	}
+	if subsystem == "" {
+		l.level = level
+	} else {
+		l.levels[subsystem] = level
+	}
+	return nil
+}
+
+// ServeHTTP shows the levels on GET and changes one on POST, e.g.
+// curl -d subsystem=firewall -d level=debug localhost:6060/debug/logging
+func (l *Logging) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost, http.MethodPut:
+		if err := l.SetLevel(r.FormValue("subsystem"), r.FormValue("level")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		logFor("proxy").Info("log level changed", "subsystem", r.FormValue("subsystem"), "level", r.FormValue("level"))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	l.mu.RLock()
+	levels := make(map[string]string, len(l.levels))
+	for subsystem, level := range l.levels {
+		levels[subsystem] = level.String()
+	}
+	status := map[string]interface{}{
+		"level":  l.level.String(),
+		"levels": levels,
+	}
+	l.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// Close closes the log file
+func (l *Logging) Close() {
+	if l.file != nil {
+		l.file.Close()
+	}
+}
+
+// subsystemHandler applies the current level of its subsystem
+type subsystemHandler struct {
+	slog.Handler
+	logging   *Logging
+	subsystem string
+}
+
+func (h *subsystemHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.logging.Level(h.subsystem)
+}
+
+func (h *subsystemHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &subsystemHandler{Handler: h.Handler.WithAttrs(attrs), logging: h.logging, subsystem: h.subsystem}
+}
+
+func (h *subsystemHandler) WithGroup(name string) slog.Handler {
+	return &subsystemHandler{Handler: h.Handler.WithGroup(name), logging: h.logging, subsystem: h.subsystem}
+}
+
+// printfFor adapts a subsystem logger to the printf style logging functions
+// libraries take
+func printfFor(subsystem string) func(format string, args ...interface{}) {
+	return func(format string, args ...interface{}) {
+		logFor(subsystem).Info(fmt.Sprintf(format, args...))
+	}
+}
+
+// rotatingFile is a log file that is renamed with a timestamp suffix once it
+// reaches maxSize, keeping the newest maxFiles rotated files. Every Write is
+// one line, files are only rotated between lines. A buffered file is
+// written to disk on Flush and when it is rotated or closed.
+type rotatingFile struct {
+	path     string
+	perm     os.FileMode
+	maxSize  int64
+	maxFiles int
+	buffered bool
+
+	mu   sync.Mutex
+	file *os.File
+	buf  *bufio.Writer
+	size int64
+}
+
+func openRotatingFile(path string, perm os.FileMode, maxSize int64, maxFiles int, buffered bool) (*rotatingFile, error) {
+	f := &rotatingFile{
+		path:     path,
+		perm:     perm,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+		buffered: buffered,
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, f.perm)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	if f.buffered {
+		if f.buf == nil {
+			f.buf = bufio.NewWriter(file)
+		} else {
+			f.buf.Reset(file)
+		}
+	}
+	return nil
+}
+
+func (f *rotatingFile) rotate() error {
+	if f.buf != nil {
+		if err := f.buf.Flush(); err != nil {
+			return err
+		}
+	}
+	err := f.file.Close()
+	f.file = nil
+	if err != nil {
+		return err
+	}
+	rotated := fmt.Sprintf("%s.%s", f.path, time.Now().Format("20060102-150405.000"))
+	if err := os.Rename(f.path, rotated); err != nil {
+		return err
+	}
+
+	if f.maxFiles > 0 {
+		files, err := filepath.Glob(f.path + ".*")
+		if err == nil && len(files) > f.maxFiles {
+			sort.Strings(files)
+			for _, file := range files[:len(files)-f.maxFiles] {
+				os.Remove(file)
+			}
+		}
+	}
+
+	return f.open()
+}
+
+// Write writes one line, the slog handlers and the audit log write a line
+// per call
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			// keep writing to the same file, this may be the proxy log
+			fmt.Fprintf(os.Stderr, "failed to rotate %s: %v\n", f.path, err)
+			if f.file == nil {
+				if err := f.open(); err != nil {
+					return 0, err
+				}
+			}
+		}
+	}
+
+	var n int
+	var err error
+	if f.buf != nil {
+		n, err = f.buf.Write(p)
+	} else {
+		n, err = f.file.Write(p)
+	}
+	f.size += int64(n)
+	return n, err
+}
+
+// Flush writes buffered lines to the file
+func (f *rotatingFile) Flush() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil || f.buf == nil {
+		return nil
+	}
+	return f.buf.Flush()
+}
+
+// Close writes buffered lines to disk and closes the file
+func (f *rotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	var err error
+	if f.buf != nil {
+		err = f.buf.Flush()
+	}
+	if f.buffered {
+		err = errors.Join(err, f.file.Sync())
+	}
+	err = errors.Join(err, f.file.Close())
+	f.file = nil
+	return err
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+)
+
+const (
+	MaskNull    = "null"    // the value becomes NULL
+	MaskRedact  = "redact"  // the value becomes a fixed string
+	MaskPartial = "partial" // all but the first/last characters become mask_char
+	MaskHash    = "hash"    // salted sha256, equal values stay equal
+	MaskEmail   = "email"   // j***@example.com
+)
+
+type MaskingRuleConfig struct {
+	Name      string   `yaml:"name"`
+	Users     []string `yaml:"users"`      // proxy users the rule applies to
+	Roles     []string `yaml:"roles"`      // roles the rule applies to, empty users and roles match everyone
+	Columns   []string `yaml:"columns"`    // column or table.column
+	Action    string   `yaml:"action"`     // null, redact, partial, hash or email
+	Value     string   `yaml:"value"`      // redact: replacement, defaults to ****
+	ShowFirst int      `yaml:"show_first"` // partial: leading characters left visible
+	ShowLast  int      `yaml:"show_last"`  // partial: trailing characters left visible
+	MaskChar  string   `yaml:"mask_char"`  // partial and email, defaults to *
+}
+
+type MaskingConfig struct {
+	Enabled bool                `yaml:"enabled"`
+	Salt    string              `yaml:"salt"`  // mixed into hash masks
+	Roles   map[string][]string `yaml:"roles"` // role -> proxy users
+	Rules   []MaskingRuleConfig `yaml:"rules"`
+}
+
+type maskingRule struct {
+	name     string
+	users    map[string]bool
+	roles    map[string]bool
+	columns  map[string]bool // lower case column or table.column
+	action   string
+	value    string
+	first    int
+	last     int
+	maskChar string
+}
+
+// Masking rewrites column values in result sets according to per user and
+// per role rules, e.g. only the last four digits of a card number or no
+// email addresses for reporting users. Columns are matched by their name in
+// the table, so aliasing a column does not get around a rule, but values
+// computed from a masked column in an expression are not masked.
+type Masking struct {
+	config *MaskingConfig
+	rules  []*maskingRule
+	roles  map[string][]string // proxy user -> roles
+}
+
+func NewMasking(config *MaskingConfig) (*Masking, error) {
+	m := &Masking{
+		config: config,
+		roles:  make(map[string][]string),
+	}
+
+	for role, users := range config.Roles {
+		for _, user := range users {
+			m.roles[user] = append(m.roles[user], role)
+		}
+	}
+
+	for i, ruleConfig := range config.Rules {
+		name := ruleConfig.Name
+		if name == "" {
+			name = fmt.Sprintf("rule %d", i+1)
+		}
+
+		rule := &maskingRule{
+			name:     name,
+			columns:  make(map[string]bool),
+			action:   ruleConfig.Action,
+			value:    ruleConfig.Value,
+			first:    ruleConfig.ShowFirst,
+			last:     ruleConfig.ShowLast,
+			maskChar: ruleConfig.MaskChar,
+		}
+
+		switch rule.action {
+		case MaskNull, MaskHash, MaskEmail:
+		case MaskRedact:
+			if rule.value == "" {
+				rule.value = "****"
+			}
+		case MaskPartial:
+			if rule.first < 0 || rule.last < 0 {
+				return nil, fmt.Errorf("masking: %s: show_first and show_last cannot be negative", name)
+			}
+		default:
+			return nil, fmt.Errorf("masking: %s: unknown action: %s", name, rule.action)
+		}
+		if rule.maskChar == "" {
+			rule.maskChar = "*"
+		}
+
+		if len(ruleConfig.Columns) == 0 {
+			return nil, fmt.Errorf("masking: %s: no columns", name)
+		}
+		for _, column := range ruleConfig.Columns {
+			rule.columns[strings.ToLower(unquoteIdentifier(column))] = true
+		}
+
+		if len(ruleConfig.Users) > 0 {
+			rule.users = make(map[string]bool, len(ruleConfig.Users))
+			for _, user := range ruleConfig.Users {
+				rule.users[user] = true
+			}
+		}
+		if len(ruleConfig.Roles) > 0 {
+			rule.roles = make(map[string]bool, len(ruleConfig.Roles))
+			for _, role := range ruleConfig.Roles {
+				if _, ok := config.Roles[role]; !ok {
+					return nil, fmt.Errorf("masking: %s: unknown role: %s", name, role)
+				}
+				rule.roles[role] = true
+			}
+		}
+
+		m.rules = append(m.rules, rule)
+	}
+
+	return m, nil
+}
+
+// appliesTo reports whether the rule covers the user, directly or through
+// one of the user's roles
+func (rule *maskingRule) appliesTo(user string, roles []string) bool {
+	if rule.users == nil && rule.roles == nil {
+		return true
+	}
+	if rule.users[user] {
+		return true
+	}
+	for _, role := range roles {
+		if rule.roles[role] {
+			return true
+		}
+	}
+	return false
+}
+
+// matches reports whether the rule covers the result column
+func (rule *maskingRule) matches(field *mysql.Field) bool {
+	for _, name := range [][]byte{field.OrgName, field.Name} {
+		column := strings.ToLower(string(name))
+		if column == "" {
+			continue
+		}
+		if rule.columns[column] {
+			return true
+		}
+		for _, table := range [][]byte{field.OrgTable, field.Table} {
+			if len(table) > 0 && rule.columns[strings.ToLower(string(table))+"."+column] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// rulesFor returns the rule masking each column, nil when no column of the
+// result is masked for the user. The first matching rule wins.
+func (m *Masking) rulesFor(user string, fields []*mysql.Field) []*maskingRule {
+	roles := m.roles[user]
+
+	var masked []*maskingRule
+	for _, rule := range m.rules {
+		if !rule.appliesTo(user, roles) {
+			continue
+		}
+		for i, field := range fields {
+			if (masked == nil || masked[i] == nil) && rule.matches(field) {
+				if masked == nil {
+					masked = make([]*maskingRule, len(fields))
+				}
+				masked[i] = rule
+			}
+		}
+	}
+	return masked
+}
+
+// mask returns the masked value, nil for NULL
+func (m *Masking) mask(rule *maskingRule, value string) []byte {
+	switch rule.action {
+	case MaskNull:
+		return nil
+	case MaskRedact:
+		return []byte(rule.value)
+	case MaskHash:
+		sum := sha256.Sum256([]byte(m.config.Salt + value))
+		return []byte(hex.EncodeToString(sum[:]))
+	case MaskEmail:
+		local, domain, ok := strings.Cut(value, "@")
+		if !ok || local == "" {
+			return []byte(maskPartial(value, 0, 0, rule.maskChar))
+		}
+		return []byte(maskPartial(local, 1, 0, rule.maskChar) + "@" + domain)
+	}
+	return []byte(maskPartial(value, rule.first, rule.last, rule.maskChar))
+}
+
+// maskPartial replaces all but the first and last characters, everything
+// is masked when too few characters are left to hide
+func maskPartial(value string, first int, last int, maskChar string) string {
+	n := utf8.RuneCountInString(value)
+	if first+last >= n {
+		return strings.Repeat(maskChar, n)
+	}
+	runes := []rune(value)
+	return string(runes[:first]) + strings.Repeat(maskChar, n-first-last) + string(runes[n-last:])
+}
+
+// Apply returns the result with the masking rules for the user applied to
+// text or binary protocol rows. Results may be shared with other sessions
+// through the cache, so a copy is returned when anything is masked.
+func (m *Masking) Apply(user string, res *mysql.Result, text bool) (*mysql.Result, error) {
+	if m == nil || !m.config.Enabled || res == nil || res.Resultset == nil {
+		return res, nil
+	}
+
+	masked := m.rulesFor(user, res.Fields)
+	if masked == nil {
+		return res, nil
+	}
+
+	// masked values are sent as strings, or NULL, whatever the column type
+	fields := make([]*mysql.Field, len(res.Fields))
+	for i, field := range res.Fields {
+		fields[i] = field
+		if masked[i] == nil {
+			continue
+		}
+		copied := *field
+		copied.Data = nil // Dump() would send the cached packet otherwise
+		copied.Flag &^= mysql.NOT_NULL_FLAG
+		if masked[i].action != MaskNull && !isStringType(field.Type) {
+			copied.Type = mysql.MYSQL_TYPE_VAR_STRING
+			copied.Flag &^= mysql.UNSIGNED_FLAG | mysql.BINARY_FLAG
+			copied.Charset = uint16(mysql.DEFAULT_COLLATION_ID)
+			copied.Decimal = 0
+		}
+		if masked[i].action != MaskNull {
+			copied.ColumnLength = max(copied.ColumnLength, 255)
+		}
+		fields[i] = &copied
+	}
+
+	columns := make([]bool, len(fields))
+	for i, rule := range masked {
+		columns[i] = rule != nil
+	}
+	return rewriteResult(res, fields, columns, text, func(column int, value *mysql.FieldValue) []byte {
+		return m.mask(masked[column], string(fieldValueText(value)))
+	})
+}
+
+// fieldValueText returns the value as the text protocol sends it, String()
+// quotes strings
+func fieldValueText(value *mysql.FieldValue) []byte {
+	if value.Type == mysql.FieldValueTypeString {
+		return value.AsString()
+	}
+	return []byte(value.String())
+}
+
+// rewriteResult returns a copy of the result with fields as its column
+// metadata and the values of the given columns replaced by what rewrite
+// returns, nil for NULL. NULL values are left alone.
+func rewriteResult(res *mysql.Result, fields []*mysql.Field, columns []bool, text bool, rewrite func(column int, value *mysql.FieldValue) []byte) (*mysql.Result, error) {
+	rowDatas := make([]mysql.RowData, len(res.RowDatas))
+	values := make([][]mysql.FieldValue, len(res.RowDatas))
+	for r, row := range res.RowDatas {
+		parsed, err := row.Parse(res.Fields, !text, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		rewritten := make([][]byte, len(fields))
+		isNull := make([]bool, len(fields))
+		for i := range columns {
+			if !columns[i] {
+				continue
+			}
+			if parsed[i].Type == mysql.FieldValueTypeNull {
+				isNull[i] = true
+				continue
+			}
+			rewritten[i] = rewrite(i, &parsed[i])
+			isNull[i] = rewritten[i] == nil
+		}
+
+		if text {
+			rowDatas[r], err = rewriteTextRow(row, columns, rewritten, isNull)
+		} else {
+			rowDatas[r], err = rewriteBinaryRow(row, res.Fields, columns, rewritten, isNull)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		values[r], err = rowDatas[r].Parse(fields, !text, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	rs := &mysql.Resultset{
+		Fields:     fields,
+		FieldNames: make(map[string]int, len(fields)),
+		RowDatas:   rowDatas,
+		Values:     values,
+	}
+	for i, field := range fields {
+		rs.FieldNames[string(field.Name)] = i
+	}
+
+	result := *res
+	result.Resultset = rs
+	return &result, nil
+}
+
+func isStringType(t uint8) bool {
+	switch t {
+	case mysql.MYSQL_TYPE_VARCHAR, mysql.MYSQL_TYPE_VAR_STRING, mysql.MYSQL_TYPE_STRING,
+		mysql.MYSQL_TYPE_TINY_BLOB, mysql.MYSQL_TYPE_MEDIUM_BLOB, mysql.MYSQL_TYPE_LONG_BLOB,
+		mysql.MYSQL_TYPE_BLOB, mysql.MYSQL_TYPE_ENUM, mysql.MYSQL_TYPE_SET, mysql.MYSQL_TYPE_JSON:
+		return true
+	}
+	return false
+}
+
+// rewriteTextRow rebuilds a text protocol row with the given columns replaced
+func rewriteTextRow(row mysql.RowData, columns []bool, values [][]byte, isNull []bool) (mysql.RowData, error) {
+	out := make([]byte, 0, len(row))
+	pos := 0
+	for i := range columns {
+		_, _, n, err := mysql.LengthEncodedString(row[pos:])
+		if err != nil {
+			return nil, err
+		}
+		raw := row[pos : pos+n]
+		pos += n
+
+		switch {
+		case !columns[i]:
+			out = append(out, raw...)
+		case isNull[i]:
+			out = append(out, 0xfb)
+		default:
+			out = append(out, mysql.PutLengthEncodedString(values[i])...)
+		}
+	}
+	return out, nil
+}
+
+// binaryValueSize returns the number of bytes a non NULL value of the field
+// takes in a binary protocol row
+func binaryValueSize(field *mysql.Field, data []byte) (int, error) {
+	switch field.Type {
+	case mysql.MYSQL_TYPE_NULL:
+		return 0, nil
+	case mysql.MYSQL_TYPE_TINY:
+		return 1, nil
+	case mysql.MYSQL_TYPE_SHORT, mysql.MYSQL_TYPE_YEAR:
+		return 2, nil
+	case mysql.MYSQL_TYPE_INT24, mysql.MYSQL_TYPE_LONG, mysql.MYSQL_TYPE_FLOAT:
+		return 4, nil
+	case mysql.MYSQL_TYPE_LONGLONG, mysql.MYSQL_TYPE_DOUBLE:
+		return 8, nil
+	case mysql.MYSQL_TYPE_DATE, mysql.MYSQL_TYPE_NEWDATE, mysql.MYSQL_TYPE_TIMESTAMP,
+		mysql.MYSQL_TYPE_DATETIME, mysql.MYSQL_TYPE_TIME:
+		if len(data) == 0 {
+			return 0, mysql.ErrMalformPacket
+		}
+		return 1 + int(data[0]), nil
+	}
+	_, _, n, err := mysql.LengthEncodedString(data)
+	return n, err
+}
+
+// rewriteBinaryRow rebuilds a binary protocol row with the given columns
+// replaced, the NULL bitmap is offset by two bits in result rows
+func rewriteBinaryRow(row mysql.RowData, fields []*mysql.Field, columns []bool, values [][]byte, isNull []bool) (mysql.RowData, error) {
+	bitmapEnd := 1 + (len(fields)+7+2)>>3
+	if len(row) < bitmapEnd || row[0] != mysql.OK_HEADER {
+		return nil, mysql.ErrMalformPacket
+	}
+
+	bitmap := append([]byte(nil), row[1:bitmapEnd]...)
+	out := make([]byte, 0, len(row))
+
+	pos := bitmapEnd
+	for i, field := range fields {
+		idx, bit := (i+2)/8, byte(1)<<(uint(i+2)%8)
+		if bitmap[idx]&bit != 0 {
+			continue
+		}
+
+		n, err := binaryValueSize(field, row[pos:])
+		if err != nil {
+			return nil, err
+		}
+		if pos+n > len(row) {
+			return nil, mysql.ErrMalformPacket
+		}
+		raw := row[pos : pos+n]
+		pos += n
+
+		switch {
+		case !columns[i]:
+			out = append(out, raw...)
+		case isNull[i]:
+			bitmap[idx] |= bit
+		default:
+			out = append(out, mysql.PutLengthEncodedString(values[i])...)
+		}
+	}
+
+	return append(append([]byte{mysql.OK_HEADER}, bitmap...), out...), nil
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"os"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-mysql-org/go-mysql/client"
+	"github.com/go-mysql-org/go-mysql/mysql"
+)
+
+type MirrorConfig struct {
+	Enabled    bool    `yaml:"enabled"`
+	Host       string  `yaml:"host"` // shadow server
+	Port       int     `yaml:"port"`
+	User       string  `yaml:"user"` // defaults to the session's backend user
+	Password   string  `yaml:"password"`
+	Percent    float64 `yaml:"percent"`     // share of statements mirrored, of sessions when writes are, 0-100
+	Writes     bool    `yaml:"writes"`      // mirror writes as well as reads
+	Workers    int     `yaml:"workers"`     // concurrent shadow connections
+	QueueSize  int     `yaml:"queue_size"`  // statements waiting for the workers, more are dropped
+	SlowRatio  float64 `yaml:"slow_ratio"`  // report the shadow when it is this many times slower
+	SlowMinMs  float64 `yaml:"slow_min_ms"` // ignore latency differences below this
+	ReportFile string  `yaml:"report_file"` // JSON lines of divergences, the log when empty
+}
+
+// MirrorRequest is a statement the primary or a replica answered that is
+// replayed on the shadow
+type MirrorRequest struct {
+	Session  uint32 // proxy connection id, a session is replayed in order on one worker
+	User     string
+	Password string
+	Database string
+	Query    string
+	Write    bool
+	Result   *mysql.Result
+	Err      error
+	Latency  time.Duration
+	Backend  string // cache and coalesced results have no comparable latency
+}
+
+// MirrorDivergence is one line of the mirror report
+type MirrorDivergence struct {
+	Time           time.Time `json:"time"`
+	Kind           string    `json:"kind"` // result, error or latency
+	User           string    `json:"user"`
+	Database       string    `json:"database"`
+	Backend        string    `json:"backend"`
+	Digest         string    `json:"digest"`
+	Query          string    `json:"query"`
+	Checksum       string    `json:"checksum"`
+	ShadowChecksum string    `json:"shadow_checksum"`
+	Rows           int       `json:"rows"`
+	ShadowRows     int       `json:"shadow_rows"`
+	Error          string    `json:"error,omitempty"`
+	ShadowError    string    `json:"shadow_error,omitempty"`
+	LatencyMs      float64   `json:"latency_ms"`
+	ShadowMs       float64   `json:"shadow_latency_ms"`
+}
+
+type MirrorStats struct {
+	Mirrored   atomic.Int64
+	Dropped    atomic.Int64
+	Matched    atomic.Int64
+	Mismatched atomic.Int64
+	Errors     atomic.Int64 // error on one side only
+	Slow       atomic.Int64
+	Failed     atomic.Int64 // could not reach the shadow
+}
+
+// Mirror replays a sample of the traffic on a shadow server in the
+// background and reports results, errors and latencies that differ
+type Mirror struct {
+	config *MirrorConfig
+	queues []chan *MirrorRequest // one per worker
+	done   chan struct{}
+	wg     sync.WaitGroup
+	stats  MirrorStats
+
+	reportMu sync.Mutex
+	report   *os.File
+	redactor *Redactor
+}
+
+func NewMirror(config *MirrorConfig, redactor *Redactor) (*Mirror, error) {
+	if config.Port == 0 {
+		config.Port = 3306
+	}
+	if config.Workers <= 0 {
+		config.Workers = 4
+	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = 1000
+	}
+	if config.SlowRatio <= 0 {
+		config.SlowRatio = 2
+	}
+	if config.SlowMinMs <= 0 {
+		config.SlowMinMs = 5
+	}
+	if config.Enabled && config.Host == "" {
+		return nil, fmt.Errorf("mirror: host is required")
+	}
+	if config.Percent < 0 || config.Percent > 100 {
+		return nil, fmt.Errorf("mirror: percent must be between 0 and 100")
+	}
+
+	m := &Mirror{
+		config:   config,
+		queues:   make([]chan *MirrorRequest, config.Workers),
+		done:     make(chan struct{}),
+		redactor: redactor,
+	}
+	for i := range m.queues {
+		m.queues[i] = make(chan *MirrorRequest, (config.QueueSize+config.Workers-1)/config.Workers)
+	}
+	return m, nil
+}
+
+func (m *Mirror) Start() error {
+	if !m.config.Enabled {
+		return nil
+	}
+
+	if m.config.ReportFile != "" {
+		f, err := os.OpenFile(m.config.ReportFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+		if err != nil {
+			return fmt.Errorf("mirror: failed to open report file: %w", err)
+		}
+		m.report = f
+	}
+
+	for _, queue := range m.queues {
+		m.wg.Add(1)
+		go m.worker(queue)
+	}
+
+	logFor("mirror").Info("mirroring traffic", "percent", m.config.Percent, "writes", m.config.Writes, "host", m.config.Host, "port", m.config.Port)
+	return nil
+}
+
+// Stop waits for the workers to finish, statements still queued are dropped
+func (m *Mirror) Stop() {
+	if !m.config.Enabled {
+		return
+	}
+	close(m.done)
+	m.wg.Wait()
+
+	if m.report != nil {
+		m.report.Close()
+	}
+}
+
+// Sample decides whether the next statement of the session is mirrored.
+// Reads are sampled one by one. Once writes are mirrored the shadow's data
+// depends on them, so whole sessions are sampled and every statement of a
+// sampled session is mirrored.
+func (m *Mirror) Sample(session uint32, write bool) bool {
+	if m == nil || !m.config.Enabled || m.config.Percent <= 0 {
+		return false
+	}
+	if write && !m.config.Writes {
+		return false
+	}
+	if m.config.Percent >= 100 {
+		return true
+	}
+	if !m.config.Writes {
+		return rand.Float64()*100 < m.config.Percent
+	}
+
+	var id [4]byte
+	binary.LittleEndian.PutUint32(id[:], session)
+	h := fnv.New32a()
+	h.Write(id[:])
+	return float64(h.Sum32()%10000) < m.config.Percent*100
+}
+
+// Submit queues a statement for the shadow without ever blocking the client.
+// The statements of a session share a worker so they replay in order.
+func (m *Mirror) Submit(req *MirrorRequest) {
+	select {
+	case <-m.done:
+	case m.queues[req.Session%uint32(len(m.queues))] <- req:
+		m.stats.Mirrored.Add(1)
+	default:
+		m.stats.Dropped.Add(1)
+	}
+}
+
+func (m *Mirror) Stats() *MirrorStats {
+	return &m.stats
+}
+
+func (m *Mirror) worker(queue chan *MirrorRequest) {
+	defer m.wg.Done()
+
+	// one shadow connection per backend user
+	conns := make(map[string]*client.Conn)
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+
+	for {
+		select {
+		case <-m.done:
+			return
+		case req := <-queue:
+			m.replay(conns, req)
+		}
+	}
+}
+
+func (m *Mirror) replay(conns map[string]*client.Conn, req *MirrorRequest) {
+	user, password := req.User, req.Password
+	if m.config.User != "" {
+		user, password = m.config.User, m.config.Password
+	}
+
+	conn, ok := conns[user]
+	if !ok {
+		var err error
+		conn, err = client.Connect(fmt.Sprintf("%s:%d", m.config.Host, m.config.Port), user, password, "")
+		if err != nil {
+			m.stats.Failed.Add(1)
+			logFor("mirror").Error("failed to connect to shadow", "err", err)
+			return
+		}
+		conns[user] = conn
+	}
+
+	if req.Database != "" && conn.GetDB() != req.Database {
+		if err := conn.UseDB(req.Database); err != nil {
+			m.stats.Failed.Add(1)
+			return
+		}
+	}
+
+	start := time.Now()
+	res, err := conn.Execute(req.Query)
+	latency := time.Since(start)
+
+	var myErr *mysql.MyError
+	if err != nil && !errors.As(err, &myErr) {
+		// connection trouble rather than a statement error, reconnect next time
+		m.stats.Failed.Add(1)
+		conn.Close()
+		delete(conns, user)
+		return
+	}
+
+	m.compare(req, res, err, latency)
+}
+
+var orderByRe = regexp.MustCompile(`(?i)\border\s+by\b`)
+
+// resultChecksum hashes the rows of a result, or the affected rows of a
+// write. Without ORDER BY the row order is not defined so the rows are
+// hashed independently of it.
+func resultChecksum(query string, res *mysql.Result) (string, int) {
+	if res == nil {
+		return "", 0
+	}
+	if res.Resultset == nil {
+		return fmt.Sprintf("affected:%d", res.AffectedRows), int(res.AffectedRows)
+	}
+
+	if orderByRe.MatchString(query) {
+		h := sha256.New()
+		for _, row := range res.RowDatas {
+			var length [8]byte
+			binary.LittleEndian.PutUint64(length[:], uint64(len(row)))
+			h.Write(length[:])
+			h.Write(row)
+		}
+		return hex.EncodeToString(h.Sum(nil)[:8]), len(res.RowDatas)
+	}
+
+	var sum uint64
+	for _, row := range res.RowDatas {
+		h := fnv.New64a()
+		h.Write(row)
+		sum += h.Sum64()
+	}
+	return fmt.Sprintf("%016x", sum), len(res.RowDatas)
+}
+
+func (m *Mirror) errorText(err error) string {
+	if err == nil {
+		return ""
+	}
+	return m.redactor.Error(err)
+}
+
+func (m *Mirror) compare(req *MirrorRequest, res *mysql.Result, err error, latency time.Duration) {
+	d := &MirrorDivergence{
+		Time:        time.Now(),
+		User:        req.User,
+		Database:    req.Database,
+		Backend:     req.Backend,
+		Digest:      QueryDigest(req.Query),
+		Query:       m.redactor.Query(req.Query),
+		Error:       m.errorText(req.Err),
+		ShadowError: m.errorText(err),
+		LatencyMs:   float64(req.Latency.Microseconds()) / 1000,
+		ShadowMs:    float64(latency.Microseconds()) / 1000,
+	}
+	d.Checksum, d.Rows = resultChecksum(req.Query, req.Result)
+	d.ShadowChecksum, d.ShadowRows = resultChecksum(req.Query, res)
+
+	// compare error codes only, messages may change between versions
+	var primaryErr, shadowErr *mysql.MyError
+	errors.As(req.Err, &primaryErr)
+	errors.As(err, &shadowErr)
+
+	switch {
+	case (req.Err == nil) != (err == nil) || (primaryErr != nil && shadowErr != nil && primaryErr.Code != shadowErr.Code):
+		d.Kind = "error"
+		m.stats.Errors.Add(1)
+	case d.Checksum != d.ShadowChecksum:
+		d.Kind = "result"
+		m.stats.Mismatched.Add(1)
+	default:
+		m.stats.Matched.Add(1)
+		if req.Backend == "cache" || req.Backend == "coalesced" {
+			break
+		}
+		if d.ShadowMs > d.LatencyMs*m.config.SlowRatio && d.ShadowMs-d.LatencyMs >= m.config.SlowMinMs {
+			d.Kind = "latency"
+			m.stats.Slow.Add(1)
+		}
+	}
+
+	if d.Kind != "" {
+		m.writeReport(d)
+	}
+}
+
+func (m *Mirror) writeReport(d *MirrorDivergence) {
+	if m.report == nil {
+		logFor("mirror").Warn("divergence", "kind", d.Kind, "digest", d.Digest, "query", d.Query, "rows", d.Rows, "shadow_rows", d.ShadowRows,
+			"checksum", d.Checksum, "shadow_checksum", d.ShadowChecksum, "latency_ms", d.LatencyMs, "shadow_ms", d.ShadowMs, "error", d.Error, "shadow_error", d.ShadowError)
+		return
+	}
+
+	line, err := json.Marshal(d)
+	if err != nil {
+		return
+	}
+
+	m.reportMu.Lock()
+	defer m.reportMu.Unlock()
+	if _, err := m.report.Write(append(line, '\n')); err != nil {
+		logFor("mirror").Error("failed to write report", "err", err)
+	}
+}
+
+// mirrored executes the statement and hands a sample of the statements,
+// with their results, to the mirror
+func (ph *ProxyHandler) mirrored(query string, write bool, execute func(string) (*mysql.Result, error)) (*mysql.Result, error) {
+	// statements inside a transaction depend on state the shadow does not have
+	if ph.inTransaction || !ph.p.mirror.Sample(ph.connectionID, write) {
+		return execute(query)
+	}
+
+	start := time.Now()
+	res, err := execute(query)
+
+	ph.p.mirror.Submit(&MirrorRequest{
+		Session:  ph.connectionID,
+		User:     ph.backendUser,
+		Password: ph.backendPassword,
+		Database: ph.databaseName,
+		Query:    query,
+		Write:    write,
+		Result:   res,
+		Err:      err,
+		Latency:  time.Since(start),
+		Backend:  ph.lastBackend,
+	})
+
+	return res, err
+}
@@ -0,0 +1,58 @@
+package main
+
+import "testing"
+
+func TestMirrorSampleSessions(t *testing.T) {
+	m, err := NewMirror(&MirrorConfig{Enabled: true, Host: "shadow", Percent: 50, Writes: true}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a sampled session is mirrored whole, reads and writes alike
+	sampled := 0
+	for session := uint32(1); session <= 1000; session++ {
+		first := m.Sample(session, true)
+		for i := 0; i < 5; i++ {
+			if m.Sample(session, i%2 == 0) != first {
+				t.Fatalf("session %d was sampled for some statements only", session)
+			}
+		}
+		if first {
+			sampled++
+		}
+	}
+	if sampled < 400 || sampled > 600 {
+		t.Errorf("sampled %d of 1000 sessions, want about half", sampled)
+	}
+}
+
+func TestMirrorSubmitOrder(t *testing.T) {
+	m, err := NewMirror(&MirrorConfig{Enabled: true, Host: "shadow", Percent: 100, Writes: true, Workers: 4}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the statements of a session wait on one worker, in order
+	queries := []string{"INSERT INTO t VALUES (1)", "UPDATE t SET a = 2", "SELECT a FROM t"}
+	for _, query := range queries {
+		m.Submit(&MirrorRequest{Session: 7, Query: query})
+	}
+	found := false
+	for i, queue := range m.queues {
+		if len(queue) == 0 {
+			continue
+		}
+		found = true
+		if len(queue) != len(queries) {
+			t.Fatalf("queue %d holds %d statements of the session, want %d", i, len(queue), len(queries))
+		}
+		for _, query := range queries {
+			if req := <-queue; req.Query != query {
+				t.Errorf("queue %d replays %q, want %q", i, req.Query, query)
+			}
+		}
+	}
+	if !found {
+		t.Error("the session's statements were not queued")
+	}
+}
@@ -1,13 +1,12 @@
 package main
 
 import (
-	"fmt"
-	"log"
 	"net"
 	"os"
 	"os/signal"
 	"sync"
 	"syscall"
+	"time"
 
 	"net/http"
 	_ "net/http/pprof"
@@ -27,6 +26,25 @@ type Proxy struct {
 	mgr              *server.InMemoryProvider // in memory authentication map provider
 	clients          []*ProxyHandler          // list of our connected clients
 	server           *server.Server
+	firewall         *Firewall
+	allowlist        *Allowlist
+	rewriter         *Rewriter
+	cache            *QueryCache
+	coalescer        *ReadCoalescer
+	clusters         *Clusters
+	shards           *ShardRouter
+	tenants          *Tenants
+	masking          *Masking
+	encryption       *Encryption
+	mirror           *Mirror
+	capture          *Capture
+	audit            *Audit
+	redactor         *Redactor
+	tracer           *Tracer
+	killer           *Killer
+	timeouts         *Timeouts
+	retry            *RetryPolicy
+	binlog           *BinlogWatcher
 }
 
 type ServerType int
@@ -43,21 +61,150 @@ type Connection struct {
 }
 
 func NewProxy(config *Config) (*Proxy, error) {
+	redactor, err := NewRedactor(&config.Redaction)
+	if err != nil {
+		return nil, err
+	}
+
+	firewall, err := NewFirewall(&config.Firewall, redactor)
+	if err != nil {
+		return nil, err
+	}
+
+	allowlist, err := NewAllowlist(&config.Allowlist)
+	if err != nil {
+		return nil, err
+	}
+
+	rewriter, err := NewRewriter(&config.Rewrite)
+	if err != nil {
+		return nil, err
+	}
+
+	cache, err := NewQueryCache(&config.Cache)
+	if err != nil {
+		return nil, err
+	}
+
+	clusters, err := NewClusters(config)
+	if err != nil {
+		return nil, err
+	}
+
+	shards, err := NewShardRouter(&config.Sharding, config.Clusters)
+	if err != nil {
+		return nil, err
+	}
+
+	tenants, err := NewTenants(&config.Tenants)
+	if err != nil {
+		return nil, err
+	}
+
+	masking, err := NewMasking(&config.Masking)
+	if err != nil {
+		return nil, err
+	}
+
+	encryption, err := NewEncryption(&config.Encryption)
+	if err != nil {
+		return nil, err
+	}
+
+	mirror, err := NewMirror(&config.Mirror, redactor)
+	if err != nil {
+		return nil, err
+	}
+
+	capture, err := NewCapture(&config.Capture)
+	if err != nil {
+		return nil, err
+	}
+
+	audit, err := NewAudit(&config.Audit)
+	if err != nil {
+		return nil, err
+	}
+
+	tracer, err := NewTracer(&config.Tracing, redactor)
+	if err != nil {
+		return nil, err
+	}
+
+	timeouts, err := NewTimeouts(&config.Timeouts)
+	if err != nil {
+		return nil, err
+	}
+
+	retry, err := NewRetryPolicy(&config.Retry)
+	if err != nil {
+		return nil, err
+	}
+
+	// invalidate cached results for writes that do not go through the proxy
+	binlog := NewBinlogWatcher(&config.Binlog, config)
+	binlog.AddListener(cache)
+
 	return &Proxy{
 		config:           config,
 		shutdown:         make(chan struct{}),
 		shutdownAccepter: make(chan struct{}),
+		firewall:         firewall,
+		allowlist:        allowlist,
+		rewriter:         rewriter,
+		cache:            cache,
+		coalescer:        NewReadCoalescer(&config.Coalesce),
+		clusters:         clusters,
+		shards:           shards,
+		tenants:          tenants,
+		masking:          masking,
+		encryption:       encryption,
+		mirror:           mirror,
+		capture:          capture,
+		audit:            audit,
+		redactor:         redactor,
+		tracer:           tracer,
+		killer:           NewKiller(&config.Kill),
+		timeouts:         timeouts,
+		retry:            retry,
+		binlog:           binlog,
 	}, nil
 }
 
 func (p *Proxy) Start() error {
-	// start debug server
+	// start debug server, log levels can be changed on /debug/logging
+	http.Handle("/debug/logging", logs)
 	go func() {
-		log.Println(http.ListenAndServe("localhost:6060", nil))
+		logFor("proxy").Error("debug server stopped", "err", http.ListenAndServe("localhost:6060", nil))
 	}()
 
 	p.backends = NewBackends(p.config)
 	p.backends.Initialize()
+	p.clusters.Initialize(p.backends)
+
+	p.allowlist.Start()
+
+	if err := p.binlog.Start(); err != nil {
+		logFor("binlog").Error("failed to start", "err", err)
+	}
+
+	if err := p.mirror.Start(); err != nil {
+		logFor("mirror").Error("failed to start", "err", err)
+	}
+
+	if err := p.capture.Start(); err != nil {
+		logFor("capture").Error("failed to start", "err", err)
+	}
+
+	if err := p.tracer.Start(); err != nil {
+		logFor("tracing").Error("failed to start", "err", err)
+	}
+
+	// refuse to serve clients without the audit log
+	if err := p.audit.Start(); err != nil {
+		logFor("audit").Error("failed to start", "err", err)
+		os.Exit(1)
+	}
 
 	// create user database, this needs to be shared
 	p.mgr = server.NewInMemoryProvider()
@@ -67,7 +214,7 @@ func (p *Proxy) Start() error {
 
 	listener, err := net.Listen("tcp", p.config.ListenAddress)
 	if err != nil {
-		log.Println(fmt.Errorf("failed to listen to [%s]: %w", p.config.ListenAddress, err))
+		logFor("proxy").Error("failed to listen", "address", p.config.ListenAddress, "err", err)
 		os.Exit(1)
 	}
 	p.listener = listener
@@ -76,7 +223,7 @@ func (p *Proxy) Start() error {
 
 	p.server = server.NewDefaultServer()
 
-	log.Printf("Proxy listening on %s", p.config.ListenAddress)
+	logFor("proxy").Info("proxy listening", "address", p.config.ListenAddress)
 
 	p.wg.Add(1)
 	go p.acceptConnections()
@@ -93,9 +240,9 @@ func (p *Proxy) Start() error {
 
 	select {
 	case <-sigchan:
-		log.Println("Received Unix signal, initiating shutdown...")
+		logFor("proxy").Info("received unix signal, initiating shutdown")
 	case <-p.shutdown:
-		log.Println("Software shutdown initiated...")
+		logFor("proxy").Info("software shutdown initiated")
 	}
 
 	return p.Stop()
@@ -110,7 +257,7 @@ func (p *Proxy) acceptConnections() {
 			case <-p.shutdownAccepter:
 				return
 			default:
-				log.Printf("accept error: %v", err)
+				logFor("proxy").Error("accept error", "err", err)
 			}
 			continue
 		}
@@ -126,30 +273,37 @@ func (p *Proxy) handleConnection(conn net.Conn) {
 
 	//logWithGID("handleConnection()")
 
-	// obtain a connection from the pool
-	svr, err := p.backends.GetNextReplica()
-	if err != nil {
-		panic(err)
-	}
-	readServer := svr
-
-	// obtain a connection from the pool
-	svr, err = p.backends.GetWriter()
-	if err != nil {
-		panic(err)
-	}
-	writeServer := svr
-
-	// create a new server connection
-	ph := NewProxyHandler(p, readServer, writeServer)
+	// create a new server connection, the backends are picked once the
+	// handshake has told us the default database and with it the cluster
+	ph := NewProxyHandler(p)
+	accepted := time.Now()
 
 	// create the handler
 	host, err := server.NewCustomizedConn(conn, p.server, p.mgr, ph)
+	authenticated := time.Now()
 	if err != nil {
-		fmt.Printf("Received Error trying to create server instance: %s: %s\n", conn.RemoteAddr(), err.Error())
+		logFor("session").Warn("handshake failed", "client", conn.RemoteAddr().String(), "err", err)
+		p.audit.Write(&AuditEvent{Time: time.Now(), Event: "auth_failed", Client: conn.RemoteAddr().String()})
+		connect := p.tracer.StartSpan("", "connect", SpanKindServer, accepted)
+		connect.SetAttribute("client.address", conn.RemoteAddr().String())
+		connect.SetError(err)
+		connect.EndAt(authenticated)
 		return
 	}
 
+	// the connection attributes may carry the trace of the client
+	ph.traceparent = host.Attributes()["traceparent"]
+	connect := p.tracer.StartSpan(ph.traceparent, "connect", SpanKindServer, accepted)
+	connect.SetAttribute("client.address", conn.RemoteAddr().String())
+	connect.SetAttribute("db.user", host.GetUser())
+	connect.SetAttribute("dbinsight.connection_id", host.ConnectionID())
+	connect.ChildAt("authenticate", SpanKindInternal, accepted).EndAt(authenticated)
+
+	ph.user = host.GetUser()
+	ph.remoteAddr = conn.RemoteAddr().String()
+	ph.connectionID = host.ConnectionID()
+	ph.client = conn
+
 	// add to our list of clients
 	p.mu.Lock()
 	p.clients = append(p.clients, ph)
@@ -157,8 +311,7 @@ func (p *Proxy) handleConnection(conn net.Conn) {
 
 	//log.Println("Registered the connection with the server")
 
-	user := host.GetUser()
-	user, err = p.config.GetBackendUser(user)
+	user, err := p.config.GetBackendUser(ph.user)
 	if err != nil {
 		panic(err)
 	}
@@ -167,16 +320,45 @@ func (p *Proxy) handleConnection(conn net.Conn) {
 	if err != nil {
 		panic(err)
 	}
+	ph.backendUser = user
+	ph.backendPassword = password
+
+	ph.captureConnect(ph.databaseName)
+	defer ph.captureDisconnect()
+
+	// the handshake happens before we know the user, map its database now
+	ph.databaseName = p.tenants.MapDatabase(ph.user, ph.databaseName)
+
+	ph.cluster = p.clusters.ForDatabase(ph.databaseName)
+	backends, err := p.clusters.Get(ph.cluster)
+	if err != nil {
+		panic(err)
+	}
+
+	// obtain a connection from the pool
+	readServer, err := backends.GetReader()
+	if err != nil {
+		panic(err)
+	}
+
+	// obtain a connection from the pool
+	writeServer, err := backends.GetWriter()
+	if err != nil {
+		panic(err)
+	}
+	ph.readServer = readServer
+	ph.writeServer = writeServer
+
 	read_key := NewUserKey(readServer.address, user, password)
 	//ph.key = key
 
-	cl_conn, err := readServer.GetNextConn(read_key)
+	cl_conn, err := tracedBorrow(connect, readServer, read_key)
 	if err != nil {
 		panic(err)
 	}
 
 	write_key := NewUserKey(writeServer.address, user, password)
-	sv_conn, err := writeServer.GetNextConn(write_key)
+	sv_conn, err := tracedBorrow(connect, writeServer, write_key)
 	if err != nil {
 		panic(err)
 	}
@@ -186,27 +368,31 @@ func (p *Proxy) handleConnection(conn net.Conn) {
 	ph.read_conn = cl_conn
 	ph.write_conn = sv_conn
 	ph.current_conn = ph.read_conn
+	ph.trackThreads()
+
+	ph.auditSession("connect")
+	ph.logger().Info("client connected", "database", ph.databaseName)
+	connect.SetAttribute("db.name", ph.databaseName)
+	connect.End()
 
 	// as long as the client keeps sending commands, keep handling them
 	for {
-		if err := host.HandleCommand(); err != nil {
+		err := host.HandleCommand()
+		// the result has been written, finish the trace of the statement
+		ph.endStatementSpan(ph.handled)
+		if err != nil {
 			if err.Error() != "connection closed" {
-				log.Printf("Received error on connection: %v\n", err)
+				ph.logger().Warn("received error on connection", "err", err)
 			}
 			break
 		}
 	}
 
-	//cl_conn.Close()
-	err = ph.readServer.PutConn(read_key, cl_conn)
-	if err != nil {
-		logWithGID(err.Error())
-	}
-	//sv_conn.Close()
-	ph.writeServer.PutConn(write_key, sv_conn)
-	if err != nil {
-		logWithGID(err.Error())
-	}
+	ph.auditSession("disconnect")
+	ph.logger().Info("client disconnected")
+
+	// the session may have moved to another cluster since it connected
+	ph.releaseConns()
 
 	// Remove our client
 	for i, proxyHandler := range p.clients {
@@ -230,13 +416,31 @@ func (p *Proxy) Stop() error {
 	}
 
 	for _, proxyHandler := range p.clients {
-		proxyHandler.read_conn.Close()
-		proxyHandler.write_conn.Close()
+		if proxyHandler.read_conn != nil {
+			proxyHandler.read_conn.Close()
+		}
+		if proxyHandler.write_conn != nil {
+			proxyHandler.write_conn.Close()
+		}
 	}
 
 	p.backends.Shutdown()
+	p.clusters.Shutdown()
+
+	p.binlog.Stop()
+	p.mirror.Stop()
+
+	if err := p.allowlist.Stop(); err != nil {
+		logFor("allowlist").Error("failed to stop", "err", err)
+	}
 
 	p.wg.Wait()
-	log.Println("Proxy stopped")
+
+	// sessions have ended, write out the rest of the capture
+	p.capture.Stop()
+	p.audit.Stop()
+	p.tracer.Stop()
+
+	logFor("proxy").Info("proxy stopped")
 	return nil
 }
@@ -2,15 +2,17 @@ package main
 
 import (
 	"fmt"
-	"log"
-	"math"
+	"log/slog"
+	"net"
 	"regexp"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-mysql-org/go-mysql/client"
 	"github.com/go-mysql-org/go-mysql/mysql" // Import the mysql package
+	"github.com/jbhall78/dbinsight/internal/capture"
 )
 
 type ProxyHandler struct {
@@ -20,7 +22,23 @@ type ProxyHandler struct {
 	current_conn *client.Conn
 	readServer   *BackendServer
 	writeServer  *BackendServer
+	cluster      string // cluster readServer and writeServer belong to
 	databaseName string
+	user         string // proxy user the client authenticated as
+	remoteAddr   string
+	connectionID uint32 // connection id the client was given in the handshake
+	client       net.Conn
+
+	threads atomic.Pointer[SessionThreads] // backend threads of read_conn and write_conn, read by KILL
+	killed  atomic.Bool                    // the backend threads were killed, the connections can't go back to the pools
+
+	backendUser     string
+	backendPassword string
+
+	hints   *QueryHints       // routing hints for the statement being executed
+	session *SessionVariables // SET dbinsight.* settings
+
+	lastBackend string // backend that served the most recent statement
 	//	initialDatabase  string
 	connectionLocked bool
 	useCalled        bool
@@ -30,8 +48,15 @@ type ProxyHandler struct {
 	inTransaction bool
 
 	preparedStmts map[uint32]*client.Stmt
+	stmtConns     map[uint32]*client.Conn // connection each prepared statement lives on
 	stmtCounter   uint32
 	stmtMutex     sync.Mutex
+
+	captureID uint64 // session id in the traffic capture, 0 when not recorded
+
+	traceparent string    // traceparent connection attribute, statements continue its trace
+	span        *Span     // trace of the statement being handled, nil when it is not traced
+	handled     time.Time // when the handler returned the statement's result
 }
 
 type Transaction struct {
@@ -40,19 +65,25 @@ type Transaction struct {
 	beginError  error
 }
 
-func NewProxyHandler(proxy *Proxy, readServer *BackendServer, writeServer *BackendServer) *ProxyHandler {
+func NewProxyHandler(proxy *Proxy) *ProxyHandler {
 	// NOTE: most of the initialization code for this struct is
 	//       handled in handleConnection()
 
 	return &ProxyHandler{
 		p:             proxy,
-		readServer:    readServer,
-		writeServer:   writeServer,
 		preparedStmts: make(map[uint32]*client.Stmt),
+		stmtConns:     make(map[uint32]*client.Conn),
 		stmtCounter:   1, // Start counter from 1
+		session:       NewSessionVariables(),
 	} // Initialize any internal state here
 }
 
+// logger returns the session's logger, its lines carry the client
+// connection, user and the backend the session is using
+func (ph *ProxyHandler) logger() *slog.Logger {
+	return logFor("session").With("conn", ph.connectionID, "user", ph.user, "client", ph.remoteAddr, "backend", ph.backendAddress())
+}
+
 func (ph *ProxyHandler) UseDB(dbName string) error {
 	//log.Println("UseDB called with:", dbName)
 
@@ -60,9 +91,21 @@ func (ph *ProxyHandler) UseDB(dbName string) error {
 	//defer ph.mu.Unlock()
 
 	if ph.current_conn == nil {
+		// the handshake's database, recorded with the connect
 		ph.databaseName = dbName
 		return nil
 	}
+	start := time.Now()
+	err := ph.useDatabase(ph.p.tenants.MapDatabase(ph.user, dbName))
+	ph.captureUseDB(start, dbName, err)
+	return err
+}
+
+// useDatabase switches the read and write connections to a backend database
+func (ph *ProxyHandler) useDatabase(dbName string) error {
+	if err := ph.switchCluster(ph.p.clusters.ForDatabase(dbName)); err != nil {
+		return err
+	}
 	ph.databaseName = dbName
 	//logWithGID(fmt.Sprintf("switching database to: '%s': %s\n", dbName, ph.current_conn.RemoteAddr()))
 	// Your implementation to handle COM_INIT_DB
@@ -148,6 +191,11 @@ func (ph *ProxyHandler) ExecuteUseQuery(query string) (*mysql.Result, error) {
 	if err != nil {
 		return nil, err
 	}
+	dbName = ph.p.tenants.MapDatabase(ph.user, dbName)
+	if err := ph.switchCluster(ph.p.clusters.ForDatabase(dbName)); err != nil {
+		return nil, err
+	}
+	ph.databaseName = dbName
 	q := "USE " + dbName + ";"
 
 	var wg sync.WaitGroup
@@ -170,43 +218,225 @@ func (ph *ProxyHandler) ExecuteUseQuery(query string) (*mysql.Result, error) {
 	return res, nil
 }
 
+// RouteDecision describes where a statement is sent and why
+type RouteDecision struct {
+	Target string // primary, replica or replica_group
+	Group  string
+	Reason string
+}
+
+const RouteReplicaGroup = "replica_group"
+
+// routeRead decides where a read-only statement goes based on the routing
+// hints of the current statement, the session variables and replica lag
+func (ph *ProxyHandler) routeRead() *RouteDecision {
+	var decision *RouteDecision
+
+	// statement hints take precedence over session settings
+	switch {
+	case ph.hints.wantsPrimary() && ph.hints.Route == RoutePrimary:
+		return &RouteDecision{Target: RoutePrimary, Reason: "route=primary hint"}
+	case ph.hints.wantsPrimary():
+		return &RouteDecision{Target: RoutePrimary, Reason: "consistency=strong hint"}
+	case ph.hints != nil && ph.hints.ReplicaGroup != "":
+		return &RouteDecision{Target: RouteReplicaGroup, Group: ph.hints.ReplicaGroup, Reason: "replica_group hint"}
+	case ph.hints != nil && ph.hints.Route == RouteReplica:
+		decision = &RouteDecision{Target: RouteReplica, Reason: "route=replica hint"}
+	case ph.session.ReadFrom == ReadFromPrimary:
+		return &RouteDecision{Target: RoutePrimary, Reason: "dbinsight.read_from = primary"}
+	case ph.session.ReadFrom == ReadFromReplica:
+		decision = &RouteDecision{Target: RouteReplica, Reason: "dbinsight.read_from = replica"}
+	case ph.connectionLocked:
+		return &RouteDecision{Target: RoutePrimary, Reason: "session is locked to the primary"}
+	default:
+		decision = &RouteDecision{Target: RouteReplica, Reason: "read-only statement"}
+	}
+
+	// fall back to the primary when the replica is further behind than allowed
+	if !ph.readServer.WithinLag(ph.session.MaxLag) {
+		return &RouteDecision{Target: RoutePrimary, Reason: fmt.Sprintf("replica %s exceeds dbinsight.max_lag of %d seconds", ph.readServer.address, ph.session.MaxLag)}
+	}
+
+	return decision
+}
+
+// readConn returns the connection a read should use given the routing hints
+// of the current statement and the backend it belongs to. The release
+// function must be called once the read has finished.
+func (ph *ProxyHandler) readConn() (*client.Conn, *BackendServer, func(), error) {
+	release := func() {}
+
+	decision := ph.routeRead()
+	ph.span.SetAttribute("dbinsight.read_target", decision.Target)
+	if decision.Reason != "" {
+		ph.span.SetAttribute("dbinsight.read_reason", decision.Reason)
+	}
+	switch decision.Target {
+	case RoutePrimary:
+		if ph.p.config.LogQueries && ph.current_conn != ph.write_conn {
+			ph.logger().Info("reading from primary", "reason", decision.Reason)
+		}
+		return ph.write_conn, ph.writeServer, release, nil
+	case RouteReplicaGroup:
+		return ph.borrowReplicaConn(decision.Group)
+	}
+
+	return ph.read_conn, ph.readServer, release, nil
+}
+
+// borrowReplicaConn takes a connection from a replica in the given group for
+// a single statement, the connection is returned to the pool on release
+func (ph *ProxyHandler) borrowReplicaConn(group string) (*client.Conn, *BackendServer, func(), error) {
+	svr, err := ph.p.backends.GetNextReplicaInGroup(group)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if !svr.WithinLag(ph.session.MaxLag) {
+		return ph.write_conn, ph.writeServer, func() {}, nil
+	}
+
+	key := NewUserKey(svr.address, ph.backendUser, ph.backendPassword)
+	conn, err := tracedBorrow(ph.span, svr, key)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	release := func() {
+		if err := svr.PutConn(key, conn); err != nil {
+			ph.logger().Error("failed to return connection to pool", "backend", svr.address, "err", err)
+		}
+	}
+
+	if ph.databaseName != "" {
+		if err := conn.UseDB(ph.databaseName); err != nil {
+			release()
+			return nil, nil, nil, err
+		}
+	}
+
+	return conn, svr, release, nil
+}
+
+// cacheRequest returns the result cache request for a read, or nil when the
+// cache must be bypassed for this statement
+func (ph *ProxyHandler) cacheRequest(query string) *CacheRequest {
+	if ph.inTransaction || ph.hints.wantsPrimary() {
+		return nil
+	}
+	return ph.p.cache.NewRequest(ph.user, ph.databaseName, query)
+}
+
 func (ph *ProxyHandler) ExecuteReadQuery(query string) (*mysql.Result, error) {
+	cacheReq := ph.cacheRequest(query)
+	if cacheReq != nil {
+		if res := ph.p.cache.Get(cacheReq); res != nil {
+			ph.lastBackend = "cache"
+			return res, nil
+		}
+	}
+
+	query = ph.session.tag(query)
+
+	key := ph.coalesceKey(query)
+	if key == "" {
+		return ph.executeRead(query, cacheReq)
+	}
+
+	res, shared, err := ph.p.coalescer.Do(key, func() (*mysql.Result, error) {
+		return ph.executeRead(query, cacheReq)
+	})
+	if shared {
+		ph.lastBackend = "coalesced"
+		if ph.p.config.LogQueries {
+			ph.logger().Info("shared result of identical in-flight query", "query", ph.p.redactor.Query(query))
+		}
+	}
+	return res, err
+}
+
+// executeRead runs a read query on the backend chosen by readConn, storing
+// the result in the cache when cacheReq is set
+func (ph *ProxyHandler) executeRead(query string, cacheReq *CacheRequest) (*mysql.Result, error) {
+	conn, svr, release, err := ph.readConn()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	ph.lastBackend = conn.RemoteAddr().String()
+
 	if ph.p.config.LogQueries {
-		logWithGID(fmt.Sprintf("executing read-only query: %s: %s\n", query, ph.current_conn.RemoteAddr()))
+		ph.logger().Info("executing read-only query", "query", ph.p.redactor.Query(query))
 	}
 	var res *mysql.Result
-	var err error
 
-	delay := 1.0
+	execute := ph.span.Child("backend.execute", SpanKindClient)
+	execute.SetAttribute("server.address", ph.lastBackend)
+	defer func() {
+		execute.SetError(err)
+		execute.End()
+	}()
 
-	//for i := 0; i < 180; i++ {
-	for {
-		res, err = ph.current_conn.Execute(query)
+	// the timeout covers the retries as well
+	timeout := ph.statementTimeout(query)
+	deadline := time.Now().Add(timeout)
+
+	for attempt := 1; ; attempt++ {
+		remaining := timeout
+		if timeout > 0 {
+			remaining = time.Until(deadline)
+			if remaining <= 0 {
+				// a timeout of 0 would let the retry run forever
+				err = queryTimeoutError()
+				break
+			}
+		}
+		res, err = ph.executeWithTimeout(svr, conn, remaining, func() (*mysql.Result, error) {
+			return conn.Execute(query)
+		})
 		if err == nil {
+			if cacheReq != nil {
+				ph.p.cache.Put(cacheReq, res)
+			}
 			return res, nil
 		}
 
-		// check to see if it is a replication error first.
-		if !isReplicationError(err) {
+		// the replica may not have the table or database the primary just created
+		if !isReplicationError(err) || !ph.p.retry.Retry(attempt) {
 			break
 		}
-
-		time.Sleep(time.Duration(delay))
-		delay = math.Min(delay*2, 10000) // Double the delay, up to max
+		delay := ph.p.retry.Delay(attempt)
+		if timeout > 0 && time.Until(deadline) <= delay {
+			break
+		}
+		ph.logger().Warn("retrying read after replication error", "attempt", attempt, "delay", delay, "err", ph.p.redactor.Error(err))
+		time.Sleep(delay)
 	}
 	return nil, err
 }
 
 func (ph *ProxyHandler) ExecuteWriteQuery(query string) (*mysql.Result, error) {
 	//query = trimTrailingNull(query)
+	// the cache is invalidated with the query as the client sent it
+	tagged := ph.session.tag(query)
+	ph.lastBackend = ph.write_conn.RemoteAddr().String()
+
 	if ph.p.config.LogQueries {
-		logWithGID(fmt.Sprintf("executing write query: %s -- database: %s: server: %s\n", query, ph.write_conn.GetDB(), ph.write_conn.RemoteAddr()))
+		ph.logger().Info("executing write query", "query", ph.p.redactor.Query(tagged), "database", ph.write_conn.GetDB())
 	}
-	res, err := ph.write_conn.Execute(query)
+	execute := ph.span.Child("backend.execute", SpanKindClient)
+	execute.SetAttribute("server.address", ph.lastBackend)
+	res, err := ph.executeWithTimeout(ph.writeServer, ph.write_conn, ph.statementTimeout(query), func() (*mysql.Result, error) {
+		return ph.write_conn.Execute(tagged)
+	})
+	execute.SetError(err)
+	execute.End()
 	if err != nil {
-		logWithGID(fmt.Sprintf("error: %s", err.Error()))
+		ph.logger().Error("write query failed", "err", ph.p.redactor.Error(err))
 		return nil, err
 	}
+	ph.p.cache.InvalidateForWrite(ph.databaseName, query)
 	// go-mysql/client returns ResultSet
 	// go-mysql/server only sends and OK packet when ResultSet is nil
 	res.Resultset = nil // force an OK packet to be sent by go-mysql
@@ -214,18 +444,127 @@ func (ph *ProxyHandler) ExecuteWriteQuery(query string) (*mysql.Result, error) {
 	return res, nil
 }
 
+// checkQuery runs the firewall and allowlist, returning the configured
+// MySQL error when the query is not allowed. Rules are written against the
+// database names the client uses, so it runs before the tenant rewrite.
+func (ph *ProxyHandler) checkQuery(query string) error {
+	err := ph.p.firewall.Check(&FirewallRequest{
+		User:     ph.user,
+		Database: ph.p.tenants.ClientDatabase(ph.user, ph.databaseName),
+		Query:    query,
+	})
+	if err != nil {
+		return err
+	}
+
+	return ph.p.allowlist.Check(ph.user, query)
+}
+
+// rewriteQuery applies the configured rewrite rules to the query
+func (ph *ProxyHandler) rewriteQuery(query string) string {
+	rewritten, applied := ph.p.rewriter.Rewrite(ph.user, query)
+	if len(applied) > 0 && ph.p.config.LogQueries {
+		ph.logger().Info("rewrote query", "rules", applied, "query", ph.p.redactor.Query(query), "rewritten", ph.p.redactor.Query(rewritten))
+	}
+	return rewritten
+}
+
+// applyQueryHints strips dbinsight hint comments from the query and records
+// the hints for the statement about to be executed
+func (ph *ProxyHandler) applyQueryHints(query string) (string, error) {
+	query, hints, err := extractQueryHints(query)
+	if err != nil {
+		return query, mysql.NewError(mysql.ER_UNKNOWN_ERROR, err.Error())
+	}
+	ph.hints = hints
+
+	if hints != nil && hints.Timeout > 0 {
+		// the proxy kills statements running past the timeout, the optimizer
+		// hint lets the server stop SELECTs on its own
+		query = injectMaxExecutionTime(query, int(hints.Timeout/time.Millisecond))
+	}
+
+	return query, nil
+}
+
 func (ph *ProxyHandler) ExecuteQuery(query string) (*mysql.Result, error) {
+	query, err := ph.applyQueryHints(query)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { ph.hints = nil }()
+
+	query = ph.rewriteQuery(query)
+	if err := ph.checkQuery(query); err != nil {
+		return nil, err
+	}
+	query = ph.p.tenants.RewriteQuery(ph.user, query)
+
 	stmts, err := parseSQL(query)
 	if err != nil {
-		log.Println(err)
+		ph.logger().Error("failed to parse query", "err", err)
+		return nil, err
+	}
+
+	// SET dbinsight.* and SELECT @@dbinsight.* are answered by the proxy
+	if res, handled, err := ph.handleSessionVariableQuery(query); handled {
+		return res, err
+	}
+
+	if res, handled, err := ph.handleIntrospectionQuery(query); handled {
+		return res, err
+	}
+
+	// connection ids are the proxy's, not the backend's
+	if res, handled, err := ph.handleKillQuery(query); handled {
+		return res, err
+	}
+
+	// values of encrypted columns never reach the backend in plaintext
+	query, err = ph.p.encryption.EncryptQuery(query)
+	if err != nil {
 		return nil, err
 	}
 
 	if !ph.useCalled {
-		ph.UseDB(ph.databaseName)
+		ph.useDatabase(ph.databaseName)
 		ph.useCalled = true
 	}
 
+	// statements on tables that live in another cluster run there
+	routeSpan := ph.span.Child("route", SpanKindInternal)
+	routed := func(target string, cluster string, err error) {
+		routeSpan.SetAttribute("dbinsight.route", target)
+		if cluster != "" {
+			routeSpan.SetAttribute("dbinsight.cluster", cluster)
+		}
+		routeSpan.SetError(err)
+		routeSpan.End()
+	}
+	if len(stmts) > 0 && stmts[0] != Use {
+		shardRoute, err := ph.p.shards.Route(ph.databaseName, query)
+		if err != nil {
+			routed("error", ph.cluster, err)
+			return nil, err
+		}
+		if shardRoute != nil {
+			routeSpan.SetAttribute("dbinsight.shard_table", shardRoute.Table.name)
+			routed("shard", "", nil)
+			return ph.executeSharded(shardRoute, stmts[0].(int), query)
+		}
+
+		route, err := ph.p.clusters.ForQuery(ph.databaseName, query)
+		if err != nil {
+			routed("error", ph.cluster, err)
+			return nil, err
+		}
+		if route != nil && route.Cluster != ph.cluster {
+			routed("cluster", route.Cluster, nil)
+			return ph.executeOnCluster(route, stmts[0].(int), query)
+		}
+	}
+	routed("session", ph.cluster, nil)
+
 	for _, stmt := range stmts {
 		switch stmt {
 
@@ -240,7 +579,7 @@ func (ph *ProxyHandler) ExecuteQuery(query string) (*mysql.Result, error) {
 		case Desc:
 			fallthrough
 		case Describe:
-			return ph.ExecuteReadQuery(query)
+			return ph.mirrored(query, false, ph.ExecuteReadQuery)
 
 		// write statements
 		case Create:
@@ -254,7 +593,7 @@ func (ph *ProxyHandler) ExecuteQuery(query string) (*mysql.Result, error) {
 		case Update:
 			fallthrough
 		case Insert:
-			return ph.ExecuteWriteQuery(query)
+			return ph.mirrored(query, true, ph.ExecuteWriteQuery)
 
 		case Truncate:
 			fallthrough
@@ -266,7 +605,7 @@ func (ph *ProxyHandler) ExecuteQuery(query string) (*mysql.Result, error) {
 			fallthrough
 		case Set:
 			if !ph.connectionLocked {
-				log.Println("locking connection to write server")
+				ph.logger().Debug("locking connection to write server")
 				//ph.write_conn.Sequence = ph.read_conn.Sequence
 				ph.current_conn = ph.write_conn
 				ph.connectionLocked = true
@@ -274,7 +613,8 @@ func (ph *ProxyHandler) ExecuteQuery(query string) (*mysql.Result, error) {
 			return ph.ExecuteWriteQuery(query)
 
 		default:
-			log.Panicf("Found an unknown statement type: %s\n", query)
+			ph.logger().Error("found an unknown statement type", "query", ph.p.redactor.Query(query))
+			panic(fmt.Sprintf("Found an unknown statement type: %s", ph.p.redactor.Query(query)))
 		}
 	}
 
@@ -283,7 +623,33 @@ func (ph *ProxyHandler) ExecuteQuery(query string) (*mysql.Result, error) {
 
 func (ph *ProxyHandler) HandleQuery(query string) (*mysql.Result, error) {
 	//log.Println("HandleQuery called with:", query)
-	return ph.ExecuteQuery(query)
+	start := time.Now()
+	ph.startStatementSpan("query", query, start)
+	res, err := ph.ExecuteQuery(query)
+	if err == nil {
+		res, err = ph.mapResult(res, true)
+	}
+	ph.traceResult(res, err)
+	ph.captureCommand(capture.TypeQuery, start, query, 0, nil, res, err)
+	ph.auditStatement(start, query, res, err)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// mapResult turns a backend result into what the client gets: database
+// names mapped back, encrypted columns decrypted and masks applied
+func (ph *ProxyHandler) mapResult(res *mysql.Result, text bool) (*mysql.Result, error) {
+	res, err := ph.p.tenants.MapResult(ph.user, res, text)
+	if err != nil {
+		return nil, err
+	}
+	res, err = ph.p.encryption.Decrypt(ph.user, res, text)
+	if err != nil {
+		return nil, err
+	}
+	return ph.p.masking.Apply(ph.user, res, text)
 }
 
 // COM_FIELD_LIST is deprecated so this doesn't need to be implemented
@@ -291,11 +657,47 @@ func (ph *ProxyHandler) HandleFieldList(table string, fieldWildcard string) ([]*
 	return nil, nil
 }
 
+// prepareReadConn returns the connection read statements are prepared on.
+// Prepared statements live on a single connection for their whole lifetime
+// so replica_group hints, which borrow a connection per statement, are not
+// supported here.
+func (ph *ProxyHandler) prepareReadConn() *client.Conn {
+	switch {
+	case ph.hints.wantsPrimary():
+		return ph.write_conn
+	case ph.hints != nil && ph.hints.ReplicaGroup != "":
+		ph.logger().Warn("replica_group hints are ignored for prepared statements")
+	case ph.hints != nil && ph.hints.Route == RouteReplica:
+		return ph.read_conn
+	}
+	return ph.current_conn
+}
+
 func (ph *ProxyHandler) HandleStmtPrepare(query string) (params int, columns int, context interface{}, err error) {
-	log.Println("HandleStmtPrepare called with query:", query)
+	ph.logger().Debug("HandleStmtPrepare called", "query", ph.p.redactor.Query(query))
+	start := time.Now()
+	original := query
+	defer func() {
+		// BEGIN, COMMIT and ROLLBACK have no statement and are recorded as queries when executed
+		if stmtKey, ok := context.(uint32); ok || err != nil {
+			ph.captureCommand(capture.TypePrepare, start, original, stmtKey, nil, nil, err)
+		}
+	}()
+	query, err = ph.applyQueryHints(query)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	defer func() { ph.hints = nil }()
+
+	query = ph.rewriteQuery(query)
+	if err := ph.checkQuery(query); err != nil {
+		return 0, 0, nil, err
+	}
+	query = ph.p.tenants.RewriteQuery(ph.user, query)
+
 	sqlStatements, err := parseSQL(query)
 	if err != nil {
-		log.Println(err.Error())
+		ph.logger().Error("failed to parse statement", "err", err)
 		return 0, 0, nil, fmt.Errorf("error parsing sql: %s", err.Error())
 	}
 
@@ -303,20 +705,39 @@ func (ph *ProxyHandler) HandleStmtPrepare(query string) (params int, columns int
 		return 0, 0, nil, fmt.Errorf("error parsing sql: wrong number of SQL statements for prepare command")
 	}
 
+	// the shard of a prepared statement depends on its parameters
+	if route, err := ph.p.shards.Route(ph.databaseName, query); err != nil {
+		return 0, 0, nil, err
+	} else if route != nil {
+		return 0, 0, nil, mysql.NewError(mysql.ER_NOT_SUPPORTED_YET, fmt.Sprintf("prepared statements on sharded table %s are not supported", route.Table.name))
+	}
+
+	// the connection id is translated by the proxy, see handleKillQuery
+	if sqlStatements[0] == Kill {
+		return 0, 0, nil, mysql.NewError(mysql.ER_UNSUPPORTED_PS, "KILL cannot be prepared through the proxy")
+	}
+
+	// literals of encrypted columns, the parameters are encrypted on execute
+	query, err = ph.p.encryption.EncryptQuery(query)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+
 	if !ph.useCalled {
-		ph.UseDB(ph.databaseName)
+		ph.useDatabase(ph.databaseName)
 		ph.useCalled = true
 	}
 
 	//var ctx *Transaction = &Transaction{}
 	var stmt *client.Stmt
+	var conn *client.Conn
 
 	for _, sqlStatement := range sqlStatements {
 		switch sqlStatement {
 
 		case Begin:
 			if !ph.connectionLocked {
-				log.Println("locking connection to write server")
+				ph.logger().Debug("locking connection to write server")
 				ph.current_conn = ph.write_conn
 				ph.connectionLocked = true
 			}
@@ -339,7 +760,13 @@ func (ph *ProxyHandler) HandleStmtPrepare(query string) (params int, columns int
 		case Desc:
 			fallthrough
 		case Describe:
-			fallthrough
+			// 1. Prepare the statement on the backend server
+			conn = ph.prepareReadConn()
+			stmt, err = conn.Prepare(query)
+			if err != nil {
+				ph.logger().Error("error preparing statement on backend", "err", ph.p.redactor.Error(err))
+				return 0, 0, nil, fmt.Errorf("error preparing statement on backend: %w", err)
+			}
 
 			// write statements
 		case Create:
@@ -354,9 +781,10 @@ func (ph *ProxyHandler) HandleStmtPrepare(query string) (params int, columns int
 			fallthrough
 		case Insert:
 			// 1. Prepare the statement on the backend server
-			stmt, err = ph.current_conn.Prepare(query)
+			conn = ph.current_conn
+			stmt, err = conn.Prepare(query)
 			if err != nil {
-				logWithGID(fmt.Sprintf("error preparing statement on backend: %s", err.Error()))
+				ph.logger().Error("error preparing statement on backend", "err", ph.p.redactor.Error(err))
 				return 0, 0, nil, fmt.Errorf("error preparing statement on backend: %w", err)
 			}
 		case Truncate:
@@ -369,18 +797,20 @@ func (ph *ProxyHandler) HandleStmtPrepare(query string) (params int, columns int
 			fallthrough
 		case Set:
 			if !ph.connectionLocked {
-				log.Println("locking connection to write server")
+				ph.logger().Debug("locking connection to write server")
 				ph.current_conn = ph.write_conn
 				ph.connectionLocked = true
 			}
 			// 1. Prepare the statement on the backend server
-			stmt, err = ph.current_conn.Prepare(query)
+			conn = ph.current_conn
+			stmt, err = conn.Prepare(query)
 			if err != nil {
-				logWithGID(fmt.Sprintf("error preparing statement on backend: %s", err.Error()))
+				ph.logger().Error("error preparing statement on backend", "err", ph.p.redactor.Error(err))
 				return 0, 0, nil, fmt.Errorf("error preparing statement on backend: %w", err)
 			}
 		default:
-			log.Panicf("Found an unknown statement type: %s\n", query)
+			ph.logger().Error("found an unknown statement type", "query", ph.p.redactor.Query(query))
+			panic(fmt.Sprintf("Found an unknown statement type: %s", ph.p.redactor.Query(query)))
 		}
 	}
 
@@ -393,6 +823,7 @@ func (ph *ProxyHandler) HandleStmtPrepare(query string) (params int, columns int
 	stmtKey := ph.stmtCounter
 	ph.stmtCounter++
 	ph.preparedStmts[stmtKey] = stmt
+	ph.stmtConns[stmtKey] = conn
 	ph.stmtMutex.Unlock()
 
 	// Pass the key as context
@@ -401,8 +832,20 @@ func (ph *ProxyHandler) HandleStmtPrepare(query string) (params int, columns int
 	return params, columns, context, nil
 }
 
-func (ph *ProxyHandler) HandleStmtExecute(context interface{}, query string, args []interface{}) (*mysql.Result, error) {
-	log.Println("HandleStmtExecute called with query:", query, "and args:", args)
+func (ph *ProxyHandler) HandleStmtExecute(context interface{}, query string, args []interface{}) (res *mysql.Result, err error) {
+	ph.logger().Debug("HandleStmtExecute called", "query", ph.p.redactor.Query(query), "args", ph.p.redactor.Args(query, args))
+
+	start := time.Now()
+	ph.startStatementSpan("execute", query, start)
+	defer func() {
+		ph.traceResult(res, err)
+		if stmtKey, ok := context.(uint32); ok {
+			ph.captureCommand(capture.TypeExecute, start, "", stmtKey, args, res, err)
+		} else {
+			ph.captureCommand(capture.TypeQuery, start, query, 0, nil, res, err)
+		}
+		ph.auditStatement(start, query, res, err)
+	}()
 
 	// Handle BEGIN, COMMIT, ROLLBACK (context is nil)
 	if context == nil {
@@ -423,20 +866,34 @@ func (ph *ProxyHandler) HandleStmtExecute(context interface{}, query string, arg
 	// Retrieve the prepared statement from the map
 	ph.stmtMutex.Lock()
 	stmt, ok := ph.preparedStmts[stmtKey]
+	conn := ph.stmtConns[stmtKey]
 	ph.stmtMutex.Unlock()
 
 	if !ok {
 		return nil, fmt.Errorf("prepared statement not found for key: %d", stmtKey)
 	}
 
+	// the arguments are captured as the client sent them
+	backendArgs, err := ph.p.encryption.EncryptArgs(query, args)
+	if err != nil {
+		return nil, err
+	}
+
 	// Execute the prepared statement
-	result, err := stmt.Execute(args...)
+	execute := ph.span.Child("backend.execute", SpanKindClient)
+	execute.SetAttribute("server.address", ph.lastBackend)
+	result, err := ph.executeWithTimeout(ph.serverOf(conn), conn, ph.statementTimeout(query), func() (*mysql.Result, error) {
+		return stmt.Execute(backendArgs...)
+	})
+	execute.SetError(err)
+	execute.End()
 	if err != nil {
 		return nil, err
 	}
+	ph.p.cache.InvalidateForWrite(ph.databaseName, query)
 
-	logWithGID(fmt.Sprintf("Executed statement: %d", stmtKey))
-	return result, nil
+	ph.logger().Debug("executed statement", "stmt", stmtKey)
+	return ph.mapResult(result, false)
 
 	/*
 	   // 1. Retrieve the prepared statement from the context
@@ -493,6 +950,10 @@ func (ph *ProxyHandler) HandleStmtExecute(context interface{}, query string, arg
 
 func (ph *ProxyHandler) HandleStmtClose(context interface{}) error {
 	//log.Println("HandleStmtClose called with context:", context)
+	if stmtKey, ok := context.(uint32); ok {
+		ph.captureCommand(capture.TypeClose, time.Now(), "", stmtKey, nil, nil, nil)
+	}
+
 	ctx, ok := context.(*Transaction) // Type assertion to *client.Stmt
 	if !ok {
 		return fmt.Errorf("invalid context: expected *Transaction")
@@ -505,7 +966,10 @@ func (ph *ProxyHandler) HandleStmtClose(context interface{}) error {
 }
 
 func (ph *ProxyHandler) HandleOtherCommand(cmd byte, data []byte) error {
-	log.Printf("HandleOtherCommand called with cmd: %d and data: %v\n", cmd, data)
+	ph.logger().Debug("HandleOtherCommand called", "cmd", cmd, "bytes", len(data))
+	if cmd == mysql.COM_PROCESS_KILL {
+		return ph.handleProcessKill(data)
+	}
 	// Your implementation to handle other commands
 	return nil
 }
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+)
+
+type CacheRuleConfig struct {
+	Name      string   `yaml:"name"`
+	Users     []string `yaml:"users"`     // proxy users, empty matches everyone
+	Databases []string `yaml:"databases"` // current database
+	Tables    []string `yaml:"tables"`    // table or database.table
+	Digests   []string `yaml:"digests"`   // digests produced by QueryDigest
+	Pattern   string   `yaml:"pattern"`   // regular expression matched against the query
+	TTL       int      `yaml:"ttl"`       // seconds to cache matching results, 0 disables caching
+}
+
+type CacheConfig struct {
+	Enabled    bool              `yaml:"enabled"`
+	MaxMemory  int64             `yaml:"max_memory"`  // bytes of result data to keep
+	DefaultTTL int               `yaml:"default_ttl"` // seconds for queries that match no rule, 0 caches only rule matches
+	MaxRows    int               `yaml:"max_rows"`    // results with more rows are not cached
+	Rules      []CacheRuleConfig `yaml:"rules"`
+}
+
+// QueryCache is an in-memory LRU cache of read query results. Entries expire
+// after the TTL of the rule that admitted them and are invalidated when a
+// write touches one of the tables they read from.
+type QueryCache struct {
+	config *CacheConfig
+	rules  []*CacheRule
+
+	mu      sync.Mutex
+	lru     *list.List                          // front is most recently used
+	entries map[string]*list.Element            // cache key -> element holding *cacheEntry
+	tables  map[string]map[*cacheEntry]struct{} // table -> entries reading from it
+	memory  int64
+
+	stats CacheStats
+}
+
+type CacheStats struct {
+	Hits          uint64
+	Misses        uint64
+	Stores        uint64
+	Evictions     uint64
+	Expirations   uint64
+	Invalidations uint64
+}
+
+type CacheRule struct {
+	config    *CacheRuleConfig
+	users     map[string]bool
+	databases map[string]bool
+	tables    map[string]bool
+	digests   map[string]bool
+	pattern   *regexp.Regexp
+}
+
+type cacheEntry struct {
+	key     string
+	result  *mysql.Result
+	tables  []string
+	size    int64
+	expires time.Time
+}
+
+// the query and session properties a cached result is looked up by
+type CacheRequest struct {
+	User     string
+	Database string
+	Query    string
+	Tables   []string // database.table names the query reads from
+	TTL      time.Duration
+}
+
+// queries whose results depend on more than the data they read
+var uncacheableRe = regexp.MustCompile(`(?i)\b(now|sysdate|curdate|curtime|current_timestamp|current_date|current_time|localtime|localtimestamp|unix_timestamp|utc_timestamp|rand|uuid|uuid_short|connection_id|last_insert_id|found_rows|row_count|user|current_user|session_user|system_user|database|schema|sleep|get_lock|release_lock|is_free_lock|is_used_lock)\s*\(|@|\bfor\s+update\b|\bfor\s+share\b|\block\s+in\s+share\s+mode\b|\bsql_no_cache\b|\binto\s+(outfile|dumpfile|@)`)
+
+func NewQueryCache(config *CacheConfig) (*QueryCache, error) {
+	if config.MaxMemory <= 0 {
+		config.MaxMemory = 64 * 1024 * 1024
+	}
+	if config.MaxRows <= 0 {
+		config.MaxRows = 10000
+	}
+
+	qc := &QueryCache{
+		config:  config,
+		rules:   make([]*CacheRule, 0, len(config.Rules)),
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+		tables:  make(map[string]map[*cacheEntry]struct{}),
+	}
+
+	for i := range config.Rules {
+		ruleConfig := &config.Rules[i]
+		rule := &CacheRule{
+			config:    ruleConfig,
+			databases: toSet(ruleConfig.Databases, false),
+			tables:    toSet(ruleConfig.Tables, false),
+			digests:   toSet(ruleConfig.Digests, false),
+		}
+		if len(ruleConfig.Users) > 0 {
+			rule.users = make(map[string]bool, len(ruleConfig.Users))
+			for _, user := range ruleConfig.Users {
+				rule.users[user] = true
+			}
+		}
+		if ruleConfig.Pattern != "" {
+			re, err := regexp.Compile(ruleConfig.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("cache: rule %d (%s): invalid pattern: %w", i, ruleConfig.Name, err)
+			}
+			rule.pattern = re
+		}
+		qc.rules = append(qc.rules, rule)
+	}
+
+	return qc, nil
+}
+
+func cacheKey(req *CacheRequest) string {
+	return req.User + "\x00" + req.Database + "\x00" + strings.TrimSpace(req.Query)
+}
+
+// qualifyTables prefixes unqualified table names with the current database
+func qualifyTables(database string, tables []string) []string {
+	qualified := make([]string, 0, len(tables))
+	for _, table := range tables {
+		table = strings.ToLower(table)
+		if !strings.Contains(table, ".") {
+			table = strings.ToLower(database) + "." + table
+		}
+		qualified = append(qualified, table)
+	}
+	return qualified
+}
+
+// ttl returns how long the result of the query may be cached, 0 when it
+// must not be cached at all
+func (qc *QueryCache) ttl(req *CacheRequest) time.Duration {
+	var digest string
+
+	for _, rule := range qc.rules {
+		if rule.users != nil && !rule.users[req.User] {
+			continue
+		}
+		if rule.databases != nil && !rule.databases[strings.ToLower(req.Database)] {
+			continue
+		}
+		if rule.tables != nil && !rule.matchTables(req.Tables) {
+			continue
+		}
+		if rule.digests != nil {
+			if digest == "" {
+				digest = QueryDigest(req.Query)
+			}
+			if !rule.digests[digest] {
+				continue
+			}
+		}
+		if rule.pattern != nil && !rule.pattern.MatchString(req.Query) {
+			continue
+		}
+		return time.Duration(rule.config.TTL) * time.Second
+	}
+
+	return time.Duration(qc.config.DefaultTTL) * time.Second
+}
+
+func (rule *CacheRule) matchTables(tables []string) bool {
+	for _, table := range tables {
+		if rule.tables[table] {
+			return true
+		}
+		if idx := strings.LastIndex(table, "."); idx >= 0 && rule.tables[table[idx+1:]] {
+			return true
+		}
+	}
+	return false
+}
+
+// NewRequest returns the cache request for a query, or nil when the query
+// is not a single deterministic SELECT or no rule allows caching it
+func (qc *QueryCache) NewRequest(user string, database string, query string) *CacheRequest {
+	if qc == nil || !qc.config.Enabled {
+		return nil
+	}
+
+	stmts := splitAndProcessStatements(query, "8.0.33")
+	if len(stmts) != 1 {
+		return nil
+	}
+	tokens := Tokenize(stmts[0])
+	if len(tokens) == 0 || strings.ToUpper(tokens[0]) != "SELECT" {
+		return nil
+	}
+	if uncacheableRe.MatchString(stmts[0]) {
+		return nil
+	}
+	tables := extractTables(tokens)
+	if len(tables) == 0 {
+		return nil
+	}
+
+	req := &CacheRequest{
+		User:     user,
+		Database: database,
+		Query:    query,
+		Tables:   qualifyTables(database, tables),
+	}
+	req.TTL = qc.ttl(req)
+	if req.TTL <= 0 {
+		return nil
+	}
+
+	return req
+}
+
+// Get returns a cached result for the query, or nil on a miss
+func (qc *QueryCache) Get(req *CacheRequest) *mysql.Result {
+	if qc == nil || !qc.config.Enabled {
+		return nil
+	}
+
+	key := cacheKey(req)
+
+	qc.mu.Lock()
+	defer qc.mu.Unlock()
+
+	elem, ok := qc.entries[key]
+	if !ok {
+		qc.stats.Misses++
+		return nil
+	}
+
+	entry := elem.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		qc.remove(elem)
+		qc.stats.Expirations++
+		qc.stats.Misses++
+		return nil
+	}
+
+	qc.lru.MoveToFront(elem)
+	qc.stats.Hits++
+
+	return entry.result
+}
+
+// Put stores the result of a read query if a rule (or the default TTL)
+// allows caching it
+func (qc *QueryCache) Put(req *CacheRequest, res *mysql.Result) {
+	if qc == nil || !qc.config.Enabled || res == nil || res.Resultset == nil {
+		return
+	}
+	if res.RowNumber() > qc.config.MaxRows {
+		return
+	}
+
+	entry := &cacheEntry{
+		key:     cacheKey(req),
+		result:  res,
+		tables:  req.Tables,
+		size:    resultSize(res) + int64(len(req.Query)),
+		expires: time.Now().Add(req.TTL),
+	}
+	if entry.size > qc.config.MaxMemory {
+		return
+	}
+
+	qc.mu.Lock()
+	defer qc.mu.Unlock()
+
+	if elem, ok := qc.entries[entry.key]; ok {
+		qc.remove(elem)
+	}
+
+	elem := qc.lru.PushFront(entry)
+	qc.entries[entry.key] = elem
+	qc.memory += entry.size
+	for _, table := range entry.tables {
+		set, ok := qc.tables[table]
+		if !ok {
+			set = make(map[*cacheEntry]struct{})
+			qc.tables[table] = set
+		}
+		set[entry] = struct{}{}
+	}
+	qc.stats.Stores++
+
+	// evict least recently used entries until we are within the memory cap
+	for qc.memory > qc.config.MaxMemory {
+		oldest := qc.lru.Back()
+		if oldest == nil {
+			break
+		}
+		qc.remove(oldest)
+		qc.stats.Evictions++
+	}
+}
+
+// remove must be called with the lock held
+func (qc *QueryCache) remove(elem *list.Element) {
+	entry := elem.Value.(*cacheEntry)
+	qc.lru.Remove(elem)
+	delete(qc.entries, entry.key)
+	qc.memory -= entry.size
+	for _, table := range entry.tables {
+		if set, ok := qc.tables[table]; ok {
+			delete(set, entry)
+			if len(set) == 0 {
+				delete(qc.tables, table)
+			}
+		}
+	}
+}
+
+// InvalidateTables drops every cached result that read from one of the
+// given fully qualified (database.table) tables
+func (qc *QueryCache) InvalidateTables(tables []string) {
+	if qc == nil || !qc.config.Enabled {
+		return
+	}
+
+	qc.mu.Lock()
+	defer qc.mu.Unlock()
+
+	for _, table := range tables {
+		for entry := range qc.tables[strings.ToLower(table)] {
+			if elem, ok := qc.entries[entry.key]; ok {
+				qc.remove(elem)
+				qc.stats.Invalidations++
+			}
+		}
+	}
+}
+
+// InvalidateDatabase drops every cached result that read from the database
+func (qc *QueryCache) InvalidateDatabase(database string) {
+	if qc == nil || !qc.config.Enabled {
+		return
+	}
+
+	prefix := strings.ToLower(database) + "."
+
+	qc.mu.Lock()
+	tables := make([]string, 0)
+	for table := range qc.tables {
+		if strings.HasPrefix(table, prefix) {
+			tables = append(tables, table)
+		}
+	}
+	qc.mu.Unlock()
+
+	qc.InvalidateTables(tables)
+}
+
+// InvalidateAll empties the cache
+func (qc *QueryCache) InvalidateAll() {
+	if qc == nil || !qc.config.Enabled {
+		return
+	}
+
+	qc.mu.Lock()
+	defer qc.mu.Unlock()
+
+	qc.stats.Invalidations += uint64(qc.lru.Len())
+	qc.lru.Init()
+	qc.entries = make(map[string]*list.Element)
+	qc.tables = make(map[string]map[*cacheEntry]struct{})
+	qc.memory = 0
+}
+
+// InvalidateForWrite drops the cached results affected by a write query
+// executed in the given database
+func (qc *QueryCache) InvalidateForWrite(database string, query string) {
+	if qc == nil || !qc.config.Enabled {
+		return
+	}
+
+	for _, stmt := range splitAndProcessStatements(query, "8.0.33") {
+		tokens := Tokenize(stmt)
+		if len(tokens) == 0 {
+			continue
+		}
+		cmd, err := parseStatement(tokens)
+		if err != nil {
+			continue
+		}
+
+		switch cmd {
+		case Insert, Update, Delete, Create, Alter, Drop, Truncate, Rename:
+		default:
+			continue
+		}
+
+		// DROP DATABASE and statements we cannot attribute to a table
+		if cmd == Drop && len(tokens) > 1 && (strings.ToUpper(tokens[1]) == "DATABASE" || strings.ToUpper(tokens[1]) == "SCHEMA") {
+			if len(tokens) > 2 {
+				qc.InvalidateDatabase(unquoteIdentifier(tokens[len(tokens)-1]))
+			}
+			continue
+		}
+		tables := extractTables(tokens)
+		if len(tables) == 0 {
+			qc.InvalidateAll()
+			return
+		}
+		qc.InvalidateTables(qualifyTables(database, tables))
+	}
+}
+
+// Stats returns a snapshot of the cache statistics along with the current
+// number of entries and bytes used
+func (qc *QueryCache) Stats() (CacheStats, int, int64) {
+	qc.mu.Lock()
+	defer qc.mu.Unlock()
+	return qc.stats, qc.lru.Len(), qc.memory
+}
+
+// resultSize estimates the memory held by a result set
+func resultSize(res *mysql.Result) int64 {
+	var size int64
+	for _, row := range res.RowDatas {
+		size += int64(len(row))
+	}
+	for _, field := range res.Fields {
+		size += int64(len(field.Name)+len(field.OrgName)+len(field.Table)+len(field.OrgTable)+len(field.Schema)) + 64
+	}
+	// parsed values are kept alongside the raw rows
+	return size * 2
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-mysql-org/go-mysql/client"
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/server"
+)
+
+// testBackend is a MySQL server that records the queries it is sent and
+// answers each with an OK packet
+type testBackend struct {
+	server.EmptyHandler
+
+	mu      sync.Mutex
+	queries []string
+}
+
+func (b *testBackend) HandleQuery(query string) (*mysql.Result, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.queries = append(b.queries, query)
+	return mysql.NewResult(nil), nil
+}
+
+// startTestBackend serves b on a local port and returns a client connected to it
+func startTestBackend(t *testing.T, b *testBackend) *client.Conn {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn, err := server.NewConn(c, "root", "", b)
+				if err != nil {
+					return
+				}
+				for !conn.Closed() {
+					if err := conn.HandleCommand(); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	conn, err := client.Connect(l.Addr().String(), "root", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestTaggedWriteInvalidatesCache(t *testing.T) {
+	cache, err := NewQueryCache(&CacheConfig{Enabled: true, DefaultTTL: 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := &testBackend{}
+	ph := &ProxyHandler{
+		p:            &Proxy{config: &Config{}, cache: cache},
+		session:      NewSessionVariables(),
+		databaseName: "app",
+		write_conn:   startTestBackend(t, backend),
+	}
+	if err := ph.session.Set("query_tag", "billing"); err != nil {
+		t.Fatal(err)
+	}
+
+	req := &CacheRequest{Database: "app", Query: "SELECT * FROM users", Tables: []string{"app.users"}, TTL: time.Minute}
+	cache.Put(req, &mysql.Result{Resultset: &mysql.Resultset{}})
+	if cache.Get(req) == nil {
+		t.Fatal("result was not cached")
+	}
+
+	if _, err := ph.ExecuteWriteQuery("UPDATE users SET name = 'x' WHERE id = 1"); err != nil {
+		t.Fatal(err)
+	}
+	if len(backend.queries) != 1 || !strings.HasPrefix(backend.queries[0], "/* query_tag=billing */ UPDATE") {
+		t.Errorf("backend got %q, want the tagged update", backend.queries)
+	}
+	if cache.Get(req) != nil {
+		t.Error("tagged write left the cached result of the table it updated")
+	}
+}
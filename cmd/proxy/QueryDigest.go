@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"unicode"
+)
+
+// NormalizeQuery reduces a query to its fingerprint form: comments are
+// removed, string and numeric literals are replaced with '?', whitespace is
+// collapsed, keywords and identifiers are lowercased and IN lists are folded
+// so that queries differing only by their values normalize to the same text.
+func NormalizeQuery(query string) string {
+	var out strings.Builder
+	runes := []rune(strings.TrimSpace(query))
+	n := len(runes)
+
+	lastSpace := true
+	writeSpace := func() {
+		if !lastSpace {
+			out.WriteRune(' ')
+			lastSpace = true
+		}
+	}
+	writeRune := func(r rune) {
+		out.WriteRune(r)
+		lastSpace = false
+	}
+
+	for i := 0; i < n; i++ {
+		char := runes[i]
+
+		switch {
+		// -- and # comments run to the end of the line
+		case char == '#' || (char == '-' && i+2 < n && runes[i+1] == '-' && unicode.IsSpace(runes[i+2])):
+			for i < n && runes[i] != '\n' {
+				i++
+			}
+			writeSpace()
+
+		// /* */ comments, version comments /*!NNNNN ... */ are kept verbatim
+		// because they change the meaning of the statement
+		case char == '/' && i+1 < n && runes[i+1] == '*':
+			end := i + 2
+			for end+1 < n && !(runes[end] == '*' && runes[end+1] == '/') {
+				end++
+			}
+			if i+2 < n && runes[i+2] == '!' {
+				for j := i; j < n && j <= end+1; j++ {
+					writeRune(unicode.ToLower(runes[j]))
+				}
+			} else {
+				writeSpace()
+			}
+			i = end + 1
+
+		case char == '\'' || char == '"':
+			quote := char
+			i++
+			for i < n {
+				if runes[i] == '\\' {
+					i += 2
+					continue
+				}
+				if runes[i] == quote {
+					// a doubled quote is an escaped quote inside the literal
+					if i+1 < n && runes[i+1] == quote {
+						i += 2
+						continue
+					}
+					break
+				}
+				i++
+			}
+			writeRune('?')
+
+		case char == '`':
+			// quoted identifiers keep their name
+			i++
+			for i < n && runes[i] != '`' {
+				writeRune(unicode.ToLower(runes[i]))
+				i++
+			}
+
+		case unicode.IsDigit(char) && (i == 0 || !isIdentifierRune(runes[i-1])):
+			for i+1 < n && (isIdentifierRune(runes[i+1]) || runes[i+1] == '.') {
+				i++
+			}
+			writeRune('?')
+
+		case unicode.IsSpace(char):
+			writeSpace()
+
+		default:
+			writeRune(unicode.ToLower(char))
+		}
+	}
+
+	normalized := strings.TrimSpace(out.String())
+	normalized = strings.TrimSuffix(normalized, ";")
+	normalized = strings.TrimSpace(normalized)
+
+	return foldValueLists(normalized)
+}
+
+func isIdentifierRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '$'
+}
+
+// foldValueLists turns "in (?, ?, ?)" into "in (...)" and multi-row
+// "values (?, ?), (?, ?)" into "values (...)"
+func foldValueLists(query string) string {
+	var out strings.Builder
+	i := 0
+	for i < len(query) {
+		if query[i] != '(' {
+			out.WriteByte(query[i])
+			i++
+			continue
+		}
+
+		// find the matching parenthesis and check that it only holds placeholders
+		j := i + 1
+		onlyPlaceholders := true
+		for j < len(query) && query[j] != ')' {
+			if query[j] != '?' && query[j] != ',' && query[j] != ' ' {
+				onlyPlaceholders = false
+				break
+			}
+			j++
+		}
+		if !onlyPlaceholders || j >= len(query) {
+			out.WriteByte(query[i])
+			i++
+			continue
+		}
+
+		out.WriteString("(...)")
+		i = j + 1
+
+		// swallow any repeated value groups: , (?, ?)
+		for {
+			k := i
+			for k < len(query) && (query[k] == ' ' || query[k] == ',') {
+				k++
+			}
+			if k >= len(query) || query[k] != '(' || k == i {
+				break
+			}
+			m := k + 1
+			for m < len(query) && (query[m] == '?' || query[m] == ',' || query[m] == ' ') {
+				m++
+			}
+			if m >= len(query) || query[m] != ')' {
+				break
+			}
+			i = m + 1
+		}
+	}
+	return out.String()
+}
+
+// QueryDigest returns a short stable identifier for the normalized form of the query
+func QueryDigest(query string) string {
+	return DigestNormalized(NormalizeQuery(query))
+}
+
+// DigestNormalized hashes an already normalized query
+func DigestNormalized(normalized string) string {
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:8])
+}
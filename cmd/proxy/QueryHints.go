@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	RoutePrimary = "primary"
+	RouteReplica = "replica"
+
+	ConsistencyStrong   = "strong"
+	ConsistencyEventual = "eventual"
+)
+
+// QueryHints holds the routing instructions an application embedded in a
+// statement with a comment such as /* dbinsight: route=primary timeout=500ms */
+type QueryHints struct {
+	Route        string        // primary or replica
+	ReplicaGroup string        // only use replicas from this group
+	Timeout      time.Duration // maximum execution time of the statement
+	Consistency  string        // strong reads are sent to the primary
+}
+
+var hintCommentRe = regexp.MustCompile(`(?is)^/\*\s*dbinsight\s*:(.*)\*/$`)
+
+// hintComments returns the start and end of the dbinsight hint comments in
+// the query, comments inside string literals and quoted identifiers are
+// values and not hints
+func hintComments(query string) [][2]int {
+	var comments [][2]int
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case c == '\'' || c == '"':
+			i = quotedEnd(query, i) - 1
+		case c == '`':
+			end := strings.IndexByte(query[i+1:], '`')
+			if end < 0 {
+				return comments
+			}
+			i += end + 1
+		case c == '#' || (c == '-' && i+2 < len(query) && query[i+1] == '-' && (query[i+2] == ' ' || query[i+2] == '\t')):
+			end := strings.IndexByte(query[i:], '\n')
+			if end < 0 {
+				return comments
+			}
+			i += end
+		case c == '/' && i+1 < len(query) && query[i+1] == '*':
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				return comments
+			}
+			end += i + 4
+			if hintCommentRe.MatchString(query[i:end]) {
+				comments = append(comments, [2]int{i, end})
+			}
+			i = end - 1
+		}
+	}
+	return comments
+}
+
+// extractQueryHints parses every dbinsight hint comment in the query and
+// returns the query with the comments removed. Hints is nil when the query
+// contains no hint comments.
+func extractQueryHints(query string) (string, *QueryHints, error) {
+	comments := hintComments(query)
+	if comments == nil {
+		return query, nil, nil
+	}
+
+	hints := &QueryHints{}
+	var stripped strings.Builder
+	last := 0
+	for _, comment := range comments {
+		stripped.WriteString(query[last:comment[0]])
+		stripped.WriteByte(' ')
+		last = comment[1]
+
+		match := hintCommentRe.FindStringSubmatch(query[comment[0]:comment[1]])
+		fields := strings.FieldsFunc(match[1], func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t' || r == '\n' || r == '\r'
+		})
+		for _, field := range fields {
+			key, value, ok := strings.Cut(field, "=")
+			if !ok {
+				return query, nil, fmt.Errorf("invalid dbinsight hint: %s", field)
+			}
+			key = strings.ToLower(strings.TrimSpace(key))
+			value = strings.Trim(strings.TrimSpace(value), `'"`)
+
+			switch key {
+			case "route":
+				value = strings.ToLower(value)
+				if value != RoutePrimary && value != RouteReplica {
+					return query, nil, fmt.Errorf("invalid dbinsight route hint: %s", value)
+				}
+				hints.Route = value
+			case "replica_group":
+				hints.ReplicaGroup = value
+			case "timeout":
+				timeout, err := time.ParseDuration(value)
+				if err != nil || timeout <= 0 {
+					return query, nil, fmt.Errorf("invalid dbinsight timeout hint: %s", value)
+				}
+				hints.Timeout = timeout
+			case "consistency":
+				value = strings.ToLower(value)
+				if value != ConsistencyStrong && value != ConsistencyEventual {
+					return query, nil, fmt.Errorf("invalid dbinsight consistency hint: %s", value)
+				}
+				hints.Consistency = value
+			default:
+				return query, nil, fmt.Errorf("unknown dbinsight hint: %s", key)
+			}
+		}
+	}
+
+	stripped.WriteString(query[last:])
+
+	return strings.TrimSpace(stripped.String()), hints, nil
+}
+
+// wantsPrimary reports whether reads carrying these hints must go to the primary
+func (hints *QueryHints) wantsPrimary() bool {
+	return hints != nil && (hints.Route == RoutePrimary || hints.Consistency == ConsistencyStrong)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+)
+
+type CoalesceConfig struct {
+	Enabled bool `yaml:"enabled"`
+}
+
+// coalescedRead is a read query in flight that other sessions can wait on
+type coalescedRead struct {
+	done chan struct{}
+	res  *mysql.Result
+	err  error
+}
+
+// ReadCoalescer lets sessions that send the same read query at the same time
+// share a single backend execution. Results are shared between sessions,
+// which is safe since writing a result set to a client does not modify it.
+type ReadCoalescer struct {
+	config *CoalesceConfig
+
+	mu       sync.Mutex
+	inflight map[string]*coalescedRead
+}
+
+func NewReadCoalescer(config *CoalesceConfig) *ReadCoalescer {
+	return &ReadCoalescer{
+		config:   config,
+		inflight: make(map[string]*coalescedRead),
+	}
+}
+
+// Do runs fn unless an identical read is already running, in which case it
+// waits for that one and returns its result. shared reports whether the
+// result came from another session.
+func (rc *ReadCoalescer) Do(key string, fn func() (*mysql.Result, error)) (res *mysql.Result, shared bool, err error) {
+	rc.mu.Lock()
+	if call, ok := rc.inflight[key]; ok {
+		rc.mu.Unlock()
+		<-call.done
+		return call.res, true, call.err
+	}
+	call := &coalescedRead{done: make(chan struct{})}
+	rc.inflight[key] = call
+	rc.mu.Unlock()
+
+	defer func() {
+		rc.mu.Lock()
+		delete(rc.inflight, key)
+		rc.mu.Unlock()
+		close(call.done)
+	}()
+
+	call.res, call.err = fn()
+	return call.res, false, call.err
+}
+
+// coalesceKey returns the key identical reads share, or "" when the query
+// must run on its own. The key covers the user, so sessions never see rows
+// their privileges would not return, and the database and routing target,
+// so unqualified tables and replica groups resolve the same way.
+func (ph *ProxyHandler) coalesceKey(query string) string {
+	if !ph.p.coalescer.config.Enabled || ph.inTransaction {
+		return ""
+	}
+	if uncacheableRe.MatchString(query) {
+		return ""
+	}
+
+	decision := ph.routeRead()
+	if decision.Target == RoutePrimary {
+		// reads routed to the primary want to see their own writes
+		return ""
+	}
+
+	return ph.backendUser + "\x00" + ph.databaseName + "\x00" + decision.Target + "\x00" + decision.Group + "\x00" + query
+}
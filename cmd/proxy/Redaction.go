@@ -0,0 +1,479 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+const (
+	RedactionModeOff         = "off"
+	RedactionModePlaceholder = "placeholder"
+	RedactionModeHash        = "hash"
+)
+
+type RedactionConfig struct {
+	Mode        string   `yaml:"mode"`         // placeholder (default), hash or off
+	Salt        string   `yaml:"salt"`         // mixed into hashes so they cannot be looked up
+	ShowColumns []string `yaml:"show_columns"` // column or table.column whose values stay visible
+	ShowTables  []string `yaml:"show_tables"`  // statements on these tables are logged as sent
+}
+
+// Redactor removes literal values and prepared statement arguments from
+// everything the proxy logs, so customer data never ends up in log files.
+// Literals become ? or, in hash mode, a salted hash so equal values can
+// still be told apart. Values compared with or inserted into an opted in
+// column stay visible for debugging.
+type Redactor struct {
+	config  *RedactionConfig
+	columns map[string]bool // lower case column or table.column
+	tables  map[string]bool // lower case table or database.table
+}
+
+func NewRedactor(config *RedactionConfig) (*Redactor, error) {
+	if config.Mode == "" {
+		config.Mode = RedactionModePlaceholder
+	}
+	switch config.Mode {
+	case RedactionModeOff, RedactionModePlaceholder, RedactionModeHash:
+	default:
+		return nil, fmt.Errorf("redaction: unknown mode: %s", config.Mode)
+	}
+
+	r := &Redactor{
+		config:  config,
+		columns: make(map[string]bool),
+		tables:  make(map[string]bool),
+	}
+	for _, column := range config.ShowColumns {
+		r.columns[strings.ToLower(unquoteIdentifier(column))] = true
+	}
+	for _, table := range config.ShowTables {
+		r.tables[strings.ToLower(unquoteIdentifier(table))] = true
+	}
+	return r, nil
+}
+
+func (r *Redactor) enabled() bool {
+	return r != nil && r.config.Mode != RedactionModeOff
+}
+
+// replacement returns what a literal is logged as
+func (r *Redactor) replacement(value string) string {
+	if r.config.Mode == RedactionModeHash {
+		sum := sha256.Sum256([]byte(r.config.Salt + value))
+		return "?:" + hex.EncodeToString(sum[:4])
+	}
+	return "?"
+}
+
+// showsTables reports whether the query touches a table whose statements
+// are logged as sent
+func (r *Redactor) showsTables(query string) bool {
+	if len(r.tables) == 0 {
+		return false
+	}
+	for _, table := range extractTables(Tokenize(query)) {
+		table = strings.ToLower(table)
+		if r.tables[table] {
+			return true
+		}
+		if _, name, ok := strings.Cut(table, "."); ok && r.tables[name] {
+			return true
+		}
+	}
+	return false
+}
+
+// showsColumn reports whether values of the column, as the query names it,
+// stay visible
+func (r *Redactor) showsColumn(column string, query string) bool {
+	if column == "" || len(r.columns) == 0 {
+		return false
+	}
+	if r.columns[column] {
+		return true
+	}
+
+	// t.c against a table.column rule only checks the column name since t
+	// may be an alias, the table must be in the statement
+	name := column
+	if i := strings.LastIndexByte(column, '.'); i >= 0 {
+		name = column[i+1:]
+	}
+	for rule := range r.columns {
+		table, ruleColumn, ok := strings.Cut(rule, ".")
+		if !ok || ruleColumn != name {
+			continue
+		}
+		for _, t := range extractTables(Tokenize(query)) {
+			t = strings.ToLower(t)
+			if t == table || strings.HasSuffix(t, "."+table) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// keywords that keep the column a following literal is compared with
+var redactionComparisonKeywords = map[string]bool{
+	"in": true, "not": true, "like": true, "between": true, "is": true, "regexp": true, "rlike": true,
+}
+
+// scanLiterals walks the query and calls literal for every string, number and
+// ? placeholder with the column it is compared with or inserted into, when
+// that can be told. The returned query has each literal replaced by what
+// literal returned. The contents of /*! */ comments the server runs are
+// scanned like the rest of the query, other comments are kept as they are
+// with keepComments and emptied otherwise.
+func scanLiterals(query string, keepComments bool, literal func(column string, text string) string) string {
+	var out strings.Builder
+	out.Grow(len(query))
+
+	column := ""     // column the next literal belongs to
+	prevWord := ""   // previous keyword or identifier, lower case
+	between := false // the AND of BETWEEN x AND y keeps the column
+	listDepth := -1  // depth of an IN (...) list, its commas keep the column
+	depth := 0
+	versioned := false // inside an executed /*! */ comment
+
+	// INSERT INTO t (a, b) VALUES (...) maps values to columns by position
+	trimmed := strings.ToLower(strings.TrimSpace(query))
+	isInsert := strings.HasPrefix(trimmed, "insert") || strings.HasPrefix(trimmed, "replace")
+	insertColumns := []string(nil)
+	collecting := false // reading the column list
+	inValues := false
+	field := 0
+
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case c == '\'' || c == '"':
+			j := quotedEnd(query, i)
+			out.WriteString(literal(valueColumn(column, inValues, depth, insertColumns, field), query[i:j]))
+			prevWord = "?"
+			i = j
+			continue
+
+		case (c == '-' || c == '+') && isUnarySign(prevWord) && signedLiteralEnd(query, i) > 0:
+			// the sign belongs to the literal, -123 is one value
+			j := signedLiteralEnd(query, i)
+			out.WriteString(literal(valueColumn(column, inValues, depth, insertColumns, field), query[i:j]))
+			prevWord = "?"
+			i = j
+			continue
+
+		case versioned && c == '*' && i+1 < len(query) && query[i+1] == '/':
+			out.WriteString("*/")
+			versioned = false
+			i += 2
+			continue
+
+		case c == '/' && i+1 < len(query) && query[i+1] == '*':
+			if j, ok := executedComment(query, i); ok {
+				out.WriteString(query[i:j])
+				versioned = true
+				i = j
+				continue
+			}
+			end := strings.Index(query[i+2:], "*/")
+			j := len(query)
+			if end >= 0 {
+				j = i + 2 + end + 2
+			}
+			// comments may hold anything
+			if keepComments {
+				out.WriteString(query[i:j])
+			} else {
+				out.WriteString("/* */")
+			}
+			i = j
+			continue
+
+		case c == '#' || (c == '-' && i+2 < len(query) && query[i+1] == '-' && (query[i+2] == ' ' || query[i+2] == '\t')):
+			end := strings.IndexByte(query[i:], '\n')
+			if end < 0 {
+				end = len(query) - i
+			}
+			if keepComments {
+				out.WriteString(query[i : i+end])
+			}
+			i += end
+			continue
+
+		case c == '?' || (c >= '0' && c <= '9') || (c == '.' && i+1 < len(query) && query[i+1] >= '0' && query[i+1] <= '9'):
+			j := i + 1
+			if c != '?' {
+				for j < len(query) && (isIdentifierByte(query[j]) || query[j] == '.') {
+					j++
+				}
+			}
+			out.WriteString(literal(valueColumn(column, inValues, depth, insertColumns, field), query[i:j]))
+			prevWord = "?"
+			i = j
+			continue
+
+		case c == '`' || isIdentifierByte(c):
+			// identifiers, possibly qualified, and keywords
+			j := i
+			for j < len(query) {
+				if query[j] == '`' {
+					end := strings.IndexByte(query[j+1:], '`')
+					if end < 0 {
+						j = len(query)
+						break
+					}
+					j += end + 2
+				} else if isIdentifierByte(query[j]) || query[j] == '.' {
+					j++
+				} else {
+					break
+				}
+			}
+			word := query[i:j]
+
+			// charset introducers and N'', X'', B'' belong to the literal
+			if j < len(query) && (query[j] == '\'' || query[j] == '"') && isLiteralPrefix(word) {
+				j = quotedEnd(query, j)
+				out.WriteString(literal(valueColumn(column, inValues, depth, insertColumns, field), query[i:j]))
+				prevWord = "?"
+				i = j
+				continue
+			}
+
+			out.WriteString(word)
+			i = j
+
+			lower := strings.ToLower(strings.ReplaceAll(word, "`", ""))
+			if inValues && depth == 0 {
+				// ON DUPLICATE KEY UPDATE ... follows the rows
+				inValues = false
+			}
+			switch {
+			case collecting:
+				insertColumns = append(insertColumns, lower)
+			case lower == "values" || lower == "value":
+				// without a column list the values have no known column
+				inValues = insertColumns != nil
+				field = 0
+				column = ""
+			case redactionComparisonKeywords[lower]:
+				between = between || lower == "between"
+			case lower == "and" && between:
+				between = false
+			case isRedactionKeyword(lower):
+				column = ""
+			default:
+				column = lower
+			}
+			prevWord = lower
+			continue
+
+		case c == '(':
+			depth++
+			if prevWord == "in" && column != "" {
+				listDepth = depth
+			}
+			if isInsert && insertColumns == nil && depth == 1 && prevWord != "values" && prevWord != "value" {
+				collecting = true
+				insertColumns = []string{}
+			}
+		case c == ')':
+			if depth == listDepth {
+				listDepth = -1
+				column = ""
+			}
+			depth--
+			collecting = false
+		case c == ',':
+			if inValues && depth == 1 {
+				field++
+			} else if depth != listDepth {
+				column = ""
+			}
+		case c == '=' || c == '<' || c == '>' || c == '!' || c == '-' || c == '+':
+			// comparisons and signs keep the column
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			out.WriteByte(c)
+			i++
+			continue
+		default:
+			column = ""
+		}
+
+		if c == '(' && inValues && depth == 1 {
+			field = 0
+		}
+		out.WriteByte(c)
+		prevWord = string(c)
+		i++
+	}
+
+	return out.String()
+}
+
+// isUnarySign reports whether a + or - following prevWord is the sign of
+// what comes next rather than an addition or subtraction
+func isUnarySign(prevWord string) bool {
+	if prevWord == "" || isRedactionKeyword(prevWord) || redactionComparisonKeywords[prevWord] {
+		return true
+	}
+	return len(prevWord) == 1 && strings.Contains("=<>!(,+-*/%&|^~", prevWord)
+}
+
+// signedLiteralEnd returns the end of the number or string following the
+// sign at query[i], 0 when something else follows
+func signedLiteralEnd(query string, i int) int {
+	j := i + 1
+	for j < len(query) && (query[j] == ' ' || query[j] == '\t' || query[j] == '\n' || query[j] == '\r') {
+		j++
+	}
+	switch {
+	case j >= len(query):
+		return 0
+	case query[j] == '\'' || query[j] == '"':
+		return quotedEnd(query, j)
+	case (query[j] >= '0' && query[j] <= '9') || (query[j] == '.' && j+1 < len(query) && query[j+1] >= '0' && query[j+1] <= '9'):
+		for j++; j < len(query) && (isIdentifierByte(query[j]) || query[j] == '.'); j++ {
+		}
+		return j
+	}
+	return 0
+}
+
+// quotedEnd returns the end of the quoted string starting at query[i]
+func quotedEnd(query string, i int) int {
+	c := query[i]
+	j := i + 1
+	for j < len(query) {
+		if query[j] == '\\' {
+			j += 2
+			continue
+		}
+		if query[j] == c {
+			if j+1 < len(query) && query[j+1] == c {
+				j += 2
+				continue
+			}
+			break
+		}
+		j++
+	}
+	return min(j+1, len(query))
+}
+
+// isLiteralPrefix reports whether a word directly in front of a quote is a
+// charset introducer (_utf8mb4'...') or the N, X or B of N'...', X'...'
+// and B'...'
+func isLiteralPrefix(word string) bool {
+	if strings.HasPrefix(word, "_") {
+		return len(word) > 1
+	}
+	switch strings.ToLower(word) {
+	case "n", "x", "b":
+		return true
+	}
+	return false
+}
+
+// splitLiteralPrefix splits a literal into its prefix, if any, and the
+// quoted string or number
+func splitLiteralPrefix(text string) (string, string) {
+	if i := strings.IndexAny(text, `'"`); i > 0 {
+		return text[:i], text[i:]
+	}
+	return "", text
+}
+
+// valueColumn returns the column a literal belongs to, the values of an
+// INSERT belong to their column only when they are not part of an expression
+func valueColumn(column string, inValues bool, depth int, insertColumns []string, field int) string {
+	if inValues && depth == 1 && field < len(insertColumns) {
+		return insertColumns[field]
+	}
+	return column
+}
+
+var redactionKeywords = map[string]bool{
+	"select": true, "from": true, "where": true, "and": true, "or": true, "xor": true, "set": true,
+	"update": true, "insert": true, "into": true, "delete": true, "limit": true, "offset": true,
+	"order": true, "group": true, "by": true, "having": true, "on": true, "join": true, "as": true,
+	"case": true, "when": true, "then": true, "else": true, "end": true, "interval": true,
+	"replace": true, "call": true, "do": true, "show": true, "duplicate": true, "key": true,
+}
+
+func isRedactionKeyword(word string) bool {
+	return redactionKeywords[word]
+}
+
+// Query returns the query with its literal values redacted
+func (r *Redactor) Query(query string) string {
+	if !r.enabled() || r.showsTables(query) {
+		return query
+	}
+	return scanLiterals(query, false, func(column string, text string) string {
+		if text == "?" || r.showsColumn(column, query) {
+			return text
+		}
+		_, text = splitLiteralPrefix(text)
+		return r.replacement(strings.Trim(text, `'"`))
+	})
+}
+
+// Args returns the prepared statement arguments as they may be logged
+func (r *Redactor) Args(query string, args []interface{}) string {
+	if !r.enabled() || r.showsTables(query) {
+		return fmt.Sprintf("%v", args)
+	}
+
+	// the column of each placeholder, in order
+	columns := make([]string, 0, len(args))
+	scanLiterals(query, false, func(column string, text string) string {
+		if text == "?" {
+			columns = append(columns, column)
+		}
+		return text
+	})
+
+	redacted := make([]string, len(args))
+	for i, arg := range args {
+		value := fmt.Sprintf("%v", arg)
+		if b, ok := arg.([]byte); ok {
+			value = string(b)
+		}
+		if arg == nil || (i < len(columns) && r.showsColumn(columns[i], query)) {
+			redacted[i] = value
+			continue
+		}
+		redacted[i] = r.replacement(value)
+	}
+	return "[" + strings.Join(redacted, " ") + "]"
+}
+
+// Error returns the error message with quoted values redacted, MySQL repeats
+// them in messages such as duplicate entry errors
+func (r *Redactor) Error(err error) string {
+	message := err.Error()
+	if !r.enabled() {
+		return message
+	}
+
+	var out strings.Builder
+	for {
+		start := strings.IndexByte(message, '\'')
+		if start < 0 {
+			break
+		}
+		end := strings.IndexByte(message[start+1:], '\'')
+		if end < 0 {
+			break
+		}
+		out.WriteString(message[:start])
+		out.WriteString("'" + r.replacement(message[start+1:start+1+end]) + "'")
+		message = message[start+1+end+1:]
+	}
+	out.WriteString(message)
+	return out.String()
+}
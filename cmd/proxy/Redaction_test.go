@@ -0,0 +1,105 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestScanLiterals(t *testing.T) {
+	tests := []struct {
+		query    string
+		literals string // column:literal of every literal, in order
+		out      string // the scanned query without kept comments, when it is not the query
+	}{
+		{"SELECT * FROM t WHERE a = 1 AND b = 'x'", "a:1 b:'x'", ""},
+		{"SELECT * FROM t WHERE 'x' = a", ":'x'", ""},
+		{"SELECT * FROM t WHERE a IN (1, 2)", "a:1 a:2", ""},
+		{"SELECT * FROM t WHERE a BETWEEN 1 AND 2", "a:1 a:2", ""},
+		{"SELECT * FROM t WHERE a LIKE 'x%'", "a:'x%'", ""},
+		{"UPDATE t SET a = 1, b = 'x' WHERE c = ?", "a:1 b:'x' c:?", ""},
+
+		// qualified and quoted columns
+		{"SELECT * FROM t WHERE t.ssn = '1'", "t.ssn:'1'", ""},
+		{"SELECT * FROM t WHERE `t`.`ssn` = '1'", "t.ssn:'1'", ""},
+
+		// string literals
+		{"SELECT * FROM t WHERE a = 'it''s'", "a:'it''s'", ""},
+		{`SELECT * FROM t WHERE a = 'x\'y'`, `a:'x\'y'`, ""},
+		{`SELECT * FROM t WHERE a = "x"`, `a:"x"`, ""},
+		{"SELECT * FROM t WHERE a = _utf8mb4'x'", "a:_utf8mb4'x'", ""},
+		{"SELECT * FROM t WHERE a = X'41' AND b = 0x41", "a:X'41' b:0x41", ""},
+		{"SELECT * FROM t WHERE a = N'x'", "a:N'x'", ""},
+		{"UPDATE t SET a = -1, b = 2-1, c = - 'x'", "a:-1 b:2 b:1 c:- 'x'", ""},
+		{"SELECT * FROM t WHERE a > -1.5 AND b IN (-1, +2)", "a:-1.5 b:-1 b:+2", ""},
+
+		// comments
+		{"SELECT 'a /* b */' /* 'c' */ FROM t", ":'a /* b */'", "SELECT 'a /* b */' /* */ FROM t"},
+		{"SELECT a FROM t -- 'd'", "", "SELECT a FROM t "},
+		{"SELECT a FROM t # 'd'\nWHERE b = 1", "b:1", "SELECT a FROM t \nWHERE b = 1"},
+		{"SELECT /*+ MAX_EXECUTION_TIME(5) */ a FROM t", "", "SELECT /* */ a FROM t"},
+		{"INSERT INTO t (a) VALUES /*!50000 ('x') */", "a:'x'", ""},
+		{"UPDATE t SET a = /*! 'x' */", "a:'x'", ""},
+		{"UPDATE t SET a = 1 /*!99999 , b = 'x' */", "a:1", "UPDATE t SET a = 1 /* */"},
+
+		// INSERT values belong to their column at the top level only
+		{"INSERT INTO t (a, b) VALUES (1, 'x'), (2, 'y')", "a:1 b:'x' a:2 b:'y'", ""},
+		{"INSERT INTO t (`a`, `b`) VALUES (1, 'x')", "a:1 b:'x'", ""},
+		{"INSERT INTO t (a, b) VALUES (CONCAT('x', 'y'), 'z')", "concat:'x' :'y' b:'z'", ""},
+		{"INSERT INTO t VALUES (1, 'x')", ":1 :'x'", ""},
+		{"INSERT INTO t (a, b) VALUES (1, 'x') ON DUPLICATE KEY UPDATE c = LOWER('y'), b = 'z'", "a:1 b:'x' lower:'y' b:'z'", ""},
+	}
+
+	for _, test := range tests {
+		var literals []string
+		out := scanLiterals(test.query, false, func(column string, text string) string {
+			literals = append(literals, column+":"+text)
+			return text
+		})
+		if got := strings.Join(literals, " "); got != test.literals {
+			t.Errorf("scanLiterals(%q) found %q, want %q", test.query, got, test.literals)
+		}
+		want := test.out
+		if want == "" {
+			want = test.query
+		}
+		if out != want {
+			t.Errorf("scanLiterals(%q) = %q, want %q", test.query, out, want)
+		}
+		if kept := scanLiterals(test.query, true, func(column string, text string) string { return text }); kept != test.query {
+			t.Errorf("scanLiterals(%q) keeping comments = %q, want the query unchanged", test.query, kept)
+		}
+	}
+}
+
+func TestRedactorQuery(t *testing.T) {
+	r, err := NewRedactor(&RedactionConfig{
+		ShowColumns: []string{"status", "orders.state"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"SELECT * FROM users WHERE ssn = '123'", "SELECT * FROM users WHERE ssn = ?"},
+		{"SELECT * FROM users WHERE ssn = _utf8mb4'123'", "SELECT * FROM users WHERE ssn = ?"},
+		{"SELECT * FROM users WHERE id IN (1, 2) AND status = 'active'", "SELECT * FROM users WHERE id IN (?, ?) AND status = 'active'"},
+		{"SELECT * FROM orders o WHERE o.state = 'open'", "SELECT * FROM orders o WHERE o.state = 'open'"},
+		{"SELECT * FROM users u WHERE u.state = 'open'", "SELECT * FROM users u WHERE u.state = ?"},
+		{"UPDATE users SET name = 'bob' WHERE id = ?", "UPDATE users SET name = ? WHERE id = ?"},
+		{"SELECT 'secret' /* 'secret' */ FROM t -- 'secret'", "SELECT ? /* */ FROM t "},
+		{"INSERT INTO t (card) VALUES /*!50000 ('4111111111111111') */", "INSERT INTO t (card) VALUES /*!50000 (?) */"},
+		{"INSERT INTO t (card) VALUES ('1') /*!99999 , ('4111111111111111') */", "INSERT INTO t (card) VALUES (?) /* */"},
+		{"INSERT INTO users (status, name) VALUES ('active', 'bob')", "INSERT INTO users (status, name) VALUES ('active', ?)"},
+		{"INSERT INTO users (name, status) VALUES (CONCAT('bob', 'x'), 'active')", "INSERT INTO users (name, status) VALUES (CONCAT(?, ?), 'active')"},
+		{"INSERT INTO users VALUES ('bob', 'active')", "INSERT INTO users VALUES (?, ?)"},
+	}
+
+	for _, test := range tests {
+		if got := r.Query(test.query); got != test.want {
+			t.Errorf("Query(%q) = %q, want %q", test.query, got, test.want)
+		}
+	}
+}
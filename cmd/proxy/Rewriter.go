@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type RewriteRuleConfig struct {
+	Name             string   `yaml:"name"`
+	Users            []string `yaml:"users"`              // proxy users, empty matches everyone
+	Digests          []string `yaml:"digests"`            // digests produced by QueryDigest
+	Pattern          string   `yaml:"pattern"`            // regular expression matched against the query
+	Replace          string   `yaml:"replace"`            // replacement template, $1 etc. refer to pattern groups
+	AddLimit         int      `yaml:"add_limit"`          // append LIMIT n to SELECTs without one
+	MaxExecutionTime int      `yaml:"max_execution_time"` // inject a MAX_EXECUTION_TIME(ms) optimizer hint into SELECTs
+	Final            bool     `yaml:"final"`              // stop evaluating further rules after this one matches
+}
+
+type RewriteConfig struct {
+	Enabled bool                `yaml:"enabled"`
+	Rules   []RewriteRuleConfig `yaml:"rules"`
+}
+
+// Rewriter applies the configured rewrite rules, in order, to queries before
+// they are routed to a backend
+type Rewriter struct {
+	config *RewriteConfig
+	rules  []*RewriteRule
+}
+
+type RewriteRule struct {
+	config  *RewriteRuleConfig
+	users   map[string]bool
+	digests map[string]bool
+	pattern *regexp.Regexp
+}
+
+var (
+	limitRe        = regexp.MustCompile(`(?i)\blimit\b`)
+	lockingReadRe  = regexp.MustCompile(`(?is)\s+(for\s+update|for\s+share|lock\s+in\s+share\s+mode)(\s+\w+)*\s*$`)
+	selectRe       = regexp.MustCompile(`(?i)^\s*select\b`)
+	maxExecHintRe  = regexp.MustCompile(`(?i)max_execution_time\s*\(`)
+	trailingSemiRe = regexp.MustCompile(`;\s*$`)
+)
+
+func NewRewriter(config *RewriteConfig) (*Rewriter, error) {
+	rw := &Rewriter{
+		config: config,
+		rules:  make([]*RewriteRule, 0, len(config.Rules)),
+	}
+
+	for i := range config.Rules {
+		ruleConfig := &config.Rules[i]
+		rule := &RewriteRule{
+			config:  ruleConfig,
+			digests: toSet(ruleConfig.Digests, false),
+		}
+		if len(ruleConfig.Users) > 0 {
+			rule.users = make(map[string]bool, len(ruleConfig.Users))
+			for _, user := range ruleConfig.Users {
+				rule.users[user] = true
+			}
+		}
+		if ruleConfig.Pattern != "" {
+			re, err := regexp.Compile(ruleConfig.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("rewrite: rule %d (%s): invalid pattern: %w", i, ruleConfig.Name, err)
+			}
+			rule.pattern = re
+		}
+		if rule.pattern == nil && rule.digests == nil && ruleConfig.Replace != "" {
+			return nil, fmt.Errorf("rewrite: rule %d (%s): replace requires a pattern or digests", i, ruleConfig.Name)
+		}
+		rw.rules = append(rw.rules, rule)
+	}
+
+	return rw, nil
+}
+
+// Rewrite returns the query after applying every matching rule and the
+// names of the rules that changed it
+func (rw *Rewriter) Rewrite(user string, query string) (string, []string) {
+	if rw == nil || !rw.config.Enabled {
+		return query, nil
+	}
+
+	var applied []string
+	var digest string
+
+	for _, rule := range rw.rules {
+		if rule.users != nil && !rule.users[user] {
+			continue
+		}
+		if rule.digests != nil {
+			if digest == "" {
+				digest = QueryDigest(query)
+			}
+			if !rule.digests[digest] {
+				continue
+			}
+		}
+		if rule.pattern != nil && !rule.pattern.MatchString(query) {
+			continue
+		}
+
+		rewritten := rule.apply(query)
+		if rewritten != query {
+			applied = append(applied, rule.config.Name)
+			query = rewritten
+			digest = ""
+		}
+
+		if rule.config.Final {
+			break
+		}
+	}
+
+	return query, applied
+}
+
+func (rule *RewriteRule) apply(query string) string {
+	if rule.config.Replace != "" {
+		if rule.pattern != nil {
+			query = rule.pattern.ReplaceAllString(query, rule.config.Replace)
+		} else {
+			query = rule.config.Replace
+		}
+	}
+
+	if rule.config.MaxExecutionTime > 0 {
+		query = injectMaxExecutionTime(query, rule.config.MaxExecutionTime)
+	}
+
+	if rule.config.AddLimit > 0 {
+		query = addLimit(query, rule.config.AddLimit)
+	}
+
+	return query
+}
+
+// injectMaxExecutionTime adds a /*+ MAX_EXECUTION_TIME(n) */ hint to a
+// SELECT that does not already carry one
+func injectMaxExecutionTime(query string, ms int) string {
+	loc := selectRe.FindStringIndex(query)
+	if loc == nil || maxExecHintRe.MatchString(query) {
+		return query
+	}
+	return query[:loc[1]] + " /*+ MAX_EXECUTION_TIME(" + strconv.Itoa(ms) + ") */" + query[loc[1]:]
+}
+
+// addLimit appends a LIMIT clause to a SELECT that has none, keeping any
+// trailing locking clause at the end of the statement
+func addLimit(query string, limit int) string {
+	if !selectRe.MatchString(query) || limitRe.MatchString(query) {
+		return query
+	}
+
+	// only rewrite single statements
+	stmts := splitAndProcessStatements(query, "8.0.33")
+	if len(stmts) != 1 {
+		return query
+	}
+
+	body := strings.TrimSpace(trailingSemiRe.ReplaceAllString(query, ""))
+	clause := " LIMIT " + strconv.Itoa(limit)
+
+	if loc := lockingReadRe.FindStringIndex(body); loc != nil {
+		return body[:loc[0]] + clause + body[loc[0]:]
+	}
+	return body + clause
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"fmt"
-	"log"
 	"regexp" // For regular expressions
 	"strconv"
 	"strings"
@@ -39,6 +38,9 @@ const (
 	Begin
 	Commit
 	Rollback
+
+	// administrative commands
+	Kill
 )
 
 func Tokenize(query string) []string {
@@ -129,7 +131,7 @@ func splitAndProcessStatements(query, mysqlVersion string) []string {
 		if match[1] != "" { // Conditional comment
 			versionRequired, err := strconv.Atoi(match[1])
 			if err != nil {
-				log.Println("Error parsing version number:", err)
+				logFor("parser").Warn("error parsing version number", "err", err)
 				continue // Skip invalid conditional comment
 			}
 
@@ -240,11 +242,163 @@ func parseStatement(tokens []string) (int, error) {
 	case "ROLLBACK":
 		return Rollback, nil
 
+	case "KILL":
+		return Kill, nil
+
 	default:
 		return 0, fmt.Errorf("unsupported statement type: %s", tokens[0])
 	}
 }
 
+// names used when statement types are referenced from the configuration file
+var commandNames = map[int]string{
+	Set:      "SET",
+	Select:   "SELECT",
+	Show:     "SHOW",
+	Use:      "USE",
+	Desc:     "DESC",
+	Describe: "DESCRIBE",
+	Insert:   "INSERT",
+	Update:   "UPDATE",
+	Delete:   "DELETE",
+	Create:   "CREATE",
+	Alter:    "ALTER",
+	Drop:     "DROP",
+	Truncate: "TRUNCATE",
+	Rename:   "RENAME",
+	Grant:    "GRANT",
+	Revoke:   "REVOKE",
+	Begin:    "BEGIN",
+	Commit:   "COMMIT",
+	Rollback: "ROLLBACK",
+	Kill:     "KILL",
+}
+
+func commandName(cmd int) string {
+	if name, ok := commandNames[cmd]; ok {
+		return name
+	}
+	return "UNKNOWN"
+}
+
+// strips backtick quoting from an identifier, `db`.`table` becomes db.table
+func unquoteIdentifier(ident string) string {
+	return strings.ReplaceAll(ident, "`", "")
+}
+
+// extractTables returns the table names referenced by a tokenized statement.
+// This only understands the common forms (FROM/JOIN/INTO/UPDATE/TABLE lists)
+// and does not descend into subqueries.
+func extractTables(tokens []string) []string {
+	tables := make([]string, 0)
+	seen := make(map[string]bool)
+
+	add := func(token string) {
+		name := unquoteIdentifier(token)
+		if name == "" || seen[name] {
+			return
+		}
+		seen[name] = true
+		tables = append(tables, name)
+	}
+
+	if len(tokens) == 0 {
+		return tables
+	}
+
+	switch strings.ToUpper(tokens[0]) {
+	case "DESC", "DESCRIBE", "TRUNCATE":
+		// DESC table, TRUNCATE [TABLE] table
+		for _, token := range tokens[1:] {
+			if strings.ToUpper(token) == "TABLE" {
+				continue
+			}
+			add(token)
+			break
+		}
+		return tables
+	}
+
+	for i := 0; i < len(tokens); i++ {
+		switch strings.ToUpper(tokens[i]) {
+		case "FROM", "JOIN", "INTO", "UPDATE", "TABLE":
+			// skip modifiers that may appear before the table name
+			j := i + 1
+			for j < len(tokens) {
+				upper := strings.ToUpper(tokens[j])
+				if upper != "IF" && upper != "NOT" && upper != "EXISTS" && upper != "LOW_PRIORITY" && upper != "IGNORE" && upper != "TEMPORARY" {
+					break
+				}
+				j++
+			}
+			// comma separated table lists: FROM a, b
+			for j < len(tokens) {
+				if tokens[j] == "(" {
+					break
+				}
+				add(tokens[j])
+				// skip an optional alias
+				k := j + 1
+				if k < len(tokens) && strings.ToUpper(tokens[k]) == "AS" {
+					k += 2
+				} else if k < len(tokens) && tokens[k] != "," && !isClauseKeyword(tokens[k]) {
+					k++
+				}
+				if k < len(tokens) && tokens[k] == "," {
+					j = k + 1
+					continue
+				}
+				break
+			}
+			i = j
+		case "RENAME":
+			// RENAME TABLE a TO b, c TO d
+			for j := i + 1; j < len(tokens); j++ {
+				upper := strings.ToUpper(tokens[j])
+				if upper == "TABLE" || upper == "TO" || tokens[j] == "," {
+					continue
+				}
+				add(tokens[j])
+			}
+			return tables
+		}
+	}
+
+	return tables
+}
+
+var clauseKeywords = map[string]bool{
+	"WHERE": true, "SET": true, "VALUES": true, "VALUE": true, "SELECT": true,
+	"JOIN": true, "INNER": true, "LEFT": true, "RIGHT": true, "CROSS": true,
+	"STRAIGHT_JOIN": true, "NATURAL": true, "ON": true, "USING": true,
+	"GROUP": true, "ORDER": true, "LIMIT": true, "HAVING": true,
+	"UNION": true, "FOR": true, "LOCK": true, "FORCE": true, "USE": true,
+	"IGNORE": true, "PARTITION": true, "WINDOW": true, "INTO": true,
+	"LIKE": true, "ADD": true, "DROP": true, "MODIFY": true, "CHANGE": true,
+	"RENAME": true, "ENGINE": true, ";": true, ")": true, "(": true,
+}
+
+func isClauseKeyword(token string) bool {
+	return clauseKeywords[strings.ToUpper(token)]
+}
+
+// hasWhereClause reports whether the statement has a WHERE of its own,
+// outside of strings, comments and parenthesized subqueries
+func hasWhereClause(stmt string) bool {
+	depth := 0
+	for _, token := range lexSQL(stmt) {
+		switch {
+		case token.text == "(" && !token.quoted:
+			depth++
+		case token.text == ")" && !token.quoted:
+			depth--
+		case depth == 0 && token.isKeyword("WHERE"):
+			return true
+		}
+	}
+	return false
+}
+
 // example usage:
 
 //func main() {
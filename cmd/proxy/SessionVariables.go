@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+)
+
+const (
+	ReadFromAuto    = "auto"
+	ReadFromPrimary = "primary"
+	ReadFromReplica = "replica"
+)
+
+// SessionVariables are proxy level settings a client changes with
+// SET dbinsight.<name> = <value> and reads back with SELECT @@dbinsight.<name>
+type SessionVariables struct {
+	ReadFrom string // auto, primary or replica
+	QueryTag string // attached to every statement forwarded to a backend
+	MaxLag   int    // maximum replica lag in seconds for reads, -1 for no limit
+}
+
+var sessionVariableNames = []string{"read_from", "query_tag", "max_lag"}
+
+var (
+	setSessionVariableRe    = regexp.MustCompile(`(?is)^\s*set\s+(?:session\s+|@@session\.|@@)?dbinsight\.(\w+)\s*:?=\s*(.*?)\s*;?\s*$`)
+	selectSessionVariableRe = regexp.MustCompile(`(?is)^\s*select\s+(@@dbinsight\.(?:\w+|\*)(?:\s*,\s*@@dbinsight\.(?:\w+|\*))*)\s*;?\s*$`)
+)
+
+func NewSessionVariables() *SessionVariables {
+	return &SessionVariables{
+		ReadFrom: ReadFromAuto,
+		MaxLag:   -1,
+	}
+}
+
+func (sv *SessionVariables) Set(name string, value string) error {
+	name = strings.ToLower(name)
+	value = strings.TrimSpace(value)
+	if len(value) >= 2 && (value[0] == '\'' || value[0] == '"') && value[len(value)-1] == value[0] {
+		value = value[1 : len(value)-1]
+	}
+
+	switch name {
+	case "read_from":
+		value = strings.ToLower(value)
+		if value == "default" {
+			value = ReadFromAuto
+		}
+		if value != ReadFromAuto && value != ReadFromPrimary && value != ReadFromReplica {
+			return fmt.Errorf("Variable 'dbinsight.read_from' can't be set to the value of '%s'", value)
+		}
+		sv.ReadFrom = value
+	case "query_tag":
+		if strings.ToUpper(value) == "NULL" || strings.ToUpper(value) == "DEFAULT" {
+			value = ""
+		}
+		// the tag ends up inside a SQL comment
+		if strings.Contains(value, "*/") {
+			return fmt.Errorf("Variable 'dbinsight.query_tag' can't be set to the value of '%s'", value)
+		}
+		sv.QueryTag = value
+	case "max_lag":
+		if strings.ToUpper(value) == "NULL" || strings.ToUpper(value) == "DEFAULT" {
+			sv.MaxLag = -1
+			return nil
+		}
+		lag, err := strconv.Atoi(value)
+		if err != nil || lag < 0 {
+			return fmt.Errorf("Variable 'dbinsight.max_lag' can't be set to the value of '%s'", value)
+		}
+		sv.MaxLag = lag
+	default:
+		return fmt.Errorf("Unknown system variable 'dbinsight.%s'", name)
+	}
+
+	return nil
+}
+
+func (sv *SessionVariables) Get(name string) (interface{}, error) {
+	switch strings.ToLower(name) {
+	case "read_from":
+		return sv.ReadFrom, nil
+	case "query_tag":
+		if sv.QueryTag == "" {
+			return nil, nil
+		}
+		return sv.QueryTag, nil
+	case "max_lag":
+		if sv.MaxLag < 0 {
+			return nil, nil
+		}
+		return int64(sv.MaxLag), nil
+	default:
+		return nil, fmt.Errorf("Unknown system variable 'dbinsight.%s'", name)
+	}
+}
+
+// tag prefixes the query with the session query tag so it shows up in the
+// backend's process list and slow log
+func (sv *SessionVariables) tag(query string) string {
+	if sv.QueryTag == "" {
+		return query
+	}
+	return "/* query_tag=" + sv.QueryTag + " */ " + query
+}
+
+// handleSessionVariableQuery answers SET dbinsight.x and SELECT @@dbinsight.x
+// locally. The boolean result is false when the query is not one of these.
+func (ph *ProxyHandler) handleSessionVariableQuery(query string) (*mysql.Result, bool, error) {
+	if match := setSessionVariableRe.FindStringSubmatch(query); match != nil {
+		if _, err := ph.session.Get(match[1]); err != nil {
+			return nil, true, mysql.NewError(mysql.ER_UNKNOWN_SYSTEM_VARIABLE, err.Error())
+		}
+		if err := ph.session.Set(match[1], match[2]); err != nil {
+			return nil, true, mysql.NewError(mysql.ER_WRONG_VALUE_FOR_VAR, err.Error())
+		}
+		return mysql.NewResult(nil), true, nil
+	}
+
+	if match := selectSessionVariableRe.FindStringSubmatch(query); match != nil {
+		names := make([]string, 0)
+		values := make([]interface{}, 0)
+		for _, column := range strings.Split(match[1], ",") {
+			column = strings.TrimSpace(column)
+			name := strings.TrimPrefix(strings.ToLower(column), "@@dbinsight.")
+			if name == "*" {
+				for _, name := range sessionVariableNames {
+					value, _ := ph.session.Get(name)
+					names = append(names, "@@dbinsight."+name)
+					values = append(values, value)
+				}
+				continue
+			}
+			value, err := ph.session.Get(name)
+			if err != nil {
+				return nil, true, mysql.NewError(mysql.ER_UNKNOWN_SYSTEM_VARIABLE, err.Error())
+			}
+			names = append(names, column)
+			values = append(values, value)
+		}
+
+		rs, err := mysql.BuildSimpleTextResultset(names, [][]interface{}{values})
+		if err != nil {
+			return nil, true, err
+		}
+		return mysql.NewResult(rs), true, nil
+	}
+
+	return nil, false, nil
+}
@@ -0,0 +1,1042 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/go-mysql-org/go-mysql/client"
+	"github.com/go-mysql-org/go-mysql/mysql"
+)
+
+const (
+	ShardMethodHash  = "hash"
+	ShardMethodRange = "range"
+
+	UnkeyedScatter = "scatter"
+	UnkeyedReject  = "reject"
+)
+
+type ShardRangeConfig struct {
+	Cluster string `yaml:"cluster"`
+	Max     *int64 `yaml:"max"` // exclusive upper bound of the shard key, omitted for the last range
+}
+
+type ShardTableConfig struct {
+	Table    string             `yaml:"table"`     // database.table
+	ShardKey string             `yaml:"shard_key"` // column holding the shard key
+	Method   string             `yaml:"method"`    // hash or range
+	Shards   []string           `yaml:"shards"`    // hash: clusters in shard order
+	Ranges   []ShardRangeConfig `yaml:"ranges"`    // range: clusters in ascending key order
+}
+
+type ShardingConfig struct {
+	Enabled bool               `yaml:"enabled"`
+	Unkeyed string             `yaml:"unkeyed"` // scatter or reject statements without the shard key
+	Tables  []ShardTableConfig `yaml:"tables"`
+}
+
+type ShardTable struct {
+	config *ShardTableConfig
+	name   string // database.table
+	key    string
+}
+
+// ShardRouter finds the shard key of statements on sharded tables and maps
+// it to the cluster holding the rows
+type ShardRouter struct {
+	config *ShardingConfig
+	tables map[string]*ShardTable
+}
+
+// ShardRoute is where a statement on a sharded table has to run
+type ShardRoute struct {
+	Table    *ShardTable
+	Database string
+	Clusters []string // clusters the statement runs on, in shard order
+	Keyed    bool     // whether the shard key narrowed down the clusters
+}
+
+func NewShardRouter(config *ShardingConfig, clusters []ClusterConfig) (*ShardRouter, error) {
+	if config.Unkeyed == "" {
+		config.Unkeyed = UnkeyedReject
+	}
+	if config.Unkeyed != UnkeyedScatter && config.Unkeyed != UnkeyedReject {
+		return nil, fmt.Errorf("sharding: unknown unkeyed policy: %s", config.Unkeyed)
+	}
+
+	known := map[string]bool{DefaultCluster: true}
+	for _, cluster := range clusters {
+		known[cluster.Name] = true
+	}
+
+	router := &ShardRouter{
+		config: config,
+		tables: make(map[string]*ShardTable),
+	}
+
+	for i := range config.Tables {
+		tc := &config.Tables[i]
+		name := strings.ToLower(unquoteIdentifier(tc.Table))
+		if !strings.Contains(name, ".") {
+			return nil, fmt.Errorf("sharding: table %s must be given as database.table", tc.Table)
+		}
+		if tc.ShardKey == "" {
+			return nil, fmt.Errorf("sharding: table %s has no shard_key", name)
+		}
+
+		var shards []string
+		switch tc.Method {
+		case ShardMethodHash:
+			shards = tc.Shards
+		case ShardMethodRange:
+			for j, r := range tc.Ranges {
+				if r.Max == nil && j != len(tc.Ranges)-1 {
+					return nil, fmt.Errorf("sharding: only the last range of %s may omit max", name)
+				}
+				if j > 0 && r.Max != nil && *r.Max <= *tc.Ranges[j-1].Max {
+					return nil, fmt.Errorf("sharding: ranges of %s must be in ascending order", name)
+				}
+				shards = append(shards, r.Cluster)
+			}
+		default:
+			return nil, fmt.Errorf("sharding: table %s has unknown method: %s", name, tc.Method)
+		}
+		if len(shards) == 0 {
+			return nil, fmt.Errorf("sharding: table %s has no shards", name)
+		}
+		for _, shard := range shards {
+			if !known[shard] {
+				return nil, fmt.Errorf("sharding: table %s uses unknown cluster: %s", name, shard)
+			}
+		}
+
+		router.tables[name] = &ShardTable{
+			config: tc,
+			name:   name,
+			key:    strings.ToLower(tc.ShardKey),
+		}
+	}
+
+	return router, nil
+}
+
+// clusters returns every cluster holding a shard of the table
+func (st *ShardTable) clusters() []string {
+	if st.config.Method == ShardMethodHash {
+		return st.config.Shards
+	}
+	clusters := make([]string, 0, len(st.config.Ranges))
+	for _, r := range st.config.Ranges {
+		clusters = append(clusters, r.Cluster)
+	}
+	return clusters
+}
+
+// shardFor maps a shard key value to the cluster holding it. Hash sharding
+// hashes the literal text, so 42 and '42' land on the same shard.
+func (st *ShardTable) shardFor(value string) (string, error) {
+	if st.config.Method == ShardMethodHash {
+		h := fnv.New32a()
+		h.Write([]byte(value))
+		return st.config.Shards[h.Sum32()%uint32(len(st.config.Shards))], nil
+	}
+
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return "", mysql.NewError(mysql.ER_WRONG_VALUE_FOR_VAR, fmt.Sprintf("shard key %s of %s must be an integer, got %q", st.key, st.name, value))
+	}
+	for _, r := range st.config.Ranges {
+		if r.Max == nil || n < *r.Max {
+			return r.Cluster, nil
+		}
+	}
+	return "", mysql.NewError(mysql.ER_WRONG_VALUE_FOR_VAR, fmt.Sprintf("shard key %s = %d of %s is outside every range", st.key, n, st.name))
+}
+
+// Route returns where a statement has to run, or nil when it does not use
+// a sharded table
+func (sr *ShardRouter) Route(database string, query string) (*ShardRoute, error) {
+	if sr == nil || !sr.config.Enabled || len(sr.tables) == 0 {
+		return nil, nil
+	}
+
+	stmts := splitAndProcessStatements(query, "8.0.33")
+
+	var table *ShardTable
+	for _, stmt := range stmts {
+		for _, name := range qualifyTables(database, extractTables(Tokenize(stmt))) {
+			st, ok := sr.tables[name]
+			if !ok {
+				continue
+			}
+			if table != nil && table != st {
+				return nil, mysql.NewError(mysql.ER_NOT_SUPPORTED_YET, fmt.Sprintf("statements on more than one sharded table are not supported: %s, %s", table.name, st.name))
+			}
+			table = st
+		}
+	}
+	if table == nil {
+		return nil, nil
+	}
+	if len(stmts) != 1 {
+		return nil, mysql.NewError(mysql.ER_NOT_SUPPORTED_YET, fmt.Sprintf("multi-statement queries on sharded table %s are not supported", table.name))
+	}
+
+	route := &ShardRoute{
+		Table:    table,
+		Database: strings.SplitN(table.name, ".", 2)[0],
+	}
+
+	tokens := lexSQL(stmts[0])
+	values, keyed := shardKeyValues(tokens, table.key, table.qualifiers(tokens))
+	if !keyed {
+		route.Clusters = table.clusters()
+		return route, nil
+	}
+
+	seen := make(map[string]bool)
+	for _, value := range values {
+		cluster, err := table.shardFor(value)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[cluster] {
+			seen[cluster] = true
+			route.Clusters = append(route.Clusters, cluster)
+		}
+	}
+	route.Keyed = true
+
+	return route, nil
+}
+
+// sqlToken is a token of a statement that remembers whether it was a quoted
+// string, which Tokenize forgets
+type sqlToken struct {
+	text       string
+	quoted     bool
+	identifier bool // had a `quoted` part, never a keyword
+}
+
+// the server version versioned comments are compared against, the same one
+// parseSQL uses
+const serverVersion = 80033
+
+// executedComment returns the end of the /*! or /*!NNNNN that opens a
+// comment at query[i] when the server runs what the comment holds
+func executedComment(query string, i int) (int, bool) {
+	if !strings.HasPrefix(query[i:], "/*!") {
+		return 0, false
+	}
+	j := i + 3
+	for j < len(query) && j < i+8 && query[j] >= '0' && query[j] <= '9' {
+		j++
+	}
+	version, err := strconv.Atoi(query[i+3 : j])
+	return j, err != nil || version <= serverVersion
+}
+
+// lexSQL splits a statement into tokens, stripping comments and the quotes
+// around strings and identifiers. The contents of /*! */ and /*!NNNNN */
+// comments the server would run are lexed as part of the statement.
+func lexSQL(query string) []sqlToken {
+	tokens := make([]sqlToken, 0)
+	var current strings.Builder
+	identifier := false
+	versioned := false // inside an executed /*! */ comment
+
+	flush := func() {
+		if current.Len() > 0 || identifier {
+			tokens = append(tokens, sqlToken{text: current.String(), identifier: identifier})
+			current.Reset()
+			identifier = false
+		}
+	}
+
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case c == '`':
+			// quoted identifiers stay part of the word, `t`.`c` is t.c
+			end := strings.IndexByte(query[i+1:], '`')
+			if end < 0 {
+				end = len(query) - i - 1
+			}
+			current.WriteString(query[i+1 : i+1+end])
+			identifier = true
+			i += end + 1
+		case c == '\'' || c == '"':
+			flush()
+			var value strings.Builder
+			j := i + 1
+			for ; j < len(query); j++ {
+				if query[j] == '\\' && j+1 < len(query) {
+					j++
+					value.WriteByte(query[j])
+					continue
+				}
+				if query[j] == c {
+					if j+1 < len(query) && query[j+1] == c {
+						value.WriteByte(c)
+						j++
+						continue
+					}
+					break
+				}
+				value.WriteByte(query[j])
+			}
+			tokens = append(tokens, sqlToken{text: value.String(), quoted: true})
+			i = j
+		case versioned && c == '*' && i+1 < len(query) && query[i+1] == '/':
+			flush()
+			versioned = false
+			i++
+		case c == '/' && i+1 < len(query) && query[i+1] == '*':
+			flush()
+			if j, ok := executedComment(query, i); ok {
+				versioned = true
+				i = j - 1
+				continue
+			}
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				return tokens
+			}
+			i += end + 3
+		case c == '#' || (c == '-' && i+2 < len(query) && query[i+1] == '-' && (query[i+2] == ' ' || query[i+2] == '\t')):
+			flush()
+			end := strings.IndexByte(query[i:], '\n')
+			if end < 0 {
+				return tokens
+			}
+			i += end
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			flush()
+		case strings.IndexByte("(),;=<>!+-*/%&|^~", c) >= 0:
+			flush()
+			tokens = append(tokens, sqlToken{text: string(c)})
+		default:
+			current.WriteByte(c)
+		}
+	}
+	flush()
+
+	return tokens
+}
+
+// isKeyword reports whether the token is the given unquoted keyword
+func (t sqlToken) isKeyword(keyword string) bool {
+	return !t.quoted && !t.identifier && strings.EqualFold(t.text, keyword)
+}
+
+// isColumn reports whether the token names the column, unqualified or
+// qualified with one of the given table names or aliases
+func (t sqlToken) isColumn(column string, qualifiers map[string]bool) bool {
+	if t.quoted {
+		return false
+	}
+	name := strings.ToLower(t.text)
+	if name == column {
+		return true
+	}
+	qualifier, ok := strings.CutSuffix(name, "."+column)
+	return ok && qualifiers[qualifier]
+}
+
+// notAlias are the keywords that may follow a table reference without
+// being its alias
+var notAlias = map[string]bool{
+	"WHERE": true, "SET": true, "JOIN": true, "INNER": true, "LEFT": true, "RIGHT": true,
+	"CROSS": true, "NATURAL": true, "STRAIGHT_JOIN": true, "ON": true, "USING": true,
+	"GROUP": true, "ORDER": true, "LIMIT": true, "HAVING": true, "FOR": true, "UNION": true,
+	"WINDOW": true, "LOCK": true, "PARTITION": true, "USE": true, "FORCE": true,
+	"IGNORE": true, "VALUES": true, "VALUE": true, "SELECT": true, "TABLE": true,
+}
+
+// qualifiers returns the names columns of the table may be qualified with
+// in a statement, its own name with and without the database and the
+// aliases it is given
+func (st *ShardTable) qualifiers(tokens []sqlToken) map[string]bool {
+	_, short, _ := strings.Cut(st.name, ".")
+	qualifiers := map[string]bool{st.name: true, short: true}
+	for i, t := range tokens {
+		name := strings.ToLower(t.text)
+		if t.quoted || (name != st.name && name != short) || i+1 >= len(tokens) {
+			continue
+		}
+		next := tokens[i+1]
+		if next.isKeyword("AS") && i+2 < len(tokens) {
+			next = tokens[i+2]
+		}
+		if next.quoted || (!next.identifier && (notAlias[strings.ToUpper(next.text)] || strings.IndexByte("(),;=<>!+-*/%&|^~", next.text[0]) >= 0)) {
+			continue
+		}
+		qualifiers[strings.ToLower(next.text)] = true
+	}
+	return qualifiers
+}
+
+// literalAt returns the literal starting at tokens[i] and how many tokens it
+// spans, n is 0 when there is no literal there
+func literalAt(tokens []sqlToken, i int) (value string, n int) {
+	if i >= len(tokens) {
+		return "", 0
+	}
+	if tokens[i].quoted {
+		return tokens[i].text, 1
+	}
+	if tokens[i].text == "-" && i+1 < len(tokens) && !tokens[i+1].quoted {
+		if _, err := strconv.ParseFloat(tokens[i+1].text, 64); err == nil {
+			return "-" + tokens[i+1].text, 2
+		}
+		return "", 0
+	}
+	if _, err := strconv.ParseFloat(tokens[i].text, 64); err == nil {
+		return tokens[i].text, 1
+	}
+	return "", 0
+}
+
+var clauseEnd = map[string]bool{
+	"GROUP": true, "ORDER": true, "LIMIT": true, "HAVING": true, "FOR": true,
+	"UNION": true, "WINDOW": true, "LOCK": true, "ON": true, ";": true,
+}
+
+// topLevelClause returns the tokens following the first top level keyword
+// up to the end of that clause
+func topLevelClause(tokens []sqlToken, keyword string) []sqlToken {
+	depth := 0
+	start := -1
+	for i, t := range tokens {
+		switch t.text {
+		case "(":
+			depth++
+			continue
+		case ")":
+			depth--
+			continue
+		}
+		if depth != 0 || t.quoted || t.identifier {
+			continue
+		}
+		if start < 0 {
+			if strings.EqualFold(t.text, keyword) {
+				start = i + 1
+			}
+			continue
+		}
+		if clauseEnd[strings.ToUpper(t.text)] {
+			return tokens[start:i]
+		}
+	}
+	if start < 0 {
+		return nil
+	}
+	return tokens[start:]
+}
+
+// conditionValues returns the shard key values a WHERE clause (or INSERT
+// ... SET list) pins the key to. Only top level key = literal and key IN
+// (literals) conditions count, a top level OR makes the clause unkeyed and
+// conditions negated with NOT are passed over.
+func conditionValues(clause []sqlToken, key string, qualifiers map[string]bool) ([]string, bool) {
+	depth := 0
+	for _, t := range clause {
+		switch {
+		case t.text == "(" && !t.quoted:
+			depth++
+		case t.text == ")" && !t.quoted:
+			depth--
+		case depth == 0 && (t.isKeyword("OR") || t.isKeyword("XOR") || t.text == "|"):
+			return nil, false
+		}
+	}
+
+	depth = 0
+	for i := 0; i < len(clause); i++ {
+		t := clause[i]
+		if t.quoted {
+			continue
+		}
+		switch t.text {
+		case "(":
+			depth++
+			continue
+		case ")":
+			depth--
+			continue
+		}
+		if depth != 0 {
+			continue
+		}
+
+		// NOT key = literal, skip to the next condition
+		if t.isKeyword("NOT") || (t.text == "!" && (i+1 >= len(clause) || clause[i+1].text != "=")) {
+			nested := 0
+			for i++; i < len(clause); i++ {
+				c := clause[i]
+				if c.quoted {
+					continue
+				}
+				if c.text == "(" {
+					nested++
+				} else if c.text == ")" {
+					nested--
+				} else if nested == 0 && (c.isKeyword("AND") || c.text == "&") {
+					break
+				}
+			}
+			continue
+		}
+
+		// literal = key
+		if value, n := literalAt(clause, i); n > 0 {
+			if i+n+1 < len(clause) && clause[i+n].text == "=" && clause[i+n+1].isColumn(key, qualifiers) &&
+				(i == 0 || !strings.Contains("<>!", clause[i-1].text)) {
+				return []string{value}, true
+			}
+			i += n - 1
+			continue
+		}
+
+		if !t.isColumn(key, qualifiers) || i+1 >= len(clause) {
+			continue
+		}
+
+		// key = literal
+		if clause[i+1].text == "=" && !clause[i+1].quoted {
+			if value, n := literalAt(clause, i+2); n > 0 {
+				return []string{value}, true
+			}
+			continue
+		}
+
+		// key IN (literal, ...)
+		if clause[i+1].isKeyword("IN") && i+2 < len(clause) && clause[i+2].text == "(" {
+			values := make([]string, 0)
+			j := i + 3
+			for j < len(clause) {
+				value, n := literalAt(clause, j)
+				if n == 0 {
+					break
+				}
+				values = append(values, value)
+				j += n
+				if j < len(clause) && clause[j].text == "," {
+					j++
+					continue
+				}
+				break
+			}
+			if j < len(clause) && clause[j].text == ")" && len(values) > 0 {
+				return values, true
+			}
+		}
+	}
+
+	return nil, false
+}
+
+// insertValues returns the shard key of every row of an INSERT ... VALUES
+// with a column list
+func insertValues(tokens []sqlToken, key string) ([]string, bool) {
+	i := 0
+	for i < len(tokens) && !tokens[i].isKeyword("INTO") {
+		i++
+	}
+	// INTO table (
+	i += 2
+	if i >= len(tokens) || tokens[i].text != "(" {
+		return nil, false
+	}
+
+	column := -1
+	index := 0
+	for i++; i < len(tokens) && tokens[i].text != ")"; i++ {
+		if tokens[i].text == "," {
+			index++
+			continue
+		}
+		if strings.EqualFold(tokens[i].text, key) {
+			column = index
+		}
+	}
+	if column < 0 || i+1 >= len(tokens) || !(tokens[i+1].isKeyword("VALUES") || tokens[i+1].isKeyword("VALUE")) {
+		return nil, false
+	}
+
+	values := make([]string, 0)
+	for i += 2; i < len(tokens); {
+		if tokens[i].text != "(" {
+			break
+		}
+		// split the row at top level commas
+		field := 0
+		depth := 0
+		var value string
+		found := false
+		j := i + 1
+		for ; j < len(tokens); j++ {
+			t := tokens[j]
+			if !t.quoted && t.text == "(" {
+				depth++
+			} else if !t.quoted && t.text == ")" {
+				if depth == 0 {
+					break
+				}
+				depth--
+			} else if !t.quoted && t.text == "," && depth == 0 {
+				field++
+			} else if field == column && depth == 0 && !found {
+				v, n := literalAt(tokens, j)
+				if n == 0 {
+					return nil, false
+				}
+				// the literal must be the whole value
+				if j+n < len(tokens) && tokens[j+n].text != "," && tokens[j+n].text != ")" {
+					return nil, false
+				}
+				value = v
+				found = true
+				j += n - 1
+			}
+		}
+		if !found {
+			return nil, false
+		}
+		values = append(values, value)
+
+		i = j + 1
+		if i < len(tokens) && tokens[i].text == "," {
+			i++
+			continue
+		}
+		break
+	}
+
+	return values, len(values) > 0
+}
+
+// shardKeyValues returns the shard key values a statement is limited to,
+// keyed is false when the statement may touch any shard
+func shardKeyValues(tokens []sqlToken, key string, qualifiers map[string]bool) (values []string, keyed bool) {
+	if len(tokens) == 0 {
+		return nil, false
+	}
+
+	switch {
+	case tokens[0].isKeyword("INSERT") || tokens[0].isKeyword("REPLACE"):
+		if values, ok := insertValues(tokens, key); ok {
+			return values, true
+		}
+		// INSERT ... SET key = value
+		return conditionValues(topLevelClause(tokens, "SET"), key, qualifiers)
+	case tokens[0].isKeyword("SELECT") || tokens[0].isKeyword("UPDATE") || tokens[0].isKeyword("DELETE"):
+		return conditionValues(topLevelClause(tokens, "WHERE"), key, qualifiers)
+	}
+
+	return nil, false
+}
+
+// executeSharded runs a statement on a sharded table on the shards it needs
+func (ph *ProxyHandler) executeSharded(route *ShardRoute, cmd int, query string) (*mysql.Result, error) {
+	if ph.p.config.LogQueries {
+		ph.logger().Info("sharded query", "table", route.Table.name, "clusters", route.Clusters, "keyed", route.Keyed, "query", ph.p.redactor.Query(query))
+	}
+
+	switch cmd {
+	case Create, Alter, Drop, Truncate, Rename:
+		// schema changes apply to every shard
+		var res *mysql.Result
+		for _, cluster := range route.Table.clusters() {
+			r, err := ph.executeOnShard(route, cluster, cmd, query)
+			if err != nil {
+				return nil, fmt.Errorf("shard %s: %w", cluster, err)
+			}
+			res = r
+		}
+		return res, nil
+	case Show, Desc, Describe:
+		// every shard has the same schema
+		return ph.executeOnShard(route, route.Table.clusters()[0], cmd, query)
+	}
+
+	if len(route.Clusters) == 1 {
+		return ph.executeOnShard(route, route.Clusters[0], cmd, query)
+	}
+
+	if !route.Keyed && ph.p.config.Sharding.Unkeyed == UnkeyedReject {
+		return nil, mysql.NewError(mysql.ER_NOT_SUPPORTED_YET, fmt.Sprintf("statement on sharded table %s does not limit the shard key %s", route.Table.name, route.Table.key))
+	}
+
+	if cmd != Select {
+		return nil, mysql.NewError(mysql.ER_NOT_SUPPORTED_YET, fmt.Sprintf("%s on sharded table %s spans more than one shard", strings.ToLower(commandName(cmd)), route.Table.name))
+	}
+
+	return ph.scatterGather(route, query)
+}
+
+// executeOnShard runs the statement on one shard, through the session's own
+// connections when the shard is the session's cluster
+func (ph *ProxyHandler) executeOnShard(route *ShardRoute, cluster string, cmd int, query string) (*mysql.Result, error) {
+	if cluster == ph.cluster && ph.databaseName == route.Database {
+		switch cmd {
+		case Select, Show, Desc, Describe:
+			return ph.ExecuteReadQuery(query)
+		default:
+			return ph.ExecuteWriteQuery(query)
+		}
+	}
+
+	return ph.executeOnCluster(&ClusterRoute{
+		Cluster:  cluster,
+		Database: route.Database,
+		Tables:   []string{route.Table.name},
+	}, cmd, query)
+}
+
+var (
+	// statements whose results cannot be merged by concatenating rows
+	unmergeableRe   = regexp.MustCompile(`(?i)\b(group\s+by|having|distinct|union)\b|\b(count|sum|avg|min|max|group_concat|std|stddev|variance|bit_and|bit_or|bit_xor|json_arrayagg|json_objectagg)\s*\(`)
+	trailingLimitRe = regexp.MustCompile(`(?i)\blimit\s+(\d+)(?:\s*,\s*(\d+)|\s+offset\s+(\d+))?\s*;?\s*$`)
+)
+
+type orderItem struct {
+	column string
+	desc   bool
+}
+
+// orderBy parses a top level ORDER BY made of plain column names or
+// positions, ok is false for expressions
+func orderBy(tokens []sqlToken) (items []orderItem, ok bool) {
+	depth := 0
+	start := -1
+	for i, t := range tokens {
+		if t.quoted {
+			continue
+		}
+		switch t.text {
+		case "(":
+			depth++
+		case ")":
+			depth--
+		}
+		if depth == 0 && t.isKeyword("ORDER") && i+1 < len(tokens) && tokens[i+1].isKeyword("BY") {
+			start = i + 2
+		}
+	}
+	if start < 0 {
+		return nil, true
+	}
+
+	var item *orderItem
+	for _, t := range tokens[start:] {
+		switch {
+		case t.isKeyword("LIMIT") || t.isKeyword("FOR") || t.isKeyword("LOCK") || t.text == ";":
+			if item != nil {
+				items = append(items, *item)
+			}
+			return items, true
+		case t.text == ",":
+			if item == nil {
+				return nil, false
+			}
+			items = append(items, *item)
+			item = nil
+		case item == nil && !t.quoted:
+			item = &orderItem{column: strings.ToLower(t.text)}
+		case item != nil && t.isKeyword("ASC"):
+		case item != nil && t.isKeyword("DESC"):
+			item.desc = true
+		default:
+			return nil, false
+		}
+	}
+	if item != nil {
+		items = append(items, *item)
+	}
+	return items, true
+}
+
+// scatterLimit returns the query each shard runs for a scatter read and the
+// offset and limit to cut the merged rows at, limit is -1 without a LIMIT.
+// Every shard returns offset+limit rows. ok is false when the statement's
+// LIMIT can't be re-applied to the merged rows, e.g. before FOR UPDATE.
+func scatterLimit(query string, tokens []sqlToken) (shardQuery string, offset int, limit int, ok bool) {
+	depth := 0
+	at := -1
+	for i, t := range tokens {
+		switch {
+		case t.text == "(" && !t.quoted:
+			depth++
+		case t.text == ")" && !t.quoted:
+			depth--
+		case depth == 0 && t.isKeyword("LIMIT"):
+			at = i
+		}
+	}
+	if at < 0 {
+		return query, 0, -1, true
+	}
+
+	// LIMIT n, LIMIT n, m or LIMIT n OFFSET m, then at most a semicolon
+	number := func(t sqlToken) bool {
+		_, err := strconv.Atoi(t.text)
+		return !t.quoted && err == nil
+	}
+	rest := tokens[at+1:]
+	if len(rest) > 0 && rest[len(rest)-1].text == ";" && !rest[len(rest)-1].quoted {
+		rest = rest[:len(rest)-1]
+	}
+	switch {
+	case len(rest) == 1 && number(rest[0]):
+	case len(rest) == 3 && number(rest[0]) && (rest[1].text == "," && !rest[1].quoted || rest[1].isKeyword("OFFSET")) && number(rest[2]):
+	default:
+		return "", 0, 0, false
+	}
+
+	m := trailingLimitRe.FindStringSubmatchIndex(query)
+	if m == nil {
+		// a comment after the LIMIT
+		return "", 0, 0, false
+	}
+	first, _ := strconv.Atoi(query[m[2]:m[3]])
+	limit = first
+	if m[4] >= 0 {
+		// LIMIT offset, count
+		offset = first
+		limit, _ = strconv.Atoi(query[m[4]:m[5]])
+	} else if m[6] >= 0 {
+		offset, _ = strconv.Atoi(query[m[6]:m[7]])
+	}
+	return query[:m[0]] + fmt.Sprintf("LIMIT %d", offset+limit), offset, limit, true
+}
+
+// scatterGather runs a SELECT on every shard and merges the results,
+// applying ORDER BY and LIMIT to the merged rows
+func (ph *ProxyHandler) scatterGather(route *ShardRoute, query string) (*mysql.Result, error) {
+	if ph.inTransaction {
+		return nil, mysql.NewError(mysql.ER_NOT_SUPPORTED_YET, fmt.Sprintf("cannot read more than one shard of %s inside a transaction", route.Table.name))
+	}
+	if unmergeableRe.MatchString(query) {
+		return nil, mysql.NewError(mysql.ER_NOT_SUPPORTED_YET, fmt.Sprintf("grouping, aggregates, DISTINCT and UNION across the shards of %s are not supported", route.Table.name))
+	}
+
+	tokens := lexSQL(query)
+	order, ok := orderBy(tokens)
+	if !ok {
+		return nil, mysql.NewError(mysql.ER_NOT_SUPPORTED_YET, fmt.Sprintf("ORDER BY across the shards of %s only supports column names and positions", route.Table.name))
+	}
+
+	shardQuery, offset, limit, ok := scatterLimit(query, tokens)
+	if !ok {
+		return nil, mysql.NewError(mysql.ER_NOT_SUPPORTED_YET, fmt.Sprintf("LIMIT across the shards of %s must be the last clause and use numbers", route.Table.name))
+	}
+	shardQuery = ph.session.tag(shardQuery)
+
+	results := make([]*mysql.Result, len(route.Clusters))
+	errs := make([]error, len(route.Clusters))
+	var wg sync.WaitGroup
+	for i, cluster := range route.Clusters {
+		wg.Add(1)
+		go func(i int, cluster string) {
+			defer wg.Done()
+			results[i], errs[i] = ph.queryShard(cluster, route.Database, shardQuery)
+		}(i, cluster)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			return nil, fmt.Errorf("shard %s: %w", route.Clusters[i], err)
+		}
+	}
+
+	ph.lastBackend = "shards " + strings.Join(route.Clusters, ", ")
+
+	return mergeResults(results, order, offset, limit)
+}
+
+// queryShard runs a read on a borrowed connection of the shard's cluster
+func (ph *ProxyHandler) queryShard(cluster string, database string, query string) (*mysql.Result, error) {
+	backends, err := ph.p.clusters.Get(cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	var svr *BackendServer
+	if ph.hints.wantsPrimary() {
+		svr, err = backends.GetWriter()
+	} else {
+		svr, err = backends.GetReader()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key := NewUserKey(svr.address, ph.backendUser, ph.backendPassword)
+	var conn *client.Conn
+	conn, err = svr.GetNextConn(key)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := svr.PutConn(key, conn); err != nil {
+			ph.logger().Error("failed to return connection to pool", "backend", svr.address, "err", err)
+		}
+	}()
+
+	if err := conn.UseDB(database); err != nil {
+		return nil, err
+	}
+	return ph.executeWithTimeout(svr, conn, ph.statementTimeout(query), func() (*mysql.Result, error) {
+		return conn.Execute(query)
+	})
+}
+
+func mergeResults(results []*mysql.Result, order []orderItem, offset int, limit int) (*mysql.Result, error) {
+	first := results[0]
+	if first.Resultset == nil {
+		return first, nil
+	}
+
+	rs := &mysql.Resultset{
+		Fields:     first.Fields,
+		FieldNames: first.FieldNames,
+	}
+	for _, res := range results {
+		if res.Resultset == nil || len(res.Fields) != len(first.Fields) {
+			return nil, fmt.Errorf("shards returned different columns")
+		}
+		if len(res.Values) != len(res.RowDatas) {
+			res.Values = make([][]mysql.FieldValue, len(res.RowDatas))
+			for i, row := range res.RowDatas {
+				values, err := row.Parse(res.Fields, false, nil)
+				if err != nil {
+					return nil, err
+				}
+				res.Values[i] = values
+			}
+		}
+		rs.Values = append(rs.Values, res.Values...)
+		rs.RowDatas = append(rs.RowDatas, res.RowDatas...)
+	}
+
+	if len(order) > 0 {
+		columns := make([]int, len(order))
+		for i, item := range order {
+			column, err := resultColumn(rs, item.column)
+			if err != nil {
+				return nil, err
+			}
+			columns[i] = column
+		}
+
+		rows := make([]int, len(rs.Values))
+		for i := range rows {
+			rows[i] = i
+		}
+		sort.SliceStable(rows, func(a, b int) bool {
+			for i, column := range columns {
+				c := compareFieldValues(&rs.Values[rows[a]][column], &rs.Values[rows[b]][column])
+				if c == 0 {
+					continue
+				}
+				if order[i].desc {
+					return c > 0
+				}
+				return c < 0
+			}
+			return false
+		})
+
+		values := make([][]mysql.FieldValue, len(rows))
+		rowDatas := make([]mysql.RowData, len(rows))
+		for i, row := range rows {
+			values[i] = rs.Values[row]
+			rowDatas[i] = rs.RowDatas[row]
+		}
+		rs.Values = values
+		rs.RowDatas = rowDatas
+	}
+
+	if offset > len(rs.Values) {
+		offset = len(rs.Values)
+	}
+	end := len(rs.Values)
+	if limit >= 0 && offset+limit < end {
+		end = offset + limit
+	}
+	rs.Values = rs.Values[offset:end]
+	rs.RowDatas = rs.RowDatas[offset:end]
+
+	return mysql.NewResult(rs), nil
+}
+
+// resultColumn finds an ORDER BY column in the result by name, alias or
+// 1-based position
+func resultColumn(rs *mysql.Resultset, column string) (int, error) {
+	if n, err := strconv.Atoi(column); err == nil {
+		if n < 1 || n > len(rs.Fields) {
+			return 0, mysql.NewError(mysql.ER_BAD_FIELD_ERROR, fmt.Sprintf("Unknown column '%d' in 'order clause'", n))
+		}
+		return n - 1, nil
+	}
+
+	if i := strings.LastIndexByte(column, '.'); i >= 0 {
+		column = column[i+1:]
+	}
+	for i, field := range rs.Fields {
+		if strings.EqualFold(string(field.Name), column) {
+			return i, nil
+		}
+	}
+	return 0, mysql.NewError(mysql.ER_BAD_FIELD_ERROR, fmt.Sprintf("ORDER BY column '%s' must be in the select list to sort across shards", column))
+}
+
+// compareFieldValues orders NULL first, numbers numerically and everything
+// else by bytes, which matches binary collations only
+func compareFieldValues(a, b *mysql.FieldValue) int {
+	if a.Type == mysql.FieldValueTypeNull || b.Type == mysql.FieldValueTypeNull {
+		switch {
+		case a.Type == b.Type:
+			return 0
+		case a.Type == mysql.FieldValueTypeNull:
+			return -1
+		default:
+			return 1
+		}
+	}
+
+	an, aok := fieldNumber(a)
+	bn, bok := fieldNumber(b)
+	if aok && bok {
+		switch {
+		case an < bn:
+			return -1
+		case an > bn:
+			return 1
+		}
+		return 0
+	}
+
+	return bytes.Compare(a.AsString(), b.AsString())
+}
+
+func fieldNumber(v *mysql.FieldValue) (float64, bool) {
+	switch v.Type {
+	case mysql.FieldValueTypeUnsigned:
+		return float64(v.AsUint64()), true
+	case mysql.FieldValueTypeSigned:
+		return float64(v.AsInt64()), true
+	case mysql.FieldValueTypeFloat:
+		return v.AsFloat64(), true
+	}
+	return 0, false
+}
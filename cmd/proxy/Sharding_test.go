@@ -0,0 +1,120 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLexSQL(t *testing.T) {
+	tests := []struct {
+		query string
+		want  []sqlToken
+	}{
+		{"SELECT a FROM t", []sqlToken{{text: "SELECT"}, {text: "a"}, {text: "FROM"}, {text: "t"}}},
+		{"SELECT `t`.`c`", []sqlToken{{text: "SELECT"}, {text: "t.c", identifier: true}}},
+		{"a='x'", []sqlToken{{text: "a"}, {text: "="}, {text: "x", quoted: true}}},
+		{`'it''s' "a\"b"`, []sqlToken{{text: "it's", quoted: true}, {text: `a"b`, quoted: true}}},
+		{"a /* b */ c", []sqlToken{{text: "a"}, {text: "c"}}},
+		{"a # b\nc", []sqlToken{{text: "a"}, {text: "c"}}},
+		{"a -- b\nc", []sqlToken{{text: "a"}, {text: "c"}}},
+		{"a /*!50000 b */ c", []sqlToken{{text: "a"}, {text: "b"}, {text: "c"}}},
+		{"a /*!99999 b */ c", []sqlToken{{text: "a"}, {text: "c"}}},
+		{"f(a,-1)", []sqlToken{{text: "f"}, {text: "("}, {text: "a"}, {text: ","}, {text: "-"}, {text: "1"}, {text: ")"}}},
+	}
+
+	for _, test := range tests {
+		if got := lexSQL(test.query); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("lexSQL(%q) = %+v, want %+v", test.query, got, test.want)
+		}
+	}
+}
+
+func TestShardKeyValues(t *testing.T) {
+	table := &ShardTable{name: "app.users", key: "id"}
+
+	tests := []struct {
+		query  string
+		values []string
+		keyed  bool
+	}{
+		{"SELECT * FROM users WHERE id = 5", []string{"5"}, true},
+		{"SELECT * FROM users WHERE 5 = id", []string{"5"}, true},
+		{"SELECT * FROM users WHERE id = -5", []string{"-5"}, true},
+		{"SELECT * FROM users WHERE id = '5'", []string{"5"}, true},
+		{"SELECT * FROM users WHERE id IN (1, 2, 3)", []string{"1", "2", "3"}, true},
+		{"SELECT * FROM users WHERE name = 'x' AND id = 7", []string{"7"}, true},
+		{"SELECT * FROM users WHERE id = 5 OR id = 6", nil, false},
+		{"SELECT * FROM users WHERE id != 5", nil, false},
+		{"SELECT * FROM users WHERE id > 5", nil, false},
+		{"SELECT * FROM users", nil, false},
+
+		// qualified columns
+		{"SELECT * FROM users WHERE users.id = 5", []string{"5"}, true},
+		{"SELECT * FROM app.users WHERE app.users.id = 5", []string{"5"}, true},
+		{"SELECT * FROM users u WHERE u.id = 5", []string{"5"}, true},
+		{"SELECT * FROM users AS u WHERE u.id = 5", []string{"5"}, true},
+		{"SELECT * FROM `users` `u` WHERE `u`.`id` = 5", []string{"5"}, true},
+		{"SELECT * FROM users u JOIN orders o ON o.user_id = u.id WHERE o.id = 5", nil, false},
+		{"SELECT * FROM users WHERE other.id = 5", nil, false},
+
+		// negations
+		{"SELECT * FROM users WHERE NOT id = 5", nil, false},
+		{"SELECT * FROM users WHERE NOT (id = 5)", nil, false},
+		{"SELECT * FROM users WHERE !(id = 5)", nil, false},
+		{"SELECT * FROM users WHERE id NOT IN (1, 2)", nil, false},
+		{"SELECT * FROM users WHERE name IS NOT NULL AND id = 7", []string{"7"}, true},
+
+		// nested expressions, comments and strings
+		{"SELECT * FROM users WHERE a IN (SELECT a FROM b WHERE id = 5)", nil, false},
+		{"SELECT * FROM users WHERE note = 'id = 5'", nil, false},
+		{"SELECT * FROM users WHERE /* id = 5 */ a = 1", nil, false},
+		{"SELECT * FROM users WHERE a = 1 -- AND id = 5", nil, false},
+
+		// writes
+		{"UPDATE users SET name = 'x' WHERE id = 4", []string{"4"}, true},
+		{"DELETE FROM users WHERE id = 4", []string{"4"}, true},
+		{"INSERT INTO users (id, name) VALUES (1, 'a'), (2, 'b')", []string{"1", "2"}, true},
+		{"INSERT INTO users (name, id) VALUES (CONCAT('a', 'b'), 3)", []string{"3"}, true},
+		{"INSERT INTO users SET id = 9, name = 'x'", []string{"9"}, true},
+		{"INSERT INTO users (name) VALUES ('a')", nil, false},
+	}
+
+	for _, test := range tests {
+		tokens := lexSQL(test.query)
+		values, keyed := shardKeyValues(tokens, table.key, table.qualifiers(tokens))
+		if keyed != test.keyed || (keyed && !reflect.DeepEqual(values, test.values)) {
+			t.Errorf("shardKeyValues(%q) = %v, %v, want %v, %v", test.query, values, keyed, test.values, test.keyed)
+		}
+	}
+}
+
+func TestScatterLimit(t *testing.T) {
+	tests := []struct {
+		query      string
+		shardQuery string // empty when the query is refused
+		offset     int
+		limit      int
+	}{
+		{"SELECT * FROM users", "SELECT * FROM users", 0, -1},
+		{"SELECT * FROM users ORDER BY id LIMIT 10", "SELECT * FROM users ORDER BY id LIMIT 10", 0, 10},
+		{"SELECT * FROM users LIMIT 5, 10;", "SELECT * FROM users LIMIT 15", 5, 10},
+		{"SELECT * FROM users LIMIT 10 OFFSET 5", "SELECT * FROM users LIMIT 15", 5, 10},
+		{"SELECT * FROM users WHERE id IN (SELECT id FROM vip LIMIT 3)", "SELECT * FROM users WHERE id IN (SELECT id FROM vip LIMIT 3)", 0, -1},
+		{"SELECT * FROM users WHERE note = 'LIMIT 3'", "SELECT * FROM users WHERE note = 'LIMIT 3'", 0, -1},
+		{"SELECT * FROM users -- LIMIT 3", "SELECT * FROM users -- LIMIT 3", 0, -1},
+		{"SELECT * FROM users LIMIT 10 FOR UPDATE", "", 0, 0},
+		{"SELECT * FROM users LIMIT 10 LOCK IN SHARE MODE", "", 0, 0},
+		{"SELECT * FROM users LIMIT 10 /* x */", "", 0, 0},
+		{"SELECT * FROM users LIMIT ?", "", 0, 0},
+	}
+
+	for _, test := range tests {
+		shardQuery, offset, limit, ok := scatterLimit(test.query, lexSQL(test.query))
+		switch {
+		case test.shardQuery == "" && ok:
+			t.Errorf("scatterLimit(%q) = %q, want it refused", test.query, shardQuery)
+		case test.shardQuery != "" && (!ok || shardQuery != test.shardQuery || offset != test.offset || limit != test.limit):
+			t.Errorf("scatterLimit(%q) = %q, %d, %d, %v, want %q, %d, %d", test.query, shardQuery, offset, limit, ok, test.shardQuery, test.offset, test.limit)
+		}
+	}
+}
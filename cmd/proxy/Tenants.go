@@ -0,0 +1,360 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+)
+
+type TenantUserConfig struct {
+	User      string            `yaml:"user"`      // proxy user
+	Tenant    string            `yaml:"tenant"`    // substituted for {tenant} in the template
+	Databases map[string]string `yaml:"databases"` // database the client uses -> database on the backend, overrides the template
+}
+
+type TenantConfig struct {
+	Enabled   bool               `yaml:"enabled"`
+	Databases []string           `yaml:"databases"` // databases mapped for every tenant with the template
+	Template  string             `yaml:"template"`  // backend database name, e.g. {database}_{tenant}
+	Users     []TenantUserConfig `yaml:"users"`
+}
+
+// tenantMapping is the database aliasing of one proxy user
+type tenantMapping struct {
+	toBackend map[string]string // lower case client name -> backend name
+	toClient  map[string]string // lower case backend name -> client name
+}
+
+// Tenants maps the database names clients use to per tenant databases on
+// the backend and back again in results
+type Tenants struct {
+	config *TenantConfig
+	users  map[string]*tenantMapping
+}
+
+func NewTenants(config *TenantConfig) (*Tenants, error) {
+	t := &Tenants{
+		config: config,
+		users:  make(map[string]*tenantMapping),
+	}
+
+	for _, user := range config.Users {
+		if user.User == "" {
+			return nil, fmt.Errorf("tenants: entry without a user")
+		}
+		if _, ok := t.users[user.User]; ok {
+			return nil, fmt.Errorf("tenants: duplicate user: %s", user.User)
+		}
+
+		m := &tenantMapping{
+			toBackend: make(map[string]string),
+			toClient:  make(map[string]string),
+		}
+		add := func(client string, backend string) error {
+			if other, ok := m.toClient[strings.ToLower(backend)]; ok && !strings.EqualFold(other, client) {
+				return fmt.Errorf("tenants: %s maps both %s and %s to %s", user.User, other, client, backend)
+			}
+			m.toBackend[strings.ToLower(client)] = backend
+			m.toClient[strings.ToLower(backend)] = client
+			return nil
+		}
+
+		if user.Tenant != "" && config.Template != "" {
+			for _, database := range config.Databases {
+				backend := strings.NewReplacer("{database}", database, "{tenant}", user.Tenant, "{user}", user.User).Replace(config.Template)
+				if err := add(database, backend); err != nil {
+					return nil, err
+				}
+			}
+		}
+		for client, backend := range user.Databases {
+			if err := add(client, backend); err != nil {
+				return nil, err
+			}
+		}
+
+		t.users[user.User] = m
+	}
+
+	return t, nil
+}
+
+func (t *Tenants) mapping(user string) *tenantMapping {
+	if t == nil || !t.config.Enabled {
+		return nil
+	}
+	return t.users[user]
+}
+
+// MapDatabase returns the backend database for the name a client used
+func (t *Tenants) MapDatabase(user string, database string) string {
+	m := t.mapping(user)
+	if m == nil {
+		return database
+	}
+	if backend, ok := m.toBackend[strings.ToLower(database)]; ok {
+		return backend
+	}
+	return database
+}
+
+// ClientDatabase returns the name the client knows a backend database by
+func (t *Tenants) ClientDatabase(user string, database string) string {
+	m := t.mapping(user)
+	if m == nil {
+		return database
+	}
+	if client, ok := m.toClient[strings.ToLower(database)]; ok {
+		return client
+	}
+	return database
+}
+
+func isIdentifierByte(c byte) bool {
+	return c == '_' || c == '$' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80
+}
+
+// RewriteQuery replaces the client's database names in qualified references
+// (db.table, db.table.column) and in SHOW ... FROM|IN db with the backend
+// names. Strings and comments are left alone.
+func (t *Tenants) RewriteQuery(user string, query string) string {
+	m := t.mapping(user)
+	if m == nil || len(m.toBackend) == 0 {
+		return query
+	}
+
+	isShow := strings.HasPrefix(strings.ToUpper(strings.TrimSpace(query)), "SHOW")
+
+	var out strings.Builder
+	out.Grow(len(query))
+
+	prevWord := ""   // previous identifier or keyword, lower case
+	prevDot := false // whether the previous significant character was a dot
+
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case c == '\'' || c == '"':
+			// copy strings untouched
+			j := i + 1
+			for j < len(query) && query[j] != c {
+				if query[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			j = min(j+1, len(query))
+			out.WriteString(query[i:j])
+			i = j
+			prevWord, prevDot = "", false
+			continue
+		case c == '/' && i+1 < len(query) && query[i+1] == '*':
+			end := strings.Index(query[i+2:], "*/")
+			j := len(query)
+			if end >= 0 {
+				j = i + 2 + end + 2
+			}
+			out.WriteString(query[i:j])
+			i = j
+			continue
+		case c == '#' || (c == '-' && i+2 < len(query) && query[i+1] == '-' && (query[i+2] == ' ' || query[i+2] == '\t')):
+			end := strings.IndexByte(query[i:], '\n')
+			j := len(query)
+			if end >= 0 {
+				j = i + end
+			}
+			out.WriteString(query[i:j])
+			i = j
+			continue
+		case c == '`' || isIdentifierByte(c):
+			// read an identifier, quoted or not
+			var name string
+			j := i
+			if c == '`' {
+				end := strings.IndexByte(query[i+1:], '`')
+				if end < 0 {
+					out.WriteString(query[i:])
+					return out.String()
+				}
+				name = query[i+1 : i+1+end]
+				j = i + 1 + end + 1
+			} else {
+				for j < len(query) && isIdentifierByte(query[j]) {
+					j++
+				}
+				name = query[i:j]
+			}
+
+			// the first part of a qualified name, or the database of SHOW ... FROM db
+			qualifier := !prevDot && j < len(query) && query[j] == '.'
+			showTarget := isShow && !prevDot && (prevWord == "from" || prevWord == "in") && !(j < len(query) && query[j] == '.')
+			backend, ok := m.toBackend[strings.ToLower(name)]
+			if ok && (qualifier || showTarget) {
+				if c == '`' {
+					out.WriteString("`" + strings.ReplaceAll(backend, "`", "``") + "`")
+				} else {
+					out.WriteString(backend)
+				}
+			} else {
+				out.WriteString(query[i:j])
+			}
+
+			prevWord = strings.ToLower(name)
+			prevDot = false
+			i = j
+			continue
+		case c == '.':
+			prevDot = true
+			out.WriteByte(c)
+			i++
+			continue
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			out.WriteByte(c)
+			i++
+			continue
+		}
+
+		out.WriteByte(c)
+		prevWord, prevDot = "", false
+		i++
+	}
+
+	return out.String()
+}
+
+// columns whose values are database names
+var databaseColumns = map[string]bool{
+	"database()":   true,
+	"schema()":     true,
+	"database":     true,
+	"db":           true,
+	"table_schema": true,
+	"schema_name":  true,
+}
+
+// MapResult returns the result with backend database names replaced by the
+// client's in column metadata and in columns that hold database names.
+// Results may be shared with other sessions through the cache, so a copy is
+// returned when anything changes. Values are only rewritten in text results.
+func (t *Tenants) MapResult(user string, res *mysql.Result, text bool) (*mysql.Result, error) {
+	m := t.mapping(user)
+	if m == nil || res == nil || res.Resultset == nil {
+		return res, nil
+	}
+
+	changed := false
+	fields := make([]*mysql.Field, len(res.Fields))
+	valueColumns := make([]int, 0)
+	for i, field := range res.Fields {
+		fields[i] = field
+
+		schema, schemaMapped := m.toClient[strings.ToLower(string(field.Schema))]
+		name := string(field.Name)
+		var newName string
+		if strings.HasPrefix(name, "Tables_in_") {
+			if client, ok := m.toClient[strings.ToLower(strings.TrimPrefix(name, "Tables_in_"))]; ok {
+				newName = "Tables_in_" + client
+			}
+		}
+		if schemaMapped || newName != "" {
+			copied := *field
+			copied.Data = nil // Dump() would send the cached packet otherwise
+			if schemaMapped {
+				copied.Schema = []byte(schema)
+			}
+			if newName != "" {
+				copied.Name = []byte(newName)
+			}
+			fields[i] = &copied
+			changed = true
+		}
+
+		if databaseColumns[strings.ToLower(name)] {
+			valueColumns = append(valueColumns, i)
+		}
+	}
+
+	rowDatas := res.RowDatas
+	if text && len(valueColumns) > 0 {
+		var err error
+		var rowsChanged bool
+		rowDatas, rowsChanged, err = m.mapRows(res.RowDatas, len(fields), valueColumns)
+		if err != nil {
+			return nil, err
+		}
+		changed = changed || rowsChanged
+	}
+
+	if !changed {
+		return res, nil
+	}
+
+	rs := &mysql.Resultset{
+		Fields:     fields,
+		FieldNames: make(map[string]int, len(fields)),
+		RowDatas:   rowDatas,
+	}
+	for i, field := range fields {
+		rs.FieldNames[string(field.Name)] = i
+	}
+	if len(rowDatas) > 0 {
+		rs.Values = make([][]mysql.FieldValue, len(rowDatas))
+		for i, row := range rowDatas {
+			values, err := row.Parse(fields, !text, nil)
+			if err != nil {
+				return nil, err
+			}
+			rs.Values[i] = values
+		}
+	}
+
+	mapped := *res
+	mapped.Resultset = rs
+	return &mapped, nil
+}
+
+// mapRows rewrites database names in the given columns of text protocol rows
+func (m *tenantMapping) mapRows(rows []mysql.RowData, columns int, valueColumns []int) ([]mysql.RowData, bool, error) {
+	mapColumn := make(map[int]bool, len(valueColumns))
+	for _, column := range valueColumns {
+		mapColumn[column] = true
+	}
+
+	changed := false
+	mapped := make([]mysql.RowData, len(rows))
+	for r, row := range rows {
+		mapped[r] = row
+
+		var out []byte
+		pos := 0
+		for column := 0; column < columns; column++ {
+			value, isNull, n, err := mysql.LengthEncodedString(row[pos:])
+			if err != nil {
+				return nil, false, err
+			}
+			raw := row[pos : pos+n]
+			pos += n
+
+			if !isNull && mapColumn[column] {
+				if client, ok := m.toClient[strings.ToLower(string(value))]; ok {
+					if out == nil {
+						out = append(make([]byte, 0, len(row)), row[:pos-n]...)
+					}
+					out = append(out, mysql.PutLengthEncodedString([]byte(client))...)
+					continue
+				}
+			}
+			if out != nil {
+				out = append(out, raw...)
+			}
+		}
+
+		if out != nil {
+			mapped[r] = out
+			changed = true
+		}
+	}
+
+	return mapped, changed, nil
+}
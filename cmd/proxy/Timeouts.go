@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/go-mysql-org/go-mysql/client"
+	"github.com/go-mysql-org/go-mysql/mysql"
+)
+
+type TimeoutRuleConfig struct {
+	Name    string   `yaml:"name"`
+	Users   []string `yaml:"users"`   // proxy users, empty matches everyone
+	Digests []string `yaml:"digests"` // digests produced by QueryDigest
+	Pattern string   `yaml:"pattern"` // regular expression matched against the query
+	Timeout int      `yaml:"timeout"` // milliseconds, 0 means no limit
+}
+
+type TimeoutConfig struct {
+	Enabled bool                `yaml:"enabled"`
+	Default int                 `yaml:"default"` // milliseconds, 0 means no limit
+	Users   map[string]int      `yaml:"users"`   // proxy user -> milliseconds, overrides default
+	Rules   []TimeoutRuleConfig `yaml:"rules"`   // the first matching rule overrides the user and default timeouts
+}
+
+type RetryConfig struct {
+	MaxAttempts int `yaml:"max_attempts"` // attempts of a read failing on a table or database the replica doesn't have yet, 1 never retries
+	Delay       int `yaml:"delay"`        // milliseconds before the first retry, doubled for every further one
+	MaxDelay    int `yaml:"max_delay"`    // milliseconds
+}
+
+// go-mysql has no name for the error MySQL returns when MAX_EXECUTION_TIME
+// stops a statement
+const erQueryTimeout = 3024
+
+// queryTimeoutError is the error MySQL returns for MAX_EXECUTION_TIME
+func queryTimeoutError() error {
+	return mysql.NewError(erQueryTimeout, "Query execution was interrupted, maximum statement execution time exceeded")
+}
+
+// Timeouts decides how long a statement may run before the proxy kills it
+// on the backend
+type Timeouts struct {
+	config *TimeoutConfig
+	rules  []*TimeoutRule
+}
+
+type TimeoutRule struct {
+	config  *TimeoutRuleConfig
+	users   map[string]bool
+	digests map[string]bool
+	pattern *regexp.Regexp
+}
+
+func NewTimeouts(config *TimeoutConfig) (*Timeouts, error) {
+	t := &Timeouts{
+		config: config,
+		rules:  make([]*TimeoutRule, 0, len(config.Rules)),
+	}
+
+	for i := range config.Rules {
+		ruleConfig := &config.Rules[i]
+		rule := &TimeoutRule{
+			config:  ruleConfig,
+			digests: toSet(ruleConfig.Digests, false),
+		}
+		if len(ruleConfig.Users) > 0 {
+			rule.users = make(map[string]bool, len(ruleConfig.Users))
+			for _, user := range ruleConfig.Users {
+				rule.users[user] = true
+			}
+		}
+		if ruleConfig.Pattern != "" {
+			re, err := regexp.Compile(ruleConfig.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("timeouts: rule %d (%s): invalid pattern: %w", i, ruleConfig.Name, err)
+			}
+			rule.pattern = re
+		}
+		if ruleConfig.Timeout < 0 {
+			return nil, fmt.Errorf("timeouts: rule %d (%s): negative timeout", i, ruleConfig.Name)
+		}
+		t.rules = append(t.rules, rule)
+	}
+
+	return t, nil
+}
+
+// For returns the timeout of a statement, 0 when it may run forever
+func (t *Timeouts) For(user string, query string) time.Duration {
+	if t == nil || !t.config.Enabled {
+		return 0
+	}
+
+	var digest string
+	for _, rule := range t.rules {
+		if rule.users != nil && !rule.users[user] {
+			continue
+		}
+		if rule.digests != nil {
+			if digest == "" {
+				digest = QueryDigest(query)
+			}
+			if !rule.digests[digest] {
+				continue
+			}
+		}
+		if rule.pattern != nil && !rule.pattern.MatchString(query) {
+			continue
+		}
+		return time.Duration(rule.config.Timeout) * time.Millisecond
+	}
+
+	if ms, ok := t.config.Users[user]; ok {
+		return time.Duration(ms) * time.Millisecond
+	}
+	return time.Duration(t.config.Default) * time.Millisecond
+}
+
+// RetryPolicy bounds the retries of reads that fail because a replica has
+// not caught up with a table or database created on the primary
+type RetryPolicy struct {
+	config *RetryConfig
+}
+
+func NewRetryPolicy(config *RetryConfig) (*RetryPolicy, error) {
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = 5
+	}
+	if config.Delay <= 0 {
+		config.Delay = 100
+	}
+	if config.MaxDelay <= 0 {
+		config.MaxDelay = max(2000, config.Delay)
+	}
+	if config.MaxDelay < config.Delay {
+		return nil, fmt.Errorf("retry: max_delay %d is less than delay %d", config.MaxDelay, config.Delay)
+	}
+	return &RetryPolicy{config: config}, nil
+}
+
+// Retry reports whether another attempt follows the given failed attempt,
+// attempts are counted from 1
+func (r *RetryPolicy) Retry(attempt int) bool {
+	return attempt < r.config.MaxAttempts
+}
+
+// Delay returns how long to wait after the given failed attempt
+func (r *RetryPolicy) Delay(attempt int) time.Duration {
+	delay := time.Duration(r.config.Delay) * time.Millisecond
+	maxDelay := time.Duration(r.config.MaxDelay) * time.Millisecond
+	for i := 1; i < attempt && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, maxDelay)
+}
+
+// statementTimeout returns the timeout of the statement being executed, a
+// timeout hint takes precedence over the configured timeouts
+func (ph *ProxyHandler) statementTimeout(query string) time.Duration {
+	if ph.hints != nil && ph.hints.Timeout > 0 {
+		return ph.hints.Timeout
+	}
+	return ph.p.timeouts.For(ph.user, query)
+}
+
+// serverOf returns the backend of one of the session's own connections
+func (ph *ProxyHandler) serverOf(conn *client.Conn) *BackendServer {
+	if conn == ph.read_conn {
+		return ph.readServer
+	}
+	return ph.writeServer
+}
+
+// executeWithTimeout runs execute, which uses conn on svr. When it is still
+// running after timeout the statement is stopped with KILL QUERY and the
+// client gets the error MySQL returns for MAX_EXECUTION_TIME.
+func (ph *ProxyHandler) executeWithTimeout(svr *BackendServer, conn *client.Conn, timeout time.Duration, execute func() (*mysql.Result, error)) (*mysql.Result, error) {
+	if timeout <= 0 {
+		return execute()
+	}
+
+	// the kill must not reach the connection once it runs the next statement
+	var mu sync.Mutex
+	var finished, killed bool
+	var killErr error
+	timer := time.AfterFunc(timeout, func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if finished {
+			return
+		}
+		killed = true
+		thread := BackendThread{Server: svr, ID: conn.GetConnectionID()}
+		killErr = ph.killThread(thread, fmt.Sprintf("KILL QUERY %d", thread.ID))
+	})
+
+	res, err := execute()
+	timer.Stop()
+	mu.Lock()
+	finished = true
+	mu.Unlock()
+
+	if killed {
+		ph.logger().Warn("statement timed out", "timeout", timeout, "completed", err == nil, "kill_err", killErr)
+	}
+	if killed && err != nil {
+		return nil, queryTimeoutError()
+	}
+	return res, err
+}
@@ -0,0 +1,533 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	mathrand "math/rand"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-mysql-org/go-mysql/client"
+	"github.com/go-mysql-org/go-mysql/mysql"
+)
+
+const (
+	SpanKindInternal = 1
+	SpanKindServer   = 2
+	SpanKindClient   = 3
+)
+
+type TracingConfig struct {
+	Enabled       bool              `yaml:"enabled"`
+	Exporter      string            `yaml:"exporter"`       // otlp (OTLP/HTTP with JSON encoding) or file
+	Endpoint      string            `yaml:"endpoint"`       // otlp: collector traces URL
+	Headers       map[string]string `yaml:"headers"`        // otlp: extra request headers, e.g. for authentication
+	Path          string            `yaml:"path"`           // file: spans are appended as JSON lines
+	ServiceName   string            `yaml:"service_name"`   // service.name resource attribute
+	SampleRate    float64           `yaml:"sample_rate"`    // fraction of traces started by the proxy, a traceparent's sampled flag always wins
+	QueueSize     int               `yaml:"queue_size"`     // finished spans waiting for export, more are dropped
+	BatchSize     int               `yaml:"batch_size"`     // spans per export
+	FlushInterval int               `yaml:"flush_interval"` // seconds between exports of a partial batch
+	Timeout       int               `yaml:"timeout"`        // otlp: seconds per export request
+}
+
+// Span is one timed operation of a trace. All methods accept a nil span,
+// which is what unsampled or disabled tracing hands out.
+type Span struct {
+	tracer     *Tracer
+	traceID    [16]byte
+	spanID     [8]byte
+	parentID   [8]byte
+	name       string
+	kind       int
+	start      time.Time
+	end        time.Time
+	mu         sync.Mutex
+	attributes map[string]interface{}
+	err        string
+}
+
+// Tracer hands out spans and exports finished ones in the background
+type Tracer struct {
+	config   *TracingConfig
+	redactor *Redactor // keeps literal values out of exported error messages
+	spans    chan *Span
+	done     chan struct{}
+	wg       sync.WaitGroup
+	client   *http.Client
+	file     *os.File
+	dropped  atomic.Uint64
+}
+
+func NewTracer(config *TracingConfig, redactor *Redactor) (*Tracer, error) {
+	if config.Exporter == "" {
+		config.Exporter = "otlp"
+	}
+	if config.Endpoint == "" {
+		config.Endpoint = "http://localhost:4318/v1/traces"
+	}
+	if config.Path == "" {
+		config.Path = "data/traces.jsonl"
+	}
+	if config.ServiceName == "" {
+		config.ServiceName = "dbinsight-proxy"
+	}
+	if config.SampleRate == 0 {
+		config.SampleRate = 1
+	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = 4096
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = 512
+	}
+	if config.FlushInterval <= 0 {
+		config.FlushInterval = 5
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 10
+	}
+
+	switch config.Exporter {
+	case "otlp", "file":
+	default:
+		return nil, fmt.Errorf("tracing: unknown exporter: %s", config.Exporter)
+	}
+	if config.SampleRate < 0 || config.SampleRate > 1 {
+		return nil, fmt.Errorf("tracing: sample_rate must be between 0 and 1")
+	}
+
+	return &Tracer{
+		config:   config,
+		redactor: redactor,
+		spans:    make(chan *Span, config.QueueSize),
+		done:     make(chan struct{}),
+		client:   &http.Client{Timeout: time.Duration(config.Timeout) * time.Second},
+	}, nil
+}
+
+func (t *Tracer) Start() error {
+	if !t.config.Enabled {
+		return nil
+	}
+
+	if t.config.Exporter == "file" {
+		file, err := os.OpenFile(t.config.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+		if err != nil {
+			return fmt.Errorf("tracing: %w", err)
+		}
+		t.file = file
+	}
+
+	t.wg.Add(1)
+	go t.exporter()
+
+	logFor("tracing").Info("exporting spans", "destination", t.destination())
+	return nil
+}
+
+// Stop exports the spans still queued
+func (t *Tracer) Stop() {
+	if !t.config.Enabled {
+		return
+	}
+	close(t.done)
+	t.wg.Wait()
+	if t.file != nil {
+		t.file.Close()
+	}
+	if dropped := t.dropped.Load(); dropped > 0 {
+		logFor("tracing").Warn("dropped spans", "count", dropped)
+	}
+}
+
+func (t *Tracer) destination() string {
+	if t.config.Exporter == "file" {
+		return t.config.Path
+	}
+	return t.config.Endpoint
+}
+
+func (t *Tracer) exporter() {
+	defer t.wg.Done()
+
+	ticker := time.NewTicker(time.Duration(t.config.FlushInterval) * time.Second)
+	defer ticker.Stop()
+
+	batch := make([]*Span, 0, t.config.BatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.export(batch); err != nil {
+			logFor("tracing").Error("failed to export spans", "count", len(batch), "destination", t.destination(), "err", err)
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case span := <-t.spans:
+			batch = append(batch, span)
+			if len(batch) >= t.config.BatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-t.done:
+			for {
+				select {
+				case span := <-t.spans:
+					batch = append(batch, span)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// traceparentRe matches a W3C traceparent, version 00
+var traceparentRe = regexp.MustCompile(`^00-([0-9a-f]{32})-([0-9a-f]{16})-([0-9a-f]{2})$`)
+
+// parseTraceparent returns the trace and parent span of a traceparent
+// header value, ok is false when it is missing or malformed
+func parseTraceparent(value string) (traceID [16]byte, parentID [8]byte, sampled bool, ok bool) {
+	m := traceparentRe.FindStringSubmatch(strings.ToLower(strings.TrimSpace(value)))
+	if m == nil {
+		return traceID, parentID, false, false
+	}
+	hex.Decode(traceID[:], []byte(m[1]))
+	hex.Decode(parentID[:], []byte(m[2]))
+	if traceID == [16]byte{} || parentID == [8]byte{} {
+		return traceID, parentID, false, false
+	}
+	flags, _ := strconv.ParseUint(m[3], 16, 8)
+	return traceID, parentID, flags&1 == 1, true
+}
+
+// commentTraceparentRe finds traceparent='...' in a comment, as sqlcommenter
+// and similar libraries write it
+var commentTraceparentRe = regexp.MustCompile(`(?i)traceparent\s*[=:]\s*['"]?([0-9a-f]{2}-[0-9a-f]{32}-[0-9a-f]{16}-[0-9a-f]{2})`)
+
+// queryTraceparent returns the traceparent passed in a comment of the query
+func queryTraceparent(query string) string {
+	for rest := query; ; {
+		start := strings.Index(rest, "/*")
+		if start < 0 {
+			return ""
+		}
+		end := strings.Index(rest[start+2:], "*/")
+		if end < 0 {
+			return ""
+		}
+		if m := commentTraceparentRe.FindStringSubmatch(rest[start+2 : start+2+end]); m != nil {
+			return m[1]
+		}
+		rest = rest[start+2+end+2:]
+	}
+}
+
+// StartSpan starts a trace, continuing the one of traceparent when it is
+// valid. It returns nil when tracing is off or the trace is not sampled.
+func (t *Tracer) StartSpan(traceparent string, name string, kind int, start time.Time) *Span {
+	if t == nil || !t.config.Enabled {
+		return nil
+	}
+
+	span := &Span{
+		tracer: t,
+		name:   name,
+		kind:   kind,
+		start:  start,
+	}
+	if traceID, parentID, sampled, ok := parseTraceparent(traceparent); ok {
+		if !sampled {
+			return nil
+		}
+		span.traceID = traceID
+		span.parentID = parentID
+	} else {
+		if t.config.SampleRate < 1 && mathrand.Float64() >= t.config.SampleRate {
+			return nil
+		}
+		rand.Read(span.traceID[:])
+	}
+	rand.Read(span.spanID[:])
+	return span
+}
+
+// Child starts a span within the span's trace
+func (s *Span) Child(name string, kind int) *Span {
+	return s.ChildAt(name, kind, time.Now())
+}
+
+func (s *Span) ChildAt(name string, kind int, start time.Time) *Span {
+	if s == nil {
+		return nil
+	}
+	child := &Span{
+		tracer:   s.tracer,
+		traceID:  s.traceID,
+		parentID: s.spanID,
+		name:     name,
+		kind:     kind,
+		start:    start,
+	}
+	rand.Read(child.spanID[:])
+	return child
+}
+
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.attributes == nil {
+		s.attributes = make(map[string]interface{})
+	}
+	s.attributes[key] = value
+	s.mu.Unlock()
+}
+
+// SetError marks the span as failed when err is set, the message is
+// redacted like logged errors since errors often quote values
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	message := s.tracer.redactor.Error(err)
+	s.mu.Lock()
+	s.err = message
+	s.mu.Unlock()
+}
+
+// Traceparent returns the W3C traceparent of the span
+func (s *Span) Traceparent() string {
+	if s == nil {
+		return ""
+	}
+	return fmt.Sprintf("00-%x-%x-01", s.traceID, s.spanID)
+}
+
+func (s *Span) End() {
+	s.EndAt(time.Now())
+}
+
+// EndAt finishes the span and queues it for export, a full queue drops it
+func (s *Span) EndAt(end time.Time) {
+	if s == nil {
+		return
+	}
+	s.end = end
+	select {
+	case s.tracer.spans <- s:
+	default:
+		s.tracer.dropped.Add(1)
+	}
+}
+
+// otlpValue is an OTLP AnyValue, 64 bit integers are strings in OTLP JSON
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"` // 2 is error
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+func attribute(key string, value interface{}) otlpAttribute {
+	a := otlpAttribute{Key: key}
+	switch v := value.(type) {
+	case int:
+		s := strconv.FormatInt(int64(v), 10)
+		a.Value.IntValue = &s
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		a.Value.IntValue = &s
+	case uint64:
+		s := strconv.FormatUint(v, 10)
+		a.Value.IntValue = &s
+	case uint32:
+		s := strconv.FormatUint(uint64(v), 10)
+		a.Value.IntValue = &s
+	case float64:
+		a.Value.DoubleValue = &v
+	case bool:
+		a.Value.BoolValue = &v
+	default:
+		s := fmt.Sprintf("%v", v)
+		a.Value.StringValue = &s
+	}
+	return a
+}
+
+func (s *Span) otlp() otlpSpan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	span := otlpSpan{
+		TraceID:           hex.EncodeToString(s.traceID[:]),
+		SpanID:            hex.EncodeToString(s.spanID[:]),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+	}
+	if s.parentID != [8]byte{} {
+		span.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+	for key, value := range s.attributes {
+		span.Attributes = append(span.Attributes, attribute(key, value))
+	}
+	if s.err != "" {
+		span.Status = otlpStatus{Code: 2, Message: s.err}
+	}
+	return span
+}
+
+func (t *Tracer) export(batch []*Span) error {
+	spans := make([]otlpSpan, len(batch))
+	for i, span := range batch {
+		spans[i] = span.otlp()
+	}
+
+	if t.file != nil {
+		w := bufio.NewWriter(t.file)
+		encoder := json.NewEncoder(w)
+		for _, span := range spans {
+			if err := encoder.Encode(span); err != nil {
+				return err
+			}
+		}
+		return w.Flush()
+	}
+
+	request := map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": []otlpAttribute{attribute("service.name", t.config.ServiceName)},
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]string{"name": "dbinsight"},
+						"spans": spans,
+					},
+				},
+			},
+		},
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, t.config.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range t.config.Headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector returned %s", resp.Status)
+	}
+	return nil
+}
+
+// tracedBorrow takes a backend connection from the server's pool, recording
+// how long it waited for one in a backend.borrow span
+func tracedBorrow(parent *Span, server *BackendServer, key UserKey) (*client.Conn, error) {
+	start := time.Now()
+	borrow := parent.ChildAt("backend.borrow", SpanKindInternal, start)
+	conn, err := server.GetNextConn(key)
+	borrow.SetAttribute("server.address", server.address)
+	borrow.SetAttribute("dbinsight.pool_wait_ms", float64(time.Since(start).Microseconds())/1000)
+	borrow.SetError(err)
+	borrow.End()
+	return conn, err
+}
+
+// startStatementSpan starts the trace of a statement, continuing the one
+// passed in a comment of the query or in the connection attributes
+func (ph *ProxyHandler) startStatementSpan(name string, query string, start time.Time) {
+	traceparent := queryTraceparent(query)
+	if traceparent == "" {
+		traceparent = ph.traceparent
+	}
+
+	ph.span = ph.p.tracer.StartSpan(traceparent, name, SpanKindServer, start)
+	ph.span.SetAttribute("db.system", "mysql")
+	ph.span.SetAttribute("db.user", ph.user)
+	ph.span.SetAttribute("db.name", ph.databaseName)
+	ph.span.SetAttribute("db.statement", ph.p.redactor.Query(query))
+	ph.span.SetAttribute("client.address", ph.remoteAddr)
+	ph.span.SetAttribute("dbinsight.connection_id", ph.connectionID)
+}
+
+// traceResult records the outcome of the statement on its span, the
+// handler is done with it from here on
+func (ph *ProxyHandler) traceResult(res *mysql.Result, err error) {
+	ph.handled = time.Now()
+	if ph.span == nil {
+		return
+	}
+	ph.span.SetError(err)
+	ph.span.SetAttribute("dbinsight.backend", ph.lastBackend)
+	if res != nil {
+		ph.span.SetAttribute("db.rows_affected", res.AffectedRows)
+		if res.Resultset != nil {
+			ph.span.SetAttribute("db.rows", len(res.RowDatas))
+		}
+	}
+}
+
+// endStatementSpan finishes the statement trace once the result has been
+// written to the client, handled is when the handler returned it
+func (ph *ProxyHandler) endStatementSpan(handled time.Time) {
+	if ph.span == nil {
+		return
+	}
+	ph.span.ChildAt("result.send", SpanKindInternal, handled).End()
+	ph.span.End()
+	ph.span = nil
+}
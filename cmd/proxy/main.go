@@ -3,7 +3,6 @@ package main
 import (
 	"flag"
 	"fmt"
-	"log"
 	"os"
 	"runtime"
 
@@ -13,8 +12,9 @@ import (
 )
 
 type ReplicaConfig struct {
-	Host string `yaml:"host"`
-	Port int    `yaml:"port"`
+	Host  string `yaml:"host"`
+	Port  int    `yaml:"port"`
+	Group string `yaml:"group"` // optional replica group used by replica_group routing hints
 }
 
 type AuthenticationMapItem struct {
@@ -38,6 +38,26 @@ type Config struct {
 	HealthCheckDelay       int                     `yaml:"health_check_delay"`
 	BackendReplicas        []ReplicaConfig         `yaml:"backend_replicas"` // A slice of ReplicaConfig
 	AuthenticationMap      []AuthenticationMapItem `yaml:"authentication_map"`
+	Firewall               FirewallConfig          `yaml:"firewall"`
+	Allowlist              AllowlistConfig         `yaml:"allowlist"`
+	Rewrite                RewriteConfig           `yaml:"rewrite"`
+	Cache                  CacheConfig             `yaml:"cache"`
+	Coalesce               CoalesceConfig          `yaml:"coalesce"`
+	Binlog                 BinlogConfig            `yaml:"binlog"`
+	Clusters               []ClusterConfig         `yaml:"clusters"` // additional clusters, the backend_primary_* settings form the default cluster
+	Sharding               ShardingConfig          `yaml:"sharding"`
+	Tenants                TenantConfig            `yaml:"tenants"`
+	Masking                MaskingConfig           `yaml:"masking"`
+	Encryption             EncryptionConfig        `yaml:"encryption"`
+	Mirror                 MirrorConfig            `yaml:"mirror"`
+	Capture                CaptureConfig           `yaml:"capture"`
+	Audit                  AuditConfig             `yaml:"audit"`
+	Redaction              RedactionConfig         `yaml:"redaction"`
+	Tracing                TracingConfig           `yaml:"tracing"`
+	Logging                LoggingConfig           `yaml:"logging"`
+	Kill                   KillConfig              `yaml:"kill"`
+	Timeouts               TimeoutConfig           `yaml:"timeouts"`
+	Retry                  RetryConfig             `yaml:"retry"`
 }
 
 func (c *Config) GetBackendUser(user string) (string, error) {
@@ -102,21 +122,30 @@ func main() {
 	if *cpuprofile != "" {
 		f, err := os.Create(*cpuprofile)
 		if err != nil {
-			log.Fatal("could not create CPU profile: ", err)
+			logFor("proxy").Error("could not create CPU profile", "err", err)
+			os.Exit(1)
 		}
 		defer f.Close() // make sure to close it when we're done
 		if err := pprof.StartCPUProfile(f); err != nil {
-			log.Fatal("could not start CPU profile: ", err)
+			logFor("proxy").Error("could not start CPU profile", "err", err)
+			os.Exit(1)
 		}
 		defer pprof.StopCPUProfile()
 	}
 
 	cfg, err := loadConfig()
 	if err != nil {
-		fmt.Println("Couldn't load configuration file")
+		logFor("proxy").Error("couldn't load configuration file", "err", err)
 		os.Exit(1)
 	}
 
+	if err := SetupLogging(&cfg.Logging); err != nil {
+		logFor("proxy").Error("couldn't set up logging", "err", err)
+		os.Exit(1)
+	}
+	defer logs.Close()
+	logger := logFor("proxy")
+
 	logQueries := flag.Bool("log-queries", false, "Enable logging of queries")
 
 	// Parse the command-line arguments.  This must be done *before*
@@ -125,29 +154,23 @@ func main() {
 
 	// Access the flag's value.
 	if *logQueries {
-		fmt.Println("Query logging is enabled")
 		cfg.LogQueries = true
-	} else {
-		fmt.Println("Query logging is disabled")
 	}
+	logger.Info("query logging", "enabled", cfg.LogQueries)
 
 	// Access any other command-line arguments (non-flags)
 	if flag.NArg() > 0 {
-		fmt.Println("Non-flag arguments:")
-		for _, arg := range flag.Args() {
-			fmt.Println(arg)
-		}
+		logger.Warn("ignoring non-flag arguments", "args", flag.Args())
 	}
 
-	fmt.Println("MySQL Primary Host:", cfg.BackendPrimaryHost)
-	fmt.Println("Replicas:")
+	logger.Info("primary", "host", cfg.BackendPrimaryHost, "port", cfg.BackendPrimaryPort)
 	for i, replica := range cfg.BackendReplicas {
-		fmt.Printf("  Replica %d: Host=%s, Port=%d\n", i+1, replica.Host, replica.Port)
+		logger.Info("replica", "replica", i+1, "host", replica.Host, "port", replica.Port, "group", replica.Group)
 	}
 
 	p, err := NewProxy(cfg)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error starting proxy: %v", err)
+		logger.Error("error starting proxy", "err", err)
 		os.Exit(1)
 	}
 
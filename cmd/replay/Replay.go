@@ -0,0 +1,289 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/go-mysql-org/go-mysql/client"
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/jbhall78/dbinsight/internal/capture"
+)
+
+// records are handed to sessions this long before they are due so reading
+// the capture never delays them
+const lookahead = time.Second
+
+// Replay sends the sessions of a capture to a target, every recorded session
+// on its own connection so the original concurrency is kept, each command
+// at the offset from the start of the capture it was recorded at divided
+// by the speed factor
+type Replay struct {
+	config *Config
+	users  map[string]UserConfig
+	stats  *Stats
+
+	sessions map[uint64]*session
+	wg       sync.WaitGroup
+	stop     chan struct{}
+	stopOnce sync.Once
+
+	base  int64     // time of the first record
+	start time.Time // when the first record was replayed
+}
+
+func NewReplay(config *Config) (*Replay, error) {
+	if config.Speed < 0 {
+		return nil, fmt.Errorf("speed must not be negative")
+	}
+
+	users := make(map[string]UserConfig)
+	for _, user := range config.Users {
+		users[user.User] = user
+	}
+
+	return &Replay{
+		config:   config,
+		users:    users,
+		stats:    NewStats(),
+		sessions: make(map[uint64]*session),
+		stop:     make(chan struct{}),
+	}, nil
+}
+
+func (r *Replay) Stop() {
+	r.stopOnce.Do(func() { close(r.stop) })
+}
+
+func (r *Replay) Report() *Report {
+	return r.stats.Report()
+}
+
+// due returns when a record must be sent
+func (r *Replay) due(record *capture.Record) time.Time {
+	if r.config.Speed == 0 {
+		return r.start
+	}
+	offset := time.Duration(float64(record.Time-r.base) / r.config.Speed)
+	return r.start.Add(offset)
+}
+
+// wait sleeps until t, false when the replay was stopped meanwhile
+func (r *Replay) wait(t time.Time) bool {
+	d := time.Until(t)
+	if d <= 0 {
+		select {
+		case <-r.stop:
+			return false
+		default:
+			return true
+		}
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-r.stop:
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// Run reads the capture and dispatches its records to the sessions, then
+// waits for every session to finish
+func (r *Replay) Run() error {
+	reader, err := capture.Open(r.config.Capture)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	defer func() {
+		for _, s := range r.sessions {
+			close(s.records)
+		}
+		r.wg.Wait()
+	}()
+
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if r.start.IsZero() {
+			r.base = record.Time
+			r.start = time.Now()
+			log.Printf("replaying %s against %s:%d at %gx", r.config.Capture, r.config.Host, r.config.Port, r.config.Speed)
+		}
+
+		if !r.wait(r.due(record).Add(-lookahead)) {
+			return fmt.Errorf("replay stopped")
+		}
+
+		s, ok := r.sessions[record.Session]
+		if !ok {
+			s = r.newSession(record.Session)
+			r.sessions[record.Session] = s
+		}
+		s.records <- record
+
+		if record.Type == capture.TypeDisconnect {
+			close(s.records)
+			delete(r.sessions, record.Session)
+		}
+	}
+}
+
+// session replays the records of one recorded session on its own connection
+type session struct {
+	id      uint64
+	records chan *capture.Record
+	conn    *client.Conn
+	stmts   map[uint32]*client.Stmt
+	digests map[uint32]string // digest of each prepared statement
+	failed  bool              // the connection could not be made, the rest is skipped
+}
+
+func (r *Replay) newSession(id uint64) *session {
+	s := &session{
+		id:      id,
+		records: make(chan *capture.Record, 10000),
+		stmts:   make(map[uint32]*client.Stmt),
+		digests: make(map[uint32]string),
+	}
+	r.stats.Sessions.Add(1)
+
+	r.wg.Add(1)
+	go r.runSession(s)
+	return s
+}
+
+func (r *Replay) runSession(s *session) {
+	defer r.wg.Done()
+	defer s.close()
+
+	for record := range s.records {
+		if !r.wait(r.due(record)) {
+			// drain so the dispatcher never blocks on a stopped session
+			continue
+		}
+		r.execute(s, record)
+	}
+}
+
+func (s *session) close() {
+	for _, stmt := range s.stmts {
+		stmt.Close()
+	}
+	if s.conn != nil {
+		s.conn.Close()
+	}
+}
+
+func (r *Replay) connect(s *session, user string, database string) {
+	password := r.config.Password
+	as := user
+	if u, ok := r.users[user]; ok {
+		password = u.Password
+		if u.As != "" {
+			as = u.As
+		}
+	} else if user == "" {
+		as = r.config.User
+	}
+
+	conn, err := client.Connect(fmt.Sprintf("%s:%d", r.config.Host, r.config.Port), as, password, database)
+	if err != nil {
+		log.Printf("session %d: failed to connect as %s: %v", s.id, as, err)
+		r.stats.ConnectErrors.Add(1)
+		s.failed = true
+		return
+	}
+	s.conn = conn
+}
+
+func errorCode(err error) uint16 {
+	if err == nil {
+		return 0
+	}
+	var myErr *mysql.MyError
+	if errors.As(err, &myErr) {
+		return myErr.Code
+	}
+	return mysql.ER_UNKNOWN_ERROR
+}
+
+func (r *Replay) execute(s *session, record *capture.Record) {
+	switch record.Type {
+	case capture.TypeConnect:
+		r.connect(s, record.User, record.Database)
+		return
+	case capture.TypeDisconnect:
+		// the dispatcher closes the channel after this record
+		return
+	}
+	if s.failed {
+		if record.Type != capture.TypeClose {
+			r.stats.Skipped.Add(1)
+		}
+		return
+	}
+	if s.conn == nil {
+		// the connect record was not captured
+		r.connect(s, "", "")
+		if s.failed {
+			r.stats.Skipped.Add(1)
+			return
+		}
+	}
+
+	start := time.Now()
+	switch record.Type {
+	case capture.TypeQuery:
+		_, err := s.conn.Execute(record.Query)
+		r.stats.Add(record.Digest, record.Query, record, time.Since(start), errorCode(err))
+
+	case capture.TypePrepare:
+		stmt, err := s.conn.Prepare(record.Query)
+		s.digests[record.Statement] = record.Digest
+		if err == nil {
+			s.stmts[record.Statement] = stmt
+		}
+		r.stats.Add(record.Digest, record.Query, record, time.Since(start), errorCode(err))
+
+	case capture.TypeExecute:
+		digest := s.digests[record.Statement]
+		stmt, ok := s.stmts[record.Statement]
+		if !ok {
+			r.stats.Add(digest, "", record, 0, mysql.ER_UNKNOWN_STMT_HANDLER)
+			return
+		}
+		args, err := capture.DecodeArgs(record.Args)
+		if err != nil {
+			log.Printf("session %d: %v", s.id, err)
+			r.stats.Skipped.Add(1)
+			return
+		}
+		start = time.Now()
+		_, err = stmt.Execute(args...)
+		r.stats.Add(digest, "", record, time.Since(start), errorCode(err))
+
+	case capture.TypeUseDB:
+		err := s.conn.UseDB(record.Database)
+		r.stats.Add("COM_INIT_DB", "COM_INIT_DB", record, time.Since(start), errorCode(err))
+
+	case capture.TypeClose:
+		if stmt, ok := s.stmts[record.Statement]; ok {
+			stmt.Close()
+			delete(s.stmts, record.Statement)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jbhall78/dbinsight/internal/capture"
+)
+
+// digestStats holds the recorded and replayed latencies of one digest
+type digestStats struct {
+	query          string // first query seen, as an example
+	recorded       []time.Duration
+	replayed       []time.Duration
+	recordedErrors int
+	replayedErrors int
+	changedErrors  int // different error code than recorded
+}
+
+type Stats struct {
+	Sessions      atomic.Int64
+	ConnectErrors atomic.Int64
+	Skipped       atomic.Int64 // commands of sessions that could not connect
+
+	mu      sync.Mutex
+	digests map[string]*digestStats
+}
+
+func NewStats() *Stats {
+	return &Stats{digests: make(map[string]*digestStats)}
+}
+
+// Add records the outcome of replaying a command
+func (s *Stats) Add(digest string, query string, record *capture.Record, latency time.Duration, code uint16) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d, ok := s.digests[digest]
+	if !ok {
+		d = &digestStats{}
+		s.digests[digest] = d
+	}
+	if d.query == "" {
+		d.query = query
+	}
+
+	d.recorded = append(d.recorded, time.Duration(record.Duration)*time.Microsecond)
+	d.replayed = append(d.replayed, latency)
+	if record.Error != 0 {
+		d.recordedErrors++
+	}
+	if code != 0 {
+		d.replayedErrors++
+	}
+	if code != record.Error {
+		d.changedErrors++
+	}
+}
+
+type Latencies struct {
+	P50 float64 `json:"p50_ms"`
+	P95 float64 `json:"p95_ms"`
+	P99 float64 `json:"p99_ms"`
+	Max float64 `json:"max_ms"`
+}
+
+func percentile(sorted []time.Duration, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(float64(len(sorted)-1) * p)
+	return float64(sorted[i].Microseconds()) / 1000
+}
+
+func latencies(durations []time.Duration) Latencies {
+	sorted := append([]time.Duration(nil), durations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return Latencies{
+		P50: percentile(sorted, 0.50),
+		P95: percentile(sorted, 0.95),
+		P99: percentile(sorted, 0.99),
+		Max: percentile(sorted, 1),
+	}
+}
+
+type DigestReport struct {
+	Digest         string    `json:"digest"`
+	Query          string    `json:"query"`
+	Count          int       `json:"count"`
+	Recorded       Latencies `json:"recorded"`
+	Replayed       Latencies `json:"replayed"`
+	RecordedErrors int       `json:"recorded_errors"`
+	ReplayedErrors int       `json:"replayed_errors"`
+	ChangedErrors  int       `json:"changed_errors"`
+}
+
+// Report compares the replay to the capture. Recorded latencies are the time
+// the proxy took to answer, replayed ones are measured by the client so
+// they also include the network to the target.
+type Report struct {
+	Sessions       int64          `json:"sessions"`
+	ConnectErrors  int64          `json:"connect_errors"`
+	Skipped        int64          `json:"skipped"`
+	Commands       int            `json:"commands"`
+	Recorded       Latencies      `json:"recorded"`
+	Replayed       Latencies      `json:"replayed"`
+	RecordedErrors int            `json:"recorded_errors"`
+	ReplayedErrors int            `json:"replayed_errors"`
+	Digests        []DigestReport `json:"digests"`
+}
+
+func (s *Stats) Report() *Report {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	report := &Report{
+		Sessions:      s.Sessions.Load(),
+		ConnectErrors: s.ConnectErrors.Load(),
+		Skipped:       s.Skipped.Load(),
+	}
+
+	var recorded, replayed []time.Duration
+	for digest, d := range s.digests {
+		report.Digests = append(report.Digests, DigestReport{
+			Digest:         digest,
+			Query:          d.query,
+			Count:          len(d.replayed),
+			Recorded:       latencies(d.recorded),
+			Replayed:       latencies(d.replayed),
+			RecordedErrors: d.recordedErrors,
+			ReplayedErrors: d.replayedErrors,
+			ChangedErrors:  d.changedErrors,
+		})
+		recorded = append(recorded, d.recorded...)
+		replayed = append(replayed, d.replayed...)
+		report.RecordedErrors += d.recordedErrors
+		report.ReplayedErrors += d.replayedErrors
+	}
+	report.Commands = len(replayed)
+	report.Recorded = latencies(recorded)
+	report.Replayed = latencies(replayed)
+
+	// busiest digests first
+	sort.Slice(report.Digests, func(i, j int) bool {
+		if report.Digests[i].Count != report.Digests[j].Count {
+			return report.Digests[i].Count > report.Digests[j].Count
+		}
+		return report.Digests[i].Digest < report.Digests[j].Digest
+	})
+
+	return report
+}
+
+func (r *Report) Print(out io.Writer) {
+	fmt.Fprintf(out, "sessions: %d, connect errors: %d, skipped commands: %d\n", r.Sessions, r.ConnectErrors, r.Skipped)
+	fmt.Fprintf(out, "commands: %d, errors recorded: %d, errors replayed: %d\n", r.Commands, r.RecordedErrors, r.ReplayedErrors)
+	fmt.Fprintf(out, "latency recorded p50/p95/p99: %.2f/%.2f/%.2f ms, replayed: %.2f/%.2f/%.2f ms\n\n",
+		r.Recorded.P50, r.Recorded.P95, r.Recorded.P99, r.Replayed.P50, r.Replayed.P95, r.Replayed.P99)
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "DIGEST\tCOUNT\tREC P50\tREP P50\tREC P99\tREP P99\tREC ERR\tREP ERR\tCHANGED\tQUERY")
+	for _, d := range r.Digests {
+		query := d.Query
+		if len(query) > 60 {
+			query = query[:57] + "..."
+		}
+		fmt.Fprintf(w, "%s\t%d\t%.2f\t%.2f\t%.2f\t%.2f\t%d\t%d\t%d\t%s\n",
+			d.Digest, d.Count, d.Recorded.P50, d.Replayed.P50, d.Recorded.P99, d.Replayed.P99,
+			d.RecordedErrors, d.ReplayedErrors, d.ChangedErrors, query)
+	}
+	w.Flush()
+}
+
+func (r *Report) Save(path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, data, 0640); err != nil {
+		return fmt.Errorf("failed to write report: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"gopkg.in/yaml.v3"
+)
+
+type UserConfig struct {
+	User     string `yaml:"user"`     // user recorded in the capture
+	Password string `yaml:"password"` // password on the target
+	As       string `yaml:"as"`       // user to connect as on the target, defaults to the recorded one
+}
+
+type Config struct {
+	Capture  string       `yaml:"capture"` // capture file or directory written by the proxy
+	Host     string       `yaml:"host"`    // target, the proxy or MySQL directly
+	Port     int          `yaml:"port"`
+	User     string       `yaml:"user"` // used for recorded users without an entry in users
+	Password string       `yaml:"password"`
+	Users    []UserConfig `yaml:"users"`
+	Speed    float64      `yaml:"speed"`  // 1 keeps the recorded timing, 2 replays twice as fast, 0 sends as fast as possible
+	Report   string       `yaml:"report"` // JSON report file, the summary is always printed
+}
+
+func loadConfig(path string) (*Config, error) {
+	config := Config{
+		Capture: "data/capture",
+		Host:    "127.0.0.1",
+		Port:    3306,
+		User:    "root",
+		Speed:   1,
+	}
+
+	configFile, err := os.Open(path)
+	if err != nil {
+		// for debugging
+		configFile, err = os.Open("../../" + path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open config file: %w", err)
+		}
+	}
+	defer configFile.Close()
+
+	decoder := yaml.NewDecoder(configFile)
+	err = decoder.Decode(&config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode config file: %w", err)
+	}
+
+	return &config, nil
+}
+
+func main() {
+	configPath := flag.String("config", "data/config/replay.yaml", "path to the configuration file")
+	capturePath := flag.String("capture", "", "capture file or directory, overrides the configuration")
+	speed := flag.Float64("speed", -1, "speed-up factor, overrides the configuration")
+	flag.Parse()
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *capturePath != "" {
+		cfg.Capture = *capturePath
+	}
+	if *speed >= 0 {
+		cfg.Speed = *speed
+	}
+
+	replay, err := NewReplay(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	sigchan := make(chan os.Signal, 1)
+	signal.Notify(sigchan, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigchan
+		log.Println("Received Unix signal, stopping replay...")
+		replay.Stop()
+	}()
+
+	if err := replay.Run(); err != nil {
+		log.Println(err)
+	}
+
+	report := replay.Report()
+	report.Print(os.Stdout)
+	if cfg.Report != "" {
+		if err := report.Save(cfg.Report); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
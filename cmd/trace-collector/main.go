@@ -0,0 +1,121 @@
+// a stand in for an OpenTelemetry collector when testing the proxy's
+// tracing, it accepts OTLP/HTTP JSON exports and prints the spans
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type attribute struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+type span struct {
+	TraceID           string      `json:"traceId"`
+	SpanID            string      `json:"spanId"`
+	ParentSpanID      string      `json:"parentSpanId"`
+	Name              string      `json:"name"`
+	StartTimeUnixNano string      `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string      `json:"endTimeUnixNano"`
+	Attributes        []attribute `json:"attributes"`
+	Status            struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"status"`
+}
+
+type exportRequest struct {
+	ResourceSpans []struct {
+		ScopeSpans []struct {
+			Spans []span `json:"spans"`
+		} `json:"scopeSpans"`
+	} `json:"resourceSpans"`
+}
+
+func main() {
+	listen := flag.String("listen", "localhost:4318", "address to accept OTLP/HTTP exports on")
+	raw := flag.String("raw", "", "also append the received requests to this file")
+	flag.Parse()
+
+	var mu sync.Mutex
+	var rawFile *os.File
+	if *raw != "" {
+		var err error
+		rawFile, err = os.OpenFile(*raw, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer rawFile.Close()
+	}
+
+	http.HandleFunc("/v1/traces", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+			http.Error(w, "only the JSON encoding is supported", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		var req exportRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				for _, s := range ss.Spans {
+					printSpan(&s)
+					if rawFile != nil {
+						line, _ := json.Marshal(s)
+						rawFile.Write(append(line, '\n'))
+					}
+				}
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("{}"))
+	})
+
+	log.Printf("accepting OTLP/HTTP JSON exports on http://%s/v1/traces", *listen)
+	log.Fatal(http.ListenAndServe(*listen, nil))
+}
+
+func printSpan(s *span) {
+	start, _ := strconv.ParseInt(s.StartTimeUnixNano, 10, 64)
+	end, _ := strconv.ParseInt(s.EndTimeUnixNano, 10, 64)
+
+	attributes := make([]string, 0, len(s.Attributes))
+	for _, a := range s.Attributes {
+		for _, value := range a.Value {
+			attributes = append(attributes, fmt.Sprintf("%s=%v", a.Key, value))
+		}
+	}
+	sort.Strings(attributes)
+
+	status := ""
+	if s.Status.Code == 2 {
+		status = " error=" + strconv.Quote(s.Status.Message)
+	}
+	parent := s.ParentSpanID
+	if parent == "" {
+		parent = "-"
+	}
+	fmt.Printf("%s %s parent=%s %-16s %8.3fms%s %s\n", s.TraceID, s.SpanID, parent, s.Name,
+		float64(end-start)/1e6, status, strings.Join(attributes, " "))
+}
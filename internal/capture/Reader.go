@@ -0,0 +1,123 @@
+package capture
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Reader returns the records of a capture file, or of every capture file of
+// a directory in order. A file cut short, because the proxy is still writing
+// it or stopped without closing it, ends at its last complete record.
+type Reader struct {
+	files   []string
+	file    *os.File
+	gz      *gzip.Reader
+	scanner *bufio.Scanner
+	path    string
+}
+
+// Open reads a single capture file or a capture directory
+func Open(path string) (*Reader, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	files := []string{path}
+	if info.IsDir() {
+		files, err = Files(path)
+		if err != nil {
+			return nil, err
+		}
+		if len(files) == 0 {
+			return nil, fmt.Errorf("capture: no capture files in %s", path)
+		}
+	}
+
+	return &Reader{files: files}, nil
+}
+
+func (r *Reader) next() error {
+	r.closeFile()
+
+	r.path = r.files[0]
+	r.files = r.files[1:]
+
+	file, err := os.Open(r.path)
+	if err != nil {
+		return err
+	}
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("capture: %s: %w", r.path, err)
+	}
+
+	r.file = file
+	r.gz = gz
+	r.scanner = bufio.NewScanner(gz)
+	r.scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	return nil
+}
+
+// Next returns the next record, io.EOF after the last one. Header records
+// are checked and skipped.
+func (r *Reader) Next() (*Record, error) {
+	for {
+		if r.scanner == nil {
+			if len(r.files) == 0 {
+				return nil, io.EOF
+			}
+			if err := r.next(); err != nil {
+				return nil, err
+			}
+		}
+
+		if !r.scanner.Scan() {
+			err := r.scanner.Err()
+			r.closeFile()
+			if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil, fmt.Errorf("capture: %s: %w", r.path, err)
+			}
+			continue
+		}
+
+		var record Record
+		if err := json.Unmarshal(r.scanner.Bytes(), &record); err != nil {
+			// a partly written last line
+			r.closeFile()
+			continue
+		}
+
+		if record.Type == TypeHeader {
+			if record.Version > Version {
+				return nil, fmt.Errorf("capture: %s: unsupported version %d", r.path, record.Version)
+			}
+			continue
+		}
+		return &record, nil
+	}
+}
+
+func (r *Reader) closeFile() {
+	if r.gz != nil {
+		r.gz.Close()
+	}
+	if r.file != nil {
+		r.file.Close()
+	}
+	r.gz = nil
+	r.file = nil
+	r.scanner = nil
+}
+
+func (r *Reader) Close() error {
+	r.closeFile()
+	r.files = nil
+	return nil
+}
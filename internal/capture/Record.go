@@ -0,0 +1,121 @@
+// Package capture is the on-disk format of recorded proxy sessions. A
+// capture is a directory of gzip compressed JSON lines files, each starting
+// with a header record, that the proxy writes and cmd/replay reads back.
+package capture
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+)
+
+// Version is written in the header of every capture file
+const Version = 1
+
+// record types
+const (
+	TypeHeader     = "header"
+	TypeConnect    = "connect"    // User, Database, Client
+	TypeQuery      = "query"      // Query, Digest and the result
+	TypePrepare    = "prepare"    // Statement, Query, Digest
+	TypeExecute    = "execute"    // Statement, Args and the result
+	TypeClose      = "close"      // Statement
+	TypeUseDB      = "use_db"     // Database of a COM_INIT_DB and the result
+	TypeDisconnect = "disconnect" // end of the session
+)
+
+// Record is one line of a capture file. Field names are kept short since
+// there is one record per statement.
+type Record struct {
+	Type      string `json:"t"`
+	Time      int64  `json:"ts"`          // unix nanoseconds the command arrived
+	Session   uint64 `json:"s,omitempty"` // unique within a capture
+	Version   int    `json:"v,omitempty"` // header only
+	User      string `json:"u,omitempty"`
+	Database  string `json:"db,omitempty"`
+	Client    string `json:"c,omitempty"` // client address
+	Query     string `json:"q,omitempty"`
+	Digest    string `json:"dg,omitempty"` // digest of the query, query and prepare records
+	Statement uint32 `json:"st,omitempty"` // prepared statement id within the session
+	Args      []Arg  `json:"a,omitempty"`
+	Duration  int64  `json:"d,omitempty"` // microseconds the proxy took to answer
+	Rows      int    `json:"r,omitempty"` // rows returned
+	Affected  uint64 `json:"af,omitempty"`
+	Error     uint16 `json:"e,omitempty"` // MySQL error code the client got
+}
+
+// Arg is a prepared statement parameter with enough type information to
+// send it back the way the client did
+type Arg struct {
+	Type  string `json:"t"` // null, int, uint, float, string or bytes
+	Value string `json:"v,omitempty"`
+}
+
+// EncodeArgs converts the parameters of a COM_STMT_EXECUTE
+func EncodeArgs(args []interface{}) []Arg {
+	encoded := make([]Arg, len(args))
+	for i, arg := range args {
+		switch v := arg.(type) {
+		case nil:
+			encoded[i] = Arg{Type: "null"}
+		case int8:
+			encoded[i] = Arg{Type: "int", Value: strconv.FormatInt(int64(v), 10)}
+		case int16:
+			encoded[i] = Arg{Type: "int", Value: strconv.FormatInt(int64(v), 10)}
+		case int32:
+			encoded[i] = Arg{Type: "int", Value: strconv.FormatInt(int64(v), 10)}
+		case int64:
+			encoded[i] = Arg{Type: "int", Value: strconv.FormatInt(v, 10)}
+		case int:
+			encoded[i] = Arg{Type: "int", Value: strconv.FormatInt(int64(v), 10)}
+		case uint8:
+			encoded[i] = Arg{Type: "uint", Value: strconv.FormatUint(uint64(v), 10)}
+		case uint16:
+			encoded[i] = Arg{Type: "uint", Value: strconv.FormatUint(uint64(v), 10)}
+		case uint32:
+			encoded[i] = Arg{Type: "uint", Value: strconv.FormatUint(uint64(v), 10)}
+		case uint64:
+			encoded[i] = Arg{Type: "uint", Value: strconv.FormatUint(v, 10)}
+		case float32:
+			encoded[i] = Arg{Type: "float", Value: strconv.FormatFloat(float64(v), 'g', -1, 32)}
+		case float64:
+			encoded[i] = Arg{Type: "float", Value: strconv.FormatFloat(v, 'g', -1, 64)}
+		case string:
+			encoded[i] = Arg{Type: "string", Value: v}
+		case []byte:
+			encoded[i] = Arg{Type: "bytes", Value: base64.StdEncoding.EncodeToString(v)}
+		default:
+			encoded[i] = Arg{Type: "string", Value: fmt.Sprintf("%v", v)}
+		}
+	}
+	return encoded
+}
+
+// DecodeArgs converts recorded parameters back to values client.Stmt.Execute
+// accepts
+func DecodeArgs(args []Arg) ([]interface{}, error) {
+	decoded := make([]interface{}, len(args))
+	for i, arg := range args {
+		var err error
+		switch arg.Type {
+		case "null":
+			decoded[i] = nil
+		case "int":
+			decoded[i], err = strconv.ParseInt(arg.Value, 10, 64)
+		case "uint":
+			decoded[i], err = strconv.ParseUint(arg.Value, 10, 64)
+		case "float":
+			decoded[i], err = strconv.ParseFloat(arg.Value, 64)
+		case "string":
+			decoded[i] = arg.Value
+		case "bytes":
+			decoded[i], err = base64.StdEncoding.DecodeString(arg.Value)
+		default:
+			return nil, fmt.Errorf("unknown argument type: %s", arg.Type)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("argument %d: %w", i, err)
+		}
+	}
+	return decoded, nil
+}
@@ -0,0 +1,176 @@
+package capture
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	filePrefix = "capture-"
+	fileSuffix = ".jsonl.gz"
+)
+
+// Writer appends records to the capture files of a directory, starting a
+// new file once the current one reaches maxSize bytes or is maxAge old and
+// removing the oldest files beyond maxFiles. It is not safe for concurrent
+// use.
+type Writer struct {
+	dir      string
+	maxSize  int64
+	maxAge   time.Duration
+	maxFiles int
+
+	file    *os.File
+	counter *countingWriter
+	gz      *gzip.Writer
+	buf     *bufio.Writer
+	opened  time.Time
+}
+
+// countingWriter tracks the compressed size of the current file
+type countingWriter struct {
+	file *os.File
+	n    int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.file.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func NewWriter(dir string, maxSize int64, maxAge time.Duration, maxFiles int) (*Writer, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("capture: directory is required")
+	}
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, fmt.Errorf("capture: failed to create %s: %w", dir, err)
+	}
+
+	w := &Writer{
+		dir:      dir,
+		maxSize:  maxSize,
+		maxAge:   maxAge,
+		maxFiles: maxFiles,
+	}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *Writer) open() error {
+	now := time.Now()
+	path := filepath.Join(w.dir, filePrefix+now.Format("20060102-150405.000000")+fileSuffix)
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0640)
+	if err != nil {
+		return fmt.Errorf("capture: failed to create %s: %w", path, err)
+	}
+
+	w.file = file
+	w.counter = &countingWriter{file: file}
+	w.gz = gzip.NewWriter(w.counter)
+	w.buf = bufio.NewWriter(w.gz)
+	w.opened = now
+
+	if err := w.encode(&Record{Type: TypeHeader, Time: now.UnixNano(), Version: Version}); err != nil {
+		return err
+	}
+
+	return w.prune()
+}
+
+func (w *Writer) encode(r *Record) error {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if _, err := w.buf.Write(line); err != nil {
+		return err
+	}
+	return w.buf.WriteByte('\n')
+}
+
+// closeFile finishes the gzip stream of the current file
+func (w *Writer) closeFile() error {
+	if err := w.buf.Flush(); err != nil {
+		w.file.Close()
+		return err
+	}
+	if err := w.gz.Close(); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
+
+// prune removes the oldest capture files beyond maxFiles
+func (w *Writer) prune() error {
+	if w.maxFiles <= 0 {
+		return nil
+	}
+	files, err := Files(w.dir)
+	if err != nil {
+		return err
+	}
+	for len(files) > w.maxFiles {
+		if err := os.Remove(files[0]); err != nil {
+			return fmt.Errorf("capture: failed to remove %s: %w", files[0], err)
+		}
+		files = files[1:]
+	}
+	return nil
+}
+
+func (w *Writer) Write(r *Record) error {
+	if (w.maxSize > 0 && w.counter.n >= w.maxSize) || (w.maxAge > 0 && time.Since(w.opened) >= w.maxAge) {
+		if err := w.closeFile(); err != nil {
+			return err
+		}
+		if err := w.open(); err != nil {
+			return err
+		}
+	}
+	return w.encode(r)
+}
+
+// Flush pushes buffered records to the file, a reader sees them up to the
+// last flush even while the file is still being written
+func (w *Writer) Flush() error {
+	if err := w.buf.Flush(); err != nil {
+		return err
+	}
+	return w.gz.Flush()
+}
+
+func (w *Writer) Close() error {
+	return w.closeFile()
+}
+
+// Files returns the capture files of a directory, oldest first
+func Files(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, filePrefix) || !strings.HasSuffix(name, fileSuffix) {
+			continue
+		}
+		files = append(files, filepath.Join(dir, name))
+	}
+	// the timestamp in the name sorts chronologically
+	sort.Strings(files)
+	return files, nil
+}